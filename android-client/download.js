@@ -1,9 +1,8 @@
-
 var url = "https://127.0.0.1/clipboard/get"
-var username = "test"
-var password = "password"
+// personal API token with read scope, created in the web page
+var token = "cbt_xxxxxxxx"
 
-var authorization = "Basic " + $base64.encode(username+":"+password)
+var authorization = "Bearer " + token
 
 console.show();
 
@@ -13,4 +12,4 @@ var r = http.get(url, {
     }
 });
 log("code = " + r.statusCode);
-log("html = " + r.body.string());
\ No newline at end of file
+log("html = " + r.body.string());
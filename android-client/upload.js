@@ -0,0 +1,18 @@
+var url = "https://127.0.0.1/clipboard/set"
+// personal API token with write scope, created in the web page
+var token = "cbt_xxxxxxxx"
+
+var authorization = "Bearer " + token
+
+console.show();
+
+var r = http.postJson(url, {
+    client_id: "android",
+    content: getClip()
+}, {
+    headers: {
+        'Authorization': authorization
+    }
+});
+log("code = " + r.statusCode);
+log("html = " + r.body.string());
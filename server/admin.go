@@ -0,0 +1,80 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "fmt"
+  "net/http"
+
+  "github.com/gorilla/mux"
+)
+
+// AdminRequiredInfo request body of the two factor requirement API
+type AdminRequiredInfo struct {
+  Required bool `json:"required"`
+}
+
+// AdminMDW administrator check middleware func, must be used after UserBasicAuthMDW
+func AdminMDW(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    user := RequestUser(r)
+    if !GlobalConfig.IsAdmin(user) {
+      reqLog(r).Errorln("User is not administrator:", user)
+      auditRequest(r, AuditAdmin, user, false, r.Method+" "+r.URL.Path)
+
+      rest := RestfulRespInfo{
+        Writer: w,
+        Response: utils.RespInfo{
+          Code:    http.StatusForbidden,
+          Message: "Permission Denied.",
+        },
+      }
+
+      rest.send()
+      return
+    }
+
+    next.ServeHTTP(w, r)
+  })
+}
+
+// AdminTwoFactorHandlerFunc require or release two factor authentication for a user
+func (clip *ClipHandler) AdminTwoFactorHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := mux.Vars(r)["user"]
+
+  // restful API reponse sender
+  rest := RestfulRespInfo{
+    Writer: w,
+    Response: utils.RespInfo{
+      Code:    http.StatusOK,
+      Message: "Set two factor requirement succeed.",
+    },
+  }
+
+  defer rest.send()
+
+  var info AdminRequiredInfo
+  if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+    rest.Response.Code = http.StatusBadRequest
+    rest.Response.Message = err.Error()
+    return
+  }
+
+  if DB.GetUserByName(user) == nil {
+    rest.Response.Code = http.StatusNotFound
+    rest.Response.Message = "User Not Found."
+    return
+  }
+
+  err := DB.SetTwoFactorRequired(user, info.Required)
+  if err != nil {
+    reqLog(r).Errorln("Failed to set two factor requirement for user:", user, err)
+
+    rest.Response.Code = http.StatusInternalServerError
+    rest.Response.Message = "Set Two Factor Requirement Failed."
+    return
+  }
+
+  reqLog(r).Infof("Admin(%s) set two factor required(%v) for user(%s).", RequestUser(r), info.Required, user)
+  auditRequest(r, AuditAdmin, RequestUser(r), true, fmt.Sprintf("set two factor required(%v) for user(%s)", info.Required, user))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "strconv"
+
+  log "github.com/sirupsen/logrus"
+)
+
+// audit events
+const (
+  AuditLogin            = "login"
+  AuditLogout           = "logout"
+  AuditRegister         = "register"
+  AuditLockout          = "lockout"
+  AuditDeviceRegister   = "device.register"
+  AuditDeviceTerminate  = "device.terminate"
+  AuditClipboardPush    = "clipboard.push"
+  AuditTokenCreate      = "token.create"
+  AuditTokenRevoke      = "token.revoke"
+  AuditTwoFactorEnable  = "2fa.enable"
+  AuditTwoFactorDisable = "2fa.disable"
+  AuditAdmin            = "admin"
+)
+
+// default count of records returned by the audit query API
+const auditDefaultLimit = 100
+
+// AuditRespInfo response of the audit query API
+type AuditRespInfo struct {
+  Code    int               `json:"code"`
+  Message string            `json:"message"`
+  Data    []utils.AuditInfo `json:"data"`
+}
+
+// recordAudit store the audit record, failures are only logged so they never break the request
+func recordAudit(audit *utils.AuditInfo) {
+  if err := DB.InsertAudit(audit); err != nil {
+    log.Errorf("Failed to record audit(%s) of user(%s), error: %v.", audit.Event, audit.Username, err)
+  }
+}
+
+// auditRequest record an event of the http request
+func auditRequest(r *http.Request, event string, user string, success bool, detail string) {
+  recordAudit(&utils.AuditInfo{
+    Event:    event,
+    Username: user,
+    RemoteIP: clientIP(r),
+    Success:  success,
+    Detail:   detail,
+  })
+}
+
+// auditFilter parse the filters of the audit query string
+func auditFilter(r *http.Request) (*utils.AuditFilter, error) {
+  query := r.URL.Query()
+
+  filter := &utils.AuditFilter{
+    Event:    query.Get("event"),
+    Username: query.Get("user"),
+    ClientID: query.Get("client"),
+    RemoteIP: query.Get("ip"),
+    Since:    query.Get("since"),
+    Until:    query.Get("until"),
+  }
+
+  if value := query.Get("success"); value != "" {
+    success, err := strconv.ParseBool(value)
+    if err != nil {
+      return nil, err
+    }
+    filter.Success = &success
+  }
+
+  if value := query.Get("limit"); value != "" {
+    limit, err := strconv.Atoi(value)
+    if err != nil || limit < 0 {
+      return nil, strconv.ErrSyntax
+    }
+    filter.Limit = limit
+  }
+
+  return filter, nil
+}
+
+// AdminAuditHandlerFunc query the audit records, newest first
+func (clip *ClipHandler) AdminAuditHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  resp := AuditRespInfo{
+    Code:    http.StatusOK,
+    Message: "Get audit succeed.",
+  }
+
+  filter, err := auditFilter(r)
+  if err == nil {
+    if filter.Limit == 0 {
+      filter.Limit = auditDefaultLimit
+    }
+    resp.Data, err = DB.GetAudits(filter)
+    if err != nil {
+      reqLog(r).Errorln("Failed to get audit:", err)
+
+      resp.Code = http.StatusInternalServerError
+      resp.Message = "Get Audit Failed."
+    }
+  } else {
+    resp.Code = http.StatusBadRequest
+    resp.Message = "Invalid Audit Filter."
+  }
+
+  b, _ := json.Marshal(resp)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(resp.Code)
+  w.Write(b)
+}
+
+// AdminAuditExportHandlerFunc export the matched audit records as JSON lines
+func (clip *ClipHandler) AdminAuditExportHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  filter, err := auditFilter(r)
+  if err != nil {
+    http.Error(w, "Invalid Audit Filter.", http.StatusBadRequest)
+    return
+  }
+
+  audits, err := DB.GetAudits(filter)
+  if err != nil {
+    reqLog(r).Errorln("Failed to export audit:", err)
+    http.Error(w, "Export Audit Failed.", http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/x-ndjson")
+  w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+
+  enc := json.NewEncoder(w)
+  for i := range audits {
+    enc.Encode(&audits[i])
+  }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "bufio"
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "testing"
+)
+
+func TestAuditLog(t *testing.T) {
+  handler := setupTestServer(t)
+  GlobalConfig.Admins = []string{"admin"}
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "admin", Password: "admin-pass"}, {User: "u1", Password: "pass"}})
+
+  browser := newTestBrowser(handler)
+  browser.do("GET", "/login", nil)
+  browser.do("POST", "/login", url.Values{"username": {"u1"}, "password": {"wrong"}})
+  browser.do("POST", "/login", url.Values{"username": {"u1"}, "password": {"pass"}})
+  browser.do("GET", "/content", nil)
+  browser.do("POST", "/logout", url.Values{})
+
+  request := func(user string, target string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("GET", target, nil)
+    req.SetBasicAuth(user, DB.GetPassword(user))
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, req)
+    return w
+  }
+
+  if w := request("u1", "/admin/audit"); w.Code != http.StatusForbidden {
+    t.Fatal("Only administrators can read the audit:", w.Code)
+  }
+
+  w := request("admin", "/admin/audit?event=login&user=u1")
+  var resp AuditRespInfo
+  if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != http.StatusOK {
+    t.Fatal("Failed to query audit:", w.Code, err)
+  }
+
+  if len(resp.Data) != 2 || !resp.Data[0].Success || resp.Data[1].Success || resp.Data[0].Detail != "password" {
+    t.Fatal("Login audit not matched:", resp.Data)
+  }
+
+  if w := request("admin", "/admin/audit?success=maybe"); w.Code != http.StatusBadRequest {
+    t.Fatal("Invalid filter should be rejected:", w.Code)
+  }
+
+  w = request("admin", "/admin/audit/export?user=u1")
+  if w.Header().Get("Content-Type") != "application/x-ndjson" {
+    t.Fatal("Export should be JSON lines:", w.Header().Get("Content-Type"))
+  }
+
+  events := map[string]bool{}
+  scanner := bufio.NewScanner(w.Body)
+  for scanner.Scan() {
+    var audit utils.AuditInfo
+    if err := json.Unmarshal(scanner.Bytes(), &audit); err != nil {
+      t.Fatal("Invalid JSON line:", scanner.Text())
+    }
+    events[audit.Event] = true
+  }
+
+  if !events[AuditLogin] || !events[AuditLogout] || !events[AuditAdmin] {
+    t.Fatal("Exported events not matched:", events)
+  }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "fmt"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+// AuthBackend verify the user credentials
+type AuthBackend interface {
+  // Authenticate check the plain password of the user
+  Authenticate(user string, password string) error
+
+  // AuthenticateHash check the bcrypt hash of the password sent by the websocket clients
+  AuthenticateHash(user string, hash string) error
+
+  // Lookup check the user exists, for the users authenticated otherwise, e.g. by certificate
+  Lookup(user string) error
+}
+
+// NewAuthBackend return the backend selected by the auth-backend config
+func NewAuthBackend(config *utils.ServerConfig) (AuthBackend, error) {
+  switch config.AuthBackend {
+  case "local":
+    return localBackend{}, nil
+  case "ldap":
+    return NewLDAPBackend(&config.LDAP), nil
+  case "chained":
+    return chainedBackend{localBackend{}, NewLDAPBackend(&config.LDAP)}, nil
+  default:
+    return nil, fmt.Errorf("unknown auth backend: %s", config.AuthBackend)
+  }
+}
+
+// localBackend authenticate the users in the userinfo table
+type localBackend struct{}
+
+func (localBackend) Authenticate(user string, password string) error {
+  pass := DB.GetPassword(user)
+
+  // if no password find means user not exist
+  if pass == "" || pass != password {
+    return utils.ErrAuthFailed
+  }
+
+  return nil
+}
+
+func (localBackend) AuthenticateHash(user string, hash string) error {
+  pass := DB.GetPassword(user)
+  if pass == "" {
+    return utils.ErrAuthFailed
+  }
+
+  return bcrypt.CompareHashAndPassword(utils.StringToBytes(hash), utils.StringToBytes(pass))
+}
+
+func (localBackend) Lookup(user string) error {
+  if DB.GetUserByName(user) == nil {
+    return utils.ErrAuthFailed
+  }
+
+  return nil
+}
+
+// chainedBackend try the backends in order, succeed on the first match
+type chainedBackend []AuthBackend
+
+func (c chainedBackend) Authenticate(user string, password string) error {
+  err := utils.ErrAuthFailed
+  for _, backend := range c {
+    if err = backend.Authenticate(user, password); err == nil {
+      return nil
+    }
+  }
+
+  return err
+}
+
+func (c chainedBackend) AuthenticateHash(user string, hash string) error {
+  err := utils.ErrAuthFailed
+  for _, backend := range c {
+    if err = backend.AuthenticateHash(user, hash); err == nil {
+      return nil
+    }
+  }
+
+  return err
+}
+
+func (c chainedBackend) Lookup(user string) error {
+  err := utils.ErrAuthFailed
+  for _, backend := range c {
+    if err = backend.Lookup(user); err == nil {
+      return nil
+    }
+  }
+
+  return err
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/fsnotify/fsnotify"
+  log "github.com/sirupsen/logrus"
+)
+
+// files of the generated certificates in the certificate directory
+const (
+  caCertName     = "ca.crt"
+  caKeyName      = "ca.key"
+  serverCertName = "server.crt"
+  serverKeyName  = "server.key"
+)
+
+// wait for the writes of a certificate update to settle before reloading
+const certReloadDelay = 500 * time.Millisecond
+
+// CertReloader serve the certificate files and reload them on change, the established
+// connections keep the certificate of their handshake
+type CertReloader struct {
+  sync.RWMutex
+
+  certFile string
+  keyFile  string
+
+  // CA file of the generated certificates, empty if the certificate is configured
+  caFile string
+
+  cert          *tls.Certificate
+  fingerprint   string
+  caFingerprint string
+
+  // called after each successful reload
+  onReload []func()
+}
+
+// NewCertReloader load the certificate files
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+  reloader := &CertReloader{
+    certFile: certFile,
+    keyFile:  keyFile,
+  }
+
+  if err := reloader.Reload(); err != nil {
+    return nil, err
+  }
+
+  return reloader, nil
+}
+
+// Reload load the certificate files again, the current certificate is kept on failure
+func (c *CertReloader) Reload() error {
+  cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+  if err != nil {
+    return err
+  }
+
+  // send the generated CA with the certificate, so the clients can pin the CA
+  caFingerprint := ""
+  if c.caFile != "" {
+    ca, err := utils.LoadCertFile(c.caFile)
+    if err != nil {
+      return err
+    }
+
+    if len(cert.Certificate) == 1 {
+      cert.Certificate = append(cert.Certificate, ca.Raw)
+    }
+    caFingerprint = utils.CertFingerprint(ca.Raw)
+  }
+
+  c.Lock()
+  c.cert = &cert
+  c.fingerprint = utils.CertFingerprint(cert.Certificate[0])
+  c.caFingerprint = caFingerprint
+  onReload := c.onReload
+  c.Unlock()
+
+  for _, fn := range onReload {
+    fn()
+  }
+
+  return nil
+}
+
+// OnReload call the function after each successful reload
+func (c *CertReloader) OnReload(fn func()) {
+  c.Lock()
+  defer c.Unlock()
+
+  c.onReload = append(c.onReload, fn)
+}
+
+// GetCertificate return the current certificate for the TLS handshakes
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  c.RLock()
+  defer c.RUnlock()
+
+  return c.cert, nil
+}
+
+// Fingerprint return the sha256 fingerprint of the current certificate
+func (c *CertReloader) Fingerprint() string {
+  c.RLock()
+  defer c.RUnlock()
+
+  return c.fingerprint
+}
+
+// CAFingerprint return the sha256 fingerprint of the generated CA, empty if the certificate is configured
+func (c *CertReloader) CAFingerprint() string {
+  c.RLock()
+  defer c.RUnlock()
+
+  return c.caFingerprint
+}
+
+// Watch reload the certificate when its files change until the context is done. The
+// directories are watched, so the files replaced by renaming are noticed as well.
+func (c *CertReloader) Watch(ctx context.Context) error {
+  watcher, err := fsnotify.NewWatcher()
+  if err != nil {
+    return err
+  }
+
+  files := map[string]bool{}
+  for _, file := range []string{c.certFile, c.keyFile} {
+    file = filepath.Clean(file)
+    files[file] = true
+
+    if err := watcher.Add(filepath.Dir(file)); err != nil {
+      watcher.Close()
+      return err
+    }
+  }
+
+  go func() {
+    defer watcher.Close()
+
+    timer := time.NewTimer(certReloadDelay)
+    timer.Stop()
+
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case event, ok := <-watcher.Events:
+        if !ok {
+          return
+        }
+        if files[filepath.Clean(event.Name)] {
+          timer.Reset(certReloadDelay)
+        }
+      case err, ok := <-watcher.Errors:
+        if !ok {
+          return
+        }
+        log.Errorln("Failed to watch certificate:", err)
+      case <-timer.C:
+        if err := c.Reload(); err != nil {
+          log.Errorln("Failed to reload certificate:", err)
+        } else {
+          log.Infoln("Certificate reloaded, fingerprint:", c.Fingerprint())
+        }
+      }
+    }
+  }()
+
+  return nil
+}
+
+// certHosts return the names and addresses the generated certificate is valid for, from
+// the listen address, the configured hosts and the local interfaces
+func certHosts(config *utils.ServerConfig) []string {
+  hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+  if host, _, err := net.SplitHostPort(config.Address); err == nil && host != "" {
+    if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+      hosts = append(hosts, host)
+    }
+  }
+
+  hosts = append(hosts, config.Certificate.Hosts...)
+
+  if name, err := os.Hostname(); err == nil && name != "" {
+    hosts = append(hosts, name)
+    if !strings.Contains(name, ".") {
+      hosts = append(hosts, name+".local")
+    }
+  }
+
+  if addrs, err := net.InterfaceAddrs(); err == nil {
+    for _, addr := range addrs {
+      if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+        hosts = append(hosts, ipNet.IP.String())
+      }
+    }
+  }
+
+  // remove the duplicates
+  seen := map[string]bool{}
+  result := hosts[:0]
+  for _, host := range hosts {
+    if !seen[host] {
+      seen[host] = true
+      result = append(result, host)
+    }
+  }
+
+  return result
+}
+
+// generateCert create the local CA and the server certificate in the directory if they
+// are missing, the server certificate is renewed if it does not cover all the hosts
+func generateCert(dir string, hosts []string) (*CertReloader, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+
+  caCert := filepath.Join(dir, caCertName)
+  caKey := filepath.Join(dir, caKeyName)
+  if !utils.Exists(caCert) || !utils.Exists(caKey) {
+    name, _ := os.Hostname()
+    if err := utils.CreateCA(caCert, caKey, "clipboard-remote CA "+name); err != nil {
+      return nil, err
+    }
+    log.Infoln("Generated local CA:", caCert)
+  }
+
+  certFile := filepath.Join(dir, serverCertName)
+  keyFile := filepath.Join(dir, serverKeyName)
+  if !utils.Exists(keyFile) || !utils.CertCoversHosts(certFile, hosts) {
+    err := utils.CreateCert(caCert, caKey, certFile, keyFile, &utils.CertRequest{CommonName: hosts[0], Hosts: hosts})
+    if err != nil {
+      return nil, err
+    }
+    log.Infoln("Generated server certificate for:", strings.Join(hosts, ", "))
+  }
+
+  reloader := &CertReloader{
+    certFile: certFile,
+    keyFile:  keyFile,
+    caFile:   caCert,
+  }
+
+  if err := reloader.Reload(); err != nil {
+    return nil, err
+  }
+
+  return reloader, nil
+}
+
+// serverTLSConfig return the TLS config serving the current certificate and verifying the
+// client certificates if mutual TLS is enabled
+func serverTLSConfig(config *utils.ClientAuthConfig, certs *CertReloader) (*tls.Config, error) {
+  tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+
+  switch config.Mode {
+  case "none":
+    return tlsConfig, nil
+  case "request":
+    tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+  case "require":
+    tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+  default:
+    return nil, fmt.Errorf("unknown client auth mode: %s", config.Mode)
+  }
+
+  caFile := config.CAFile
+  if caFile == "" {
+    caFile = certs.caFile
+  }
+  if caFile == "" {
+    return nil, errors.New("no CA file for the client certificates")
+  }
+
+  b, err := os.ReadFile(caFile)
+  if err != nil {
+    return nil, err
+  }
+
+  tlsConfig.ClientCAs = x509.NewCertPool()
+  if !tlsConfig.ClientCAs.AppendCertsFromPEM(b) {
+    return nil, fmt.Errorf("no certificate in %s", caFile)
+  }
+
+  return tlsConfig, nil
+}
+
+// certificateUser return the username and the device of the verified client certificate,
+// the common name must be an existing user
+func certificateUser(r *http.Request) (string, string, bool) {
+  if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+    return "", "", false
+  }
+
+  subject := r.TLS.VerifiedChains[0][0].Subject
+  if subject.CommonName == "" {
+    return "", "", false
+  }
+
+  if err := Authenticator.Lookup(subject.CommonName); err != nil {
+    reqLog(r).Warnf("Unknown user(%s) of the client certificate.", subject.CommonName)
+    return "", "", false
+  }
+
+  device := ""
+  if len(subject.OrganizationalUnit) > 0 {
+    device = subject.OrganizationalUnit[0]
+  }
+
+  return subject.CommonName, device, true
+}
+
+// issueClientCert create a client certificate signed by the generated CA, the spec is user
+// or user/device, the files are named after it in the certificate directory
+func issueClientCert(dir string, spec string) (string, error) {
+  user, device, _ := strings.Cut(spec, "/")
+  if user == "" {
+    return "", errors.New("no username in " + spec)
+  }
+
+  name := user
+  if device != "" {
+    name += "-" + device
+  }
+
+  certFile := filepath.Join(dir, name+".crt")
+  keyFile := filepath.Join(dir, name+".key")
+  err := utils.CreateCert(filepath.Join(dir, caCertName), filepath.Join(dir, caKeyName), certFile, keyFile, &utils.CertRequest{
+    CommonName: user,
+    Unit:       device,
+    Client:     true,
+  })
+  if err != nil {
+    return "", err
+  }
+
+  return certFile, nil
+}
+
+// CertRespInfo response of the certificate API
+type CertRespInfo struct {
+  Code          int    `json:"code"`
+  Message       string `json:"message"`
+  Fingerprint   string `json:"fingerprint"`
+  CAFingerprint string `json:"ca_fingerprint,omitempty"`
+}
+
+// CertificateHandlerFunc return the fingerprints for the clients to pin
+func (clip *ClipHandler) CertificateHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  resp := CertRespInfo{
+    Code:    http.StatusOK,
+    Message: "Get certificate succeed.",
+  }
+
+  if Certificates != nil {
+    resp.Fingerprint = Certificates.Fingerprint()
+    resp.CAFingerprint = Certificates.CAFingerprint()
+  } else {
+    resp.Code = http.StatusNotFound
+    resp.Message = "No Certificate."
+  }
+
+  b, _ := json.Marshal(resp)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(resp.Code)
+  w.Write(b)
+}
+
+// CACertHandlerFunc download the generated CA certificate for the clients to trust
+func (clip *ClipHandler) CACertHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  if Certificates == nil || Certificates.caFile == "" {
+    http.NotFound(w, r)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/x-pem-file")
+  w.Header().Set("Content-Disposition", `attachment; filename="`+caCertName+`"`)
+  http.ServeFile(w, r, Certificates.caFile)
+}
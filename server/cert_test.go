@@ -0,0 +1,224 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "crypto/tls"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+)
+
+func TestCertReloader(t *testing.T) {
+  dir := t.TempDir()
+
+  reloader, err := generateCert(dir, []string{"localhost", "127.0.0.1"})
+  if err != nil {
+    t.Fatal("Failed to generate certificate:", err)
+  }
+
+  if reloader.CAFingerprint() == "" || reloader.Fingerprint() == reloader.CAFingerprint() {
+    t.Fatal("Server and CA fingerprints should be set.")
+  }
+
+  // the CA is sent with the certificate for the clients pinning it
+  if cert, _ := reloader.GetCertificate(nil); len(cert.Certificate) != 2 || utils.CertFingerprint(cert.Certificate[1]) != reloader.CAFingerprint() {
+    t.Fatal("Certificate chain should contain the CA.")
+  }
+
+  // a second start keeps the certificate
+  again, err := generateCert(dir, []string{"localhost", "127.0.0.1"})
+  if err != nil || again.Fingerprint() != reloader.Fingerprint() {
+    t.Fatal("Certificate should be kept:", err)
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  if err := reloader.Watch(ctx); err != nil {
+    t.Fatal("Failed to watch certificate:", err)
+  }
+
+  // replace the certificate, the watcher reloads it
+  old := reloader.Fingerprint()
+  tmpCert, tmpKey := filepath.Join(dir, "new.crt"), filepath.Join(dir, "new.key")
+  err = utils.CreateCert(filepath.Join(dir, caCertName), filepath.Join(dir, caKeyName), tmpCert, tmpKey, &utils.CertRequest{CommonName: "localhost", Hosts: []string{"localhost"}})
+  if err != nil {
+    t.Fatal("Failed to create certificate:", err)
+  }
+  os.Rename(tmpKey, filepath.Join(dir, serverKeyName))
+  os.Rename(tmpCert, filepath.Join(dir, serverCertName))
+
+  for i := 0; i < 50 && reloader.Fingerprint() == old; i++ {
+    time.Sleep(100 * time.Millisecond)
+  }
+  if reloader.Fingerprint() == old {
+    t.Fatal("Certificate should be reloaded.")
+  }
+
+  // a broken file keeps the current certificate
+  current := reloader.Fingerprint()
+  os.WriteFile(filepath.Join(dir, serverCertName), []byte("broken"), 0644)
+  if reloader.Reload() == nil || reloader.Fingerprint() != current {
+    t.Fatal("Broken certificate should not be loaded.")
+  }
+
+  cert, _ := reloader.GetCertificate(nil)
+  if cert == nil {
+    t.Fatal("Certificate should still be served.")
+  }
+}
+
+// announcement recording its TXT records
+type testAnnounce struct {
+  text []string
+}
+
+func (a *testAnnounce) SetText(text []string) {
+  a.text = text
+}
+
+func TestCertReannounce(t *testing.T) {
+  dir := t.TempDir()
+  if _, err := generateCert(dir, []string{"localhost"}); err != nil {
+    t.Fatal("Failed to generate certificate:", err)
+  }
+
+  // configured certificate files, no CA fingerprint is announced
+  certFile, keyFile := filepath.Join(dir, "own.crt"), filepath.Join(dir, "own.key")
+  issue := func() {
+    err := utils.CreateCert(filepath.Join(dir, caCertName), filepath.Join(dir, caKeyName), certFile, keyFile, &utils.CertRequest{CommonName: "localhost", Hosts: []string{"localhost"}})
+    if err != nil {
+      t.Fatal("Failed to create certificate:", err)
+    }
+  }
+  issue()
+
+  reloader, err := NewCertReloader(certFile, keyFile)
+  if err != nil {
+    t.Fatal("Failed to load certificate:", err)
+  }
+
+  old := Certificates
+  Certificates = reloader
+  defer func() { Certificates = old }()
+
+  announced := &testAnnounce{}
+  reannounce(&utils.ServerConfig{}, reloader, announced)
+
+  // the fingerprint of the new certificate is announced after the reload
+  first := reloader.Fingerprint()
+  issue()
+  if err := reloader.Reload(); err != nil {
+    t.Fatal("Failed to reload certificate:", err)
+  }
+  if reloader.Fingerprint() == first {
+    t.Fatal("Certificate should be replaced.")
+  }
+
+  info := utils.ParseDiscoveryTXT(announced.text)
+  if info.Fingerprint != reloader.Fingerprint() || info.CAFingerprint != "" {
+    t.Fatal("Reloaded fingerprint should be announced:", announced.text)
+  }
+
+  // a failed reload keeps the announcement
+  announced.text = nil
+  os.WriteFile(certFile, []byte("broken"), 0644)
+  if reloader.Reload() == nil || announced.text != nil {
+    t.Fatal("Failed reload should not be announced.")
+  }
+}
+
+func TestClientCertificate(t *testing.T) {
+  handler := setupTestServer(t)
+  GlobalConfig.ClientAuth = utils.ClientAuthConfig{Mode: "request"}
+
+  // test CA, server and client certificates
+  dir := t.TempDir()
+  certs, err := generateCert(dir, []string{"127.0.0.1"})
+  if err != nil {
+    t.Fatal("Failed to generate certificate:", err)
+  }
+
+  certFile, err := issueClientCert(dir, "u1/dev1")
+  if err != nil {
+    t.Fatal("Failed to issue client certificate:", err)
+  }
+
+  // the common name of an admin which is not a user
+  GlobalConfig.Admins = []string{"root"}
+  rootFile, err := issueClientCert(dir, "root")
+  if err != nil {
+    t.Fatal("Failed to issue client certificate:", err)
+  }
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "p1"}})
+
+  server := httptest.NewUnstartedServer(handler)
+  server.TLS, err = serverTLSConfig(&GlobalConfig.ClientAuth, certs)
+  if err != nil {
+    t.Fatal("Failed to init TLS config:", err)
+  }
+  // httptest sets its own certificate if none is given, and IP addresses are not sent by SNI
+  cert, _ := certs.GetCertificate(nil)
+  server.TLS.Certificates = []tls.Certificate{*cert}
+  server.StartTLS()
+  defer server.Close()
+
+  addr := strings.TrimPrefix(server.URL, "https://")
+  caFile := filepath.Join(dir, caCertName)
+
+  withCert, err := utils.NewCertTrust(&utils.ClientConfig{CAFile: caFile, ClientCert: certFile, ClientKey: strings.TrimSuffix(certFile, ".crt") + ".key"})
+  if err != nil {
+    t.Fatal("Failed to load client certificate:", err)
+  }
+  withoutCert, _ := utils.NewCertTrust(&utils.ClientConfig{CAFile: caFile})
+  unknownCert, err := utils.NewCertTrust(&utils.ClientConfig{CAFile: caFile, ClientCert: rootFile, ClientKey: strings.TrimSuffix(rootFile, ".crt") + ".key"})
+  if err != nil {
+    t.Fatal("Failed to load client certificate:", err)
+  }
+
+  set := func(trust *utils.CertTrust) int {
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: trust.TLSConfig("127.0.0.1", addr)}}
+    resp, err := client.Post(server.URL+"/clipboard/set", "application/json", strings.NewReader(`{"client_id":"script","content":"hello"}`))
+    if err != nil {
+      t.Fatal("Failed to set clipboard:", err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+  }
+
+  if code := set(withCert); code != http.StatusOK {
+    t.Fatal("Client certificate should authenticate:", code)
+  }
+
+  if code := set(withoutCert); code != http.StatusUnauthorized {
+    t.Fatal("No certificate and no password should be rejected:", code)
+  }
+
+  if code := set(unknownCert); code != http.StatusUnauthorized {
+    t.Fatal("Certificate of an unknown user should be rejected:", code)
+  }
+
+  // the websocket client needs no password and gets the device of the certificate
+  dialer := websocket.Dialer{TLSClientConfig: withCert.TLSConfig("127.0.0.1", addr)}
+  conn, _, err := dialer.Dial("wss://"+addr+"/websocket", nil)
+  if err != nil {
+    t.Fatal("Failed to dial websocket:", err)
+  }
+  defer disconnect(t, conn, "dev1")
+
+  msg := &utils.WebsocketMessage{Action: utils.ActionHandshakeRegister, UserID: "other", Data: []byte("::auto")}
+  conn.WriteMessage(websocket.BinaryMessage, msg.Encode())
+
+  _, b, err := conn.ReadMessage()
+  ready := &utils.WebsocketMessage{}
+  if err != nil || ready.Decode(b) != nil || ready.Action != utils.ActionHandshakeReady || ready.UserID != "dev1" {
+    t.Fatal("Certificate client should register as its device:", err, ready.UserID)
+  }
+}
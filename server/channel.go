@@ -0,0 +1,100 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "fmt"
+  "regexp"
+)
+
+// channelNamePattern names of the channels
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// subscription channels subscribed by a client, applied by the router
+type subscription struct {
+  client   *Client
+  channels map[string]bool
+}
+
+// checkChannels validate the configured channels
+func checkChannels(channels []utils.ChannelConfig) error {
+  names := make(map[string]bool)
+  for _, channel := range channels {
+    if !channelNamePattern.MatchString(channel.Name) {
+      return fmt.Errorf("invalid channel name: %q", channel.Name)
+    }
+
+    if names[channel.Name] {
+      return fmt.Errorf("duplicate channel: %s", channel.Name)
+    }
+    names[channel.Name] = true
+  }
+
+  return nil
+}
+
+// findChannel return the configured channel, nil if not found
+func findChannel(name string) *utils.ChannelConfig {
+  for i := range GlobalConfig.Channels {
+    if GlobalConfig.Channels[i].Name == name {
+      return &GlobalConfig.Channels[i]
+    }
+  }
+
+  return nil
+}
+
+// channelMember return whether the device of the user is a member of the channel, an
+// empty device only matches the members listed by username
+func channelMember(name string, user string, device string) bool {
+  channel := findChannel(name)
+  if channel == nil || user == "" {
+    return false
+  }
+
+  for _, member := range channel.Members {
+    if member == user || (device != "" && member == user+"/"+device) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// userChannels return the channels the user is a member of with all its devices
+func userChannels(user string) []string {
+  var names []string
+  for _, channel := range GlobalConfig.Channels {
+    if channelMember(channel.Name, user, "") {
+      names = append(names, channel.Name)
+    }
+  }
+
+  return names
+}
+
+// handSubscribeMsg subscribe the client to the channels it is a member of, the router
+// replies with the subscribed ones
+func (c *Client) handSubscribeMsg(wsm *utils.WebsocketMessage) error {
+  if c.id == "" || c.username == "" {
+    return utils.ErrUnAuthenticatedClient
+  }
+
+  var names []string
+  if err := json.Unmarshal(wsm.Data, &names); err != nil {
+    return utils.ErrBadAction
+  }
+
+  channels := make(map[string]bool)
+  for _, name := range names {
+    if channelMember(name, c.username, c.id) {
+      channels[name] = true
+    } else {
+      c.logger().Warnf("Client is not a member of channel %s.", name)
+    }
+  }
+
+  c.router.subscribe <- &subscription{client: c, channels: channels}
+
+  return nil
+}
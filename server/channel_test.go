@@ -0,0 +1,95 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestChannels(t *testing.T) {
+  handler := setupTestServer(t)
+
+  if checkChannels([]utils.ChannelConfig{{Name: "a b"}}) == nil || checkChannels([]utils.ChannelConfig{{Name: "a"}, {Name: "a"}}) == nil {
+    t.Fatal("Invalid and duplicate channel names should be rejected.")
+  }
+
+  GlobalConfig.Channels = []utils.ChannelConfig{{Name: "team", Members: []string{"u1", "u2/room"}}}
+  if !channelMember("team", "u2", "room") || channelMember("team", "u2", "laptop") || channelMember("team", "u2", "") {
+    t.Fatal("Device member should only match its device.")
+  }
+  if names := userChannels("u1"); len(names) != 1 || userChannels("u2") != nil {
+    t.Fatal("Only the user members should list the channel:", names)
+  }
+
+  router := NewRouter()
+  go router.run()
+
+  newClient := func(user string, id string, channels ...string) *Client {
+    c := &Client{router: router, send: make(chan []byte, 4), id: id, username: user, auto: true, scope: utils.ScopeReadWrite}
+    router.register <- c
+
+    subscribed := make(map[string]bool)
+    for _, name := range channels {
+      subscribed[name] = true
+    }
+    router.subscribe <- &subscription{client: c, channels: subscribed}
+
+    if wsm := nextMessage(t, c); wsm.Action != utils.ActionSubscribe {
+      t.Fatal("Subscription should be replied:", wsm.Action)
+    }
+    return c
+  }
+
+  laptop := newClient("u1", "laptop", "team")
+  phone := newClient("u1", "phone")
+  room := newClient("u2", "room", "team")
+
+  router.broadcast <- &Message{id: "laptop", username: "u1", content: []byte("hi"), hash: "h1", channel: "team", created: time.Now()}
+
+  if wsm := nextMessage(t, room); wsm.Channel != "team" || string(wsm.Data) != "hi" {
+    t.Fatal("Channel clip should be delivered with its channel:", wsm.Channel)
+  }
+
+  // personal clips stay within the user
+  router.broadcast <- &Message{id: "phone", username: "u1", content: []byte("mine"), hash: "h2", created: time.Now()}
+  if wsm := nextMessage(t, laptop); string(wsm.Data) != "mine" {
+    t.Fatal("Personal clip should be delivered to the other device:", string(wsm.Data))
+  }
+
+  if len(phone.send) != 0 || len(room.send) != 0 {
+    t.Fatal("Unsubscribed device and other users should receive nothing.")
+  }
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}, {User: "u2", Password: "pass"}})
+  request := func(user string, method string, target string, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, target, strings.NewReader(body))
+    req.SetBasicAuth(user, "pass")
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, req)
+    return w
+  }
+
+  if w := request("u2", "POST", "/clipboard/set", `{"client_id":"laptop","content":"x","channel":"team"}`); w.Code != http.StatusForbidden {
+    t.Fatal("Non member device should not send to the channel:", w.Code)
+  }
+
+  if w := request("u1", "POST", "/clipboard/set", `{"client_id":"script","content":"shared","channel":"team"}`); w.Code != http.StatusOK {
+    t.Fatal("Member should send to the channel:", w.Code)
+  }
+
+  w := request("u1", "GET", "/clipboard/get?channel=team", "")
+  var resp utils.RespInfo
+  json.Unmarshal(w.Body.Bytes(), &resp)
+  if resp.Data == nil || resp.Data.Content != "shared" {
+    t.Fatal("Channel clip should be returned:", w.Body.String())
+  }
+
+  if w := request("u2", "GET", "/clipboard/get?channel=team", ""); w.Code != http.StatusForbidden {
+    t.Fatal("Device member should not read the channel by REST:", w.Code)
+  }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "errors"
+  "net"
+  "os"
+
+  "github.com/grandcat/zeroconf"
+)
+
+// discoveryInfo return the identity of the server announced by mDNS
+func discoveryInfo(config *utils.ServerConfig) *utils.DiscoveryInfo {
+  info := &utils.DiscoveryInfo{
+    Version: utils.Version,
+    Name:    config.MDNS.Name,
+    Path:    config.WebsocketPath,
+    Scheme:  "https",
+  }
+
+  if info.Name == "" {
+    info.Name, _ = os.Hostname()
+  }
+  if info.Name == "" {
+    info.Name = "clipboard"
+  }
+
+  if !config.TLSEnabled() {
+    info.Scheme = "http"
+  }
+
+  if Certificates != nil {
+    info.Fingerprint = Certificates.Fingerprint()
+    info.CAFingerprint = Certificates.CAFingerprint()
+  }
+
+  return info
+}
+
+// announce register the server by mDNS with the port of the listen address
+func announce(config *utils.ServerConfig) (*zeroconf.Server, error) {
+  _, service, err := net.SplitHostPort(config.Address)
+  if err != nil {
+    return nil, err
+  }
+
+  port, err := net.LookupPort("tcp", service)
+  if err != nil {
+    return nil, err
+  }
+  if port == 0 {
+    return nil, errors.New("no port in the listen address " + config.Address)
+  }
+
+  info := discoveryInfo(config)
+  return zeroconf.Register(info.Name, utils.DiscoveryService, utils.DiscoveryDomain, port, info.TXT(), nil)
+}
+
+// textSetter announcement whose TXT records can be updated, a *zeroconf.Server
+type textSetter interface {
+  SetText(text []string)
+}
+
+// reannounce update the announced fingerprints after each reload of the certificate, the
+// discovered clients require them
+func reannounce(config *utils.ServerConfig, certs *CertReloader, server textSetter) {
+  certs.OnReload(func() {
+    server.SetText(discoveryInfo(config).TXT())
+  })
+}
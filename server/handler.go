@@ -3,19 +3,34 @@ package main
 import (
   static "clipboard-remote"
   "clipboard-remote/utils"
+  "context"
   "encoding/base64"
   "encoding/json"
   "html/template"
   "io"
   "net/http"
-
-  log "github.com/sirupsen/logrus"
+  "net/url"
+  "strconv"
+  "time"
 )
 
 //var htmlTemplate *template.Template
 
 const cookieSessionName string = "session-id"
 const cookieUsername string = "user"
+const cookiePendingUser string = "pending-user"
+const cookiePendingTime string = "pending-time"
+
+// pendingUserTimeout how long a password verified user can take to finish the second login step
+const pendingUserTimeout = 5 * 60
+
+type contextKey string
+
+// contextUser request context key of the authenticated user
+const contextUser contextKey = "user"
+
+// contextScope request context key of the granted scope
+const contextScope contextKey = "scope"
 
 // func init() {
 //   htmlTemplate = template.Must(template.ParseGlob("../static/*.html"))
@@ -36,7 +51,7 @@ func NewClipHandler(r *Router) *ClipHandler {
 }
 
 func GetSessionUser(r *http.Request) string {
-  session, _ := SessionStore.Get(r, cookieSessionName)
+  session := getSession(r)
   s, ok := session.Values[cookieUsername]
   if !ok {
     return ""
@@ -46,21 +61,95 @@ func GetSessionUser(r *http.Request) string {
 }
 
 func SaveSessionUser(w http.ResponseWriter, r *http.Request, username string) {
-  session, _ := SessionStore.Get(r, cookieSessionName)
+  session := rotateSession(w, r)
 
   session.Values[cookieUsername] = username
-  session.Options.HttpOnly = true
-  session.Options.Secure = true
 
-  SessionStore.Save(r, w, session)
+  saveSession(w, r, session)
+}
+
+// GetPendingUser return the user who passed the password check but not the second factor yet
+func GetPendingUser(r *http.Request) string {
+  session := getSession(r)
+  s, ok := session.Values[cookiePendingUser]
+  if !ok {
+    return ""
+  }
+
+  t, ok := session.Values[cookiePendingTime].(int64)
+  if !ok || time.Now().Unix()-t > pendingUserTimeout {
+    return ""
+  }
+
+  return s.(string)
+}
+
+func SavePendingUser(w http.ResponseWriter, r *http.Request, username string) {
+  session := rotateSession(w, r)
+
+  session.Values[cookiePendingUser] = username
+  session.Values[cookiePendingTime] = time.Now().Unix()
+
+  saveSession(w, r, session)
+}
+
+func DelPendingUser(w http.ResponseWriter, r *http.Request) {
+  session := getSession(r)
+
+  delete(session.Values, cookiePendingUser)
+  delete(session.Values, cookiePendingTime)
+
+  saveSession(w, r, session)
+}
+
+// RequestUser return the user authenticated by UserBasicAuthMDW
+func RequestUser(r *http.Request) string {
+  if user, ok := r.Context().Value(contextUser).(string); ok {
+    return user
+  }
+
+  return GetSessionUser(r)
 }
 
 func DelSessionUser(w http.ResponseWriter, r *http.Request) {
-  session, _ := SessionStore.Get(r, cookieSessionName)
+  session := getSession(r)
 
   SessionStore.Delete(r, w, session)
 }
 
+// PageInfo template data for the sign in page
+type PageInfo struct {
+  Message string
+  SSO     bool
+  CSRF    string
+}
+
+// newPageInfo must be called before writing the response, the CSRF token may create the session
+func newPageInfo(w http.ResponseWriter, r *http.Request, message string) PageInfo {
+  return PageInfo{
+    Message: message,
+    SSO:     OIDC != nil,
+    CSRF:    CSRFToken(w, r),
+  }
+}
+
+// ContentPageInfo template data for the content page
+type ContentPageInfo struct {
+  Contents []DisplayInfo
+  Message  string
+  CSRF     string
+
+  // current channel, the clips of the user if empty, and the channels of the user
+  Channel  string
+  Channels []string
+
+  // online devices of the user
+  Devices []utils.DeviceInfo
+
+  // single sign-on can be linked
+  SSO bool
+}
+
 type RestfulRespInfo struct {
   Response utils.RespInfo
   Writer   http.ResponseWriter // http response writer
@@ -88,12 +177,46 @@ func UserBasicAuthMDW(next http.Handler) http.Handler {
       },
     }
 
-    // never login
-    if user == "" {
-      // authentication process
-      user, passwd, ok := r.BasicAuth()
+    scope := utils.ScopeReadWrite
+
+    // personal API token
+    if secret := bearerToken(r); secret != "" {
+      keys := limitKeys(clientIP(r), "")
+      if remain := Limiter.Check(keys...); remain > 0 {
+        w.Header().Set("Retry-After", retryAfter(remain))
+
+        rest.Response.Code = http.StatusTooManyRequests
+        rest.Response.Message = "Too Many Authentication Failures."
+
+        rest.send()
+        return
+      }
+
+      token, err := authToken(secret)
+      if err != nil {
+        reqLog(r).Errorln("Failed to authentication token:", err)
+        Limiter.Fail(keys...)
+        auditRequest(r, AuditLogin, "", false, "token")
+
+        w.Header().Set("WWW-Authenticate", `Bearer realm="restricted"`)
+
+        rest.Response.Code = http.StatusUnauthorized
+        rest.Response.Message = "Authentication Failed."
+
+        rest.send()
+        return
+      }
+
+      user = token.Username
+      scope = token.Scope
+    } else if certUser, _, ok := certificateUser(r); ok && user == "" {
+      // client certificate verified by the TLS handshake
+      user = certUser
+    } else if user == "" {
+      // never login, authentication process
+      basicUser, passwd, ok := r.BasicAuth()
       if !ok {
-        log.Errorln("No Basic Authentication Info.")
+        reqLog(r).Errorln("No Basic Authentication Info.")
 
         w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 
@@ -104,11 +227,21 @@ func UserBasicAuthMDW(next http.Handler) http.Handler {
         return
       }
 
-      pass := DB.GetPassword(user)
+      keys := limitKeys(clientIP(r), basicUser)
+      if remain := Limiter.Check(keys...); remain > 0 {
+        w.Header().Set("Retry-After", retryAfter(remain))
 
-      // if no password find means user not exist
-      if pass == "" || pass != passwd {
-        log.Errorln("Failed to authentication user:", user)
+        rest.Response.Code = http.StatusTooManyRequests
+        rest.Response.Message = "Too Many Authentication Failures."
+
+        rest.send()
+        return
+      }
+
+      if Authenticator.Authenticate(basicUser, passwd) != nil {
+        reqLog(r).Errorln("Failed to authentication user:", basicUser)
+        Limiter.Fail(keys...)
+        auditRequest(r, AuditLogin, basicUser, false, "basic")
 
         w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
 
@@ -119,17 +252,21 @@ func UserBasicAuthMDW(next http.Handler) http.Handler {
         return
       }
 
-      // use session for application
-      SaveSessionUser(w, r, user)
+      Limiter.Succeed(keys...)
+
+      // device credentials are exempt from two factor, so they never create a web session
+      user = basicUser
     }
 
-    next.ServeHTTP(w, r)
+    ctx := context.WithValue(r.Context(), contextUser, user)
+    ctx = context.WithValue(ctx, contextScope, scope)
+    next.ServeHTTP(w, r.WithContext(ctx))
   })
 }
 
 // RestGetClipHandler Get clipboard content handler for restful API
 func (clip *ClipHandler) RestGetClipHandlerFunc(w http.ResponseWriter, r *http.Request) {
-  user := GetSessionUser(r)
+  user := RequestUser(r)
 
   // restful API reponse sender
   rest := RestfulRespInfo{
@@ -142,9 +279,22 @@ func (clip *ClipHandler) RestGetClipHandlerFunc(w http.ResponseWriter, r *http.R
 
   defer rest.send()
 
-  buff, err := base64.StdEncoding.DecodeString(DB.GetClipContentByName(user))
+  // the latest clip of the channel, the user must be a member
+  stored := ""
+  if channel := r.URL.Query().Get("channel"); channel != "" {
+    if !channelMember(channel, user, "") {
+      rest.Response.Code = http.StatusForbidden
+      rest.Response.Message = "Not A Channel Member."
+      return
+    }
+    stored = DB.GetChannelContent(channel)
+  } else {
+    stored = DB.GetClipContentByName(user)
+  }
+
+  buff, err := base64.StdEncoding.DecodeString(stored)
   if err != nil {
-    log.Errorln("Failed to get clipboard content for user:", user, err)
+    reqLog(r).Errorln("Failed to get clipboard content for user:", user, err)
 
     rest.Response.Code = http.StatusInternalServerError
     rest.Response.Message = "Get Clipboard Content Failed."
@@ -153,7 +303,7 @@ func (clip *ClipHandler) RestGetClipHandlerFunc(w http.ResponseWriter, r *http.R
 
   content, err := utils.DecodeToStruct(buff)
   if err != nil {
-    log.Errorln("Failed to get clipboard content for user:", user, err)
+    reqLog(r).Errorln("Failed to get clipboard content for user:", user, err)
 
     rest.Response.Code = http.StatusInternalServerError
     rest.Response.Message = "Get Clipboard Content Failed."
@@ -174,7 +324,7 @@ func (clip *ClipHandler) RestGetClipHandlerFunc(w http.ResponseWriter, r *http.R
 
 // RestGetClipHandler Set clipboard content handler for restful API
 func (clip *ClipHandler) RestSetClipHandlerFunc(w http.ResponseWriter, r *http.Request) {
-  user := GetSessionUser(r)
+  user := RequestUser(r)
 
   // restful API reponse sender
   rest := RestfulRespInfo{
@@ -202,28 +352,54 @@ func (clip *ClipHandler) RestSetClipHandlerFunc(w http.ResponseWriter, r *http.R
     return
   }
 
-  clipBuff, _ := utils.EncodeToBytes(utils.ClipBoardBuff{
-    Type: utils.CLIP_TEXT,
-    Buff: utils.StringToBytes(dataInfo.Content),
-  })
+  if dataInfo.Channel != "" && !channelMember(dataInfo.Channel, user, dataInfo.ClientID) {
+    rest.Response.Code = http.StatusForbidden
+    rest.Response.Message = "Not A Channel Member."
+    return
+  }
 
-  // insert clipboard data into database
-  err = DB.InsertClipContent(&utils.ClipContentInfo{
+  metricMessageSize.WithLabelValues("rest").Observe(float64(len(dataInfo.Content)))
+
+  clipBuff := textClip(dataInfo.Content)
+
+  content := &utils.ClipContentInfo{
     ClientID: dataInfo.ClientID,
     Username: user,
     Content:  base64.StdEncoding.EncodeToString(clipBuff),
-  })
+    Channel:  dataInfo.Channel,
+  }
+
+  if wait, err := ClipLimits.Check(user, utils.ClipTypeText, len(dataInfo.Content), content); err != nil {
+    limitResponse(&rest, err, wait)
+    return
+  }
+
+  // insert clipboard data into database
+  err = DB.InsertClipContent(content)
 
   if err != nil {
-    log.Errorf("Failed to insert clipcontent to database, id: %s, user: %s.", dataInfo.ClientID, user)
+    reqLog(r).Errorf("Failed to insert clipcontent to database, id: %s, user: %s.", dataInfo.ClientID, user)
     // Ignore errors; therefore, no return
   }
 
+  recordAudit(&utils.AuditInfo{
+    Event:    AuditClipboardPush,
+    Username: user,
+    ClientID: dataInfo.ClientID,
+    RemoteIP: clientIP(r),
+    Success:  true,
+    Detail:   "rest text, " + strconv.Itoa(len(dataInfo.Content)) + " bytes",
+  })
+
   // broadcast clipboard content to user's all client
   clip.router.broadcast <- &Message{
     id:       dataInfo.ClientID,
     username: user,
     content:  clipBuff,
+    hash:     utils.ContentHash(clipBuff),
+    clipType: utils.ClipTypeText,
+    channel:  dataInfo.Channel,
+    created:  time.Now(),
   }
 }
 
@@ -240,18 +416,53 @@ func (clip *ClipHandler) DoLoginHandlerFunc(w http.ResponseWriter, r *http.Reque
     passwd := r.FormValue("password")
     //remember := r.FormValue("remember-check")
 
-    pass := DB.GetPassword(user)
+    keys := limitKeys(clientIP(r), user)
+    if remain := Limiter.Check(keys...); remain > 0 {
+      page := newPageInfo(w, r, "登录失败次数过多，请稍后再试！")
 
-    if pass == "" || pass != passwd {
-      log.Errorf("Failed to auth user(%s).", user)
+      w.Header().Set("Retry-After", retryAfter(remain))
+      w.WriteHeader(http.StatusTooManyRequests)
 
-      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", "用户名或者密码错误，请重新登录！")
+      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", page)
       return
     }
 
-    SaveSessionUser(w, r, user)
+    if Authenticator.Authenticate(user, passwd) != nil {
+      reqLog(r).Errorf("Failed to auth user(%s).", user)
+      Limiter.Fail(keys...)
+      auditRequest(r, AuditLogin, user, false, "password")
+
+      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "用户名或者密码错误，请重新登录！"))
+      return
+    }
+
+    Limiter.Succeed(keys...)
+
+    finishLogin(w, r, user, "password")
+    return
+  }
+
+  http.Redirect(w, r, "/content", http.StatusFound)
+}
+
+// finishLogin create the session of a first factor authenticated user, or
+// start the second login step if two factor is enabled or required
+func finishLogin(w http.ResponseWriter, r *http.Request, user string, method string) {
+  if tf := DB.GetTwoFactor(user); tf != nil && (tf.Enabled || tf.Required) {
+    auditRequest(r, AuditLogin, user, true, method+", two factor pending")
+    SavePendingUser(w, r, user)
+
+    if tf.Enabled {
+      http.Redirect(w, r, "/login/2fa", http.StatusFound)
+    } else {
+      http.Redirect(w, r, "/2fa/setup", http.StatusFound)
+    }
+    return
   }
 
+  auditRequest(r, AuditLogin, user, true, method)
+  SaveSessionUser(w, r, user)
+
   http.Redirect(w, r, "/content", http.StatusFound)
 }
 
@@ -263,7 +474,13 @@ func (clip *ClipHandler) LoginHtmlHandlerFunc(w http.ResponseWriter, r *http.Req
     return
   }
 
-  clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", nil)
+  // single sign-on only
+  if OIDC != nil && GlobalConfig.OIDC.AutoRedirect && r.URL.Query().Get("local") == "" {
+    http.Redirect(w, r, "/login/oidc", http.StatusFound)
+    return
+  }
+
+  clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, ""))
 }
 
 func (clip *ClipHandler) DoRegisterHandlerFunc(w http.ResponseWriter, r *http.Request) {
@@ -273,6 +490,13 @@ func (clip *ClipHandler) DoRegisterHandlerFunc(w http.ResponseWriter, r *http.Re
   user := r.FormValue("username")
   passwd := r.FormValue("password")
 
+  // users are managed by the directory, a local user would shadow the directory user
+  if GlobalConfig.AuthBackend == "ldap" || GlobalConfig.AuthBackend == "chained" {
+    auditRequest(r, AuditRegister, user, false, "registration disabled")
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_up.html", newPageInfo(w, r, "不支持注册，请联系管理员！"))
+    return
+  }
+
   users := []utils.AuthConfig{
     {
       User:     user,
@@ -282,28 +506,39 @@ func (clip *ClipHandler) DoRegisterHandlerFunc(w http.ResponseWriter, r *http.Re
 
   err := DB.InsertUserInfo(users)
   if err != nil {
-    log.Errorln("Failed to add user:", user)
-    clip.htmlTemplate.ExecuteTemplate(w, "sign_up.html", "注册失败，请重新注册！")
+    reqLog(r).Errorln("Failed to add user:", user)
+    auditRequest(r, AuditRegister, user, false, err.Error())
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_up.html", newPageInfo(w, r, "注册失败，请重新注册！"))
     return
   }
 
-  clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", "注册成功，请重新登录！")
+  auditRequest(r, AuditRegister, user, true, "")
+
+  clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "注册成功，请重新登录！"))
 }
 
 func (clip *ClipHandler) DoLogoutHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  if user := GetSessionUser(r); user != "" {
+    auditRequest(r, AuditLogout, user, true, "")
+  }
+
   DelSessionUser(w, r)
 
   http.Redirect(w, r, "/login", http.StatusFound)
 }
 
 func (clip *ClipHandler) DoReflashHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  target := "/content"
+  if channel := r.URL.Query().Get("channel"); channel != "" {
+    target += "?channel=" + url.QueryEscape(channel)
+  }
 
-  http.Redirect(w, r, "/content", http.StatusFound)
+  http.Redirect(w, r, target, http.StatusFound)
 }
 
 // RegisterHtmlHandlerFunc handler for register html page
 func (clip *ClipHandler) RegisterHtmlHandlerFunc(w http.ResponseWriter, r *http.Request) {
-  clip.htmlTemplate.ExecuteTemplate(w, "sign_up.html", nil)
+  clip.htmlTemplate.ExecuteTemplate(w, "sign_up.html", newPageInfo(w, r, ""))
 }
 
 // ContentHtmlHandlerFunc handler for content html page
@@ -316,26 +551,56 @@ func (clip *ClipHandler) ContentHtmlHandlerFunc(w http.ResponseWriter, r *http.R
     return
   }
 
-  var clipInfos []DisplayInfo
-  contents := DB.GetClipContents()
+  clip.renderContent(w, r, user, "")
+}
+
+// renderContent render the content page of the user with the message
+func (clip *ClipHandler) renderContent(w http.ResponseWriter, r *http.Request, user string, message string) {
+  page := ContentPageInfo{
+    Message:  message,
+    CSRF:     CSRFToken(w, r),
+    Channel:  r.URL.Query().Get("channel"),
+    Channels: userChannels(user),
+    Devices:  clip.router.Devices(user),
+    SSO:      OIDC != nil,
+  }
+
+  online := make(map[string]bool)
+  for _, device := range page.Devices {
+    online[device.ClientID] = true
+  }
+
+  // the clips of the user, or of a channel the user is a member of
+  var contents []utils.ClipContentInfo
+  if page.Channel != "" {
+    if !channelMember(page.Channel, user, "") {
+      http.Error(w, "Not A Channel Member.", http.StatusForbidden)
+      return
+    }
+    contents = DB.GetChannelContents(page.Channel)
+  } else {
+    contents = DB.GetClipContents()
+  }
+
   for _, content := range contents {
     buff, _ := base64.StdEncoding.DecodeString(content.Content)
     clipInfo, _ := utils.DecodeToStruct(buff)
 
-    if content.Username != user {
+    if page.Channel == "" && content.Username != user {
       continue
     }
 
-    clipInfos = append(clipInfos, DisplayInfo{
+    page.Contents = append(page.Contents, DisplayInfo{
       ClientID:  content.ClientID,
       Timestamp: content.Timestamp,
       UserName:  content.Username,
       Content:   utils.BytesToString(clipInfo.Buff),
+      Online:    content.Username == user && online[content.ClientID],
     })
   }
 
   // t.Execute(w, clipInfos)
-  clip.htmlTemplate.ExecuteTemplate(w, "content.html", clipInfos)
+  clip.htmlTemplate.ExecuteTemplate(w, "content.html", page)
 }
 
 // WsHandlerFunc handler for websocket action
@@ -0,0 +1,66 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "strings"
+)
+
+// serverClipTypes clip types relayed by the server
+var serverClipTypes = []string{utils.ClipTypeText, utils.ClipTypeFile, utils.ClipTypeImage}
+
+// offersCompression return whether the upgrade request offers permessage-deflate, which
+// the upgrader then negotiates
+func offersCompression(r *http.Request) bool {
+  return upgrader.EnableCompression && strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+}
+
+// accepts return whether the client accepts clips of the type, clips of unknown types
+// are sent to all clients
+func (c *Client) accepts(clipType string) bool {
+  return c.clipTypes == nil || clipType == "" || c.clipTypes[clipType]
+}
+
+// negotiate record the client info and the clip types of the structured handshake, and
+// return the ready data with the negotiated clip types and capabilities
+func (c *Client) negotiate(hs *utils.HandshakeInfo) *utils.ReadyInfo {
+  ready := &utils.ReadyInfo{
+    Protocol:     utils.ProtocolVersion,
+    Version:      utils.Version,
+    ClipTypes:    []string{},
+    Capabilities: []string{},
+    Limits:       ClipLimits.Limits(),
+  }
+  ready.Limits.MaxMsgSize = GlobalConfig.MaxMsgSize
+
+  if hs.Version != "" {
+    c.version = hs.Version
+  }
+  c.platform = hs.Platform
+
+  // the clients listing no clip type accept all of them
+  if len(hs.ClipTypes) == 0 {
+    ready.ClipTypes = append(ready.ClipTypes, serverClipTypes...)
+  } else {
+    c.clipTypes = make(map[string]bool)
+    for _, clipType := range serverClipTypes {
+      for _, t := range hs.ClipTypes {
+        if t == clipType {
+          c.clipTypes[clipType] = true
+          ready.ClipTypes = append(ready.ClipTypes, clipType)
+          break
+        }
+      }
+    }
+  }
+
+  // chunking and end-to-end encryption are not supported yet
+  for _, capability := range hs.Capabilities {
+    if capability == utils.CapCompression && c.compression {
+      ready.Capabilities = append(ready.Capabilities, capability)
+      break
+    }
+  }
+
+  return ready
+}
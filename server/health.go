@@ -0,0 +1,65 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "net/http"
+  "time"
+)
+
+// timeout of the health checks
+const healthCheckTimeout = 2 * time.Second
+
+// HealthzHandlerFunc liveness probe, the router loop must answer
+func (clip *ClipHandler) HealthzHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  rest := &RestfulRespInfo{
+    Response: utils.RespInfo{
+      Code:    http.StatusOK,
+      Message: "OK",
+    },
+    Writer: w,
+  }
+
+  ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+  defer cancel()
+
+  if _, err := clip.router.Status(ctx); err != nil {
+    reqLog(r).Errorln("Failed to check router:", err)
+
+    rest.Response.Code = http.StatusServiceUnavailable
+    rest.Response.Message = "Router Not Responding."
+  }
+
+  rest.send()
+}
+
+// ReadyzHandlerFunc readiness probe, not ready while the database is down or the server is draining
+func (clip *ClipHandler) ReadyzHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  rest := &RestfulRespInfo{
+    Response: utils.RespInfo{
+      Code:    http.StatusOK,
+      Message: "Ready",
+    },
+    Writer: w,
+  }
+
+  ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+  defer cancel()
+
+  if err := DB.Ping(ctx); err != nil {
+    reqLog(r).Errorln("Failed to ping database:", err)
+
+    rest.Response.Code = http.StatusServiceUnavailable
+    rest.Response.Message = "Database Not Available."
+  } else if draining, err := clip.router.Status(ctx); err != nil {
+    reqLog(r).Errorln("Failed to check router:", err)
+
+    rest.Response.Code = http.StatusServiceUnavailable
+    rest.Response.Message = "Router Not Responding."
+  } else if draining {
+    rest.Response.Code = http.StatusServiceUnavailable
+    rest.Response.Message = "Server Is Shutting Down."
+  }
+
+  rest.send()
+}
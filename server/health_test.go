@@ -0,0 +1,91 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+)
+
+func TestHealthAndDrain(t *testing.T) {
+  setupTestServer(t)
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  router := NewRouter()
+  go router.run()
+
+  server := httptest.NewServer(InitHttpRouter(router))
+  defer server.Close()
+
+  probe := func(path string) int {
+    resp, err := http.Get(server.URL + path)
+    if err != nil {
+      t.Fatal("Failed to probe:", err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+  }
+
+  if probe("/healthz") != http.StatusOK || probe("/readyz") != http.StatusOK {
+    t.Fatal("Server should be healthy and ready.")
+  }
+
+  resp, err := http.Get(server.URL + "/healthz")
+  if err != nil || resp.Header.Get(requestIDHeader) == "" {
+    t.Fatal("Response should carry the request ID:", err)
+  }
+  resp.Body.Close()
+
+  conn, _ := registerWs(t, server, "c1", "u1:pass:auto")
+  defer disconnect(t, conn, "c1")
+
+  // upgraded but never registered
+  idle := dialWs(t, server)
+  defer idle.Close()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+
+  // drain closes the connection, the reader keeps it alive until the close frame
+  drained := make(chan error, 1)
+  go func() {
+    drained <- router.Drain(ctx, 7)
+  }()
+
+  // the shutdown error comes before the close frame
+  wsm := readWs(t, conn)
+  info := &utils.ErrorInfo{}
+  if json.Unmarshal(wsm.Data, info) != nil || info.Code != utils.ErrorShutdown || info.RetryAfter != 7 {
+    t.Fatal("Client should get a shutdown error:", info.Code)
+  }
+
+  _, _, err = conn.ReadMessage()
+  closeErr, ok := err.(*websocket.CloseError)
+  if !ok || closeErr.Code != websocket.CloseGoingAway {
+    t.Fatal("Client should get a going away frame:", err)
+  }
+
+  if d, ok := utils.ReconnectDelay(closeErr.Text); !ok || d != 7*time.Second {
+    t.Fatal("Close reason should carry the reconnect delay:", closeErr.Text)
+  }
+
+  // the connection not registered is closed as well, so the drain does not wait for it
+  idle.ReadMessage()
+  if _, _, err = idle.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+    t.Fatal("Connection not registered should get a going away frame:", err)
+  }
+
+  if err := <-drained; err != nil {
+    t.Fatal("Failed to drain:", err)
+  }
+
+  if probe("/healthz") != http.StatusOK || probe("/readyz") != http.StatusServiceUnavailable {
+    t.Fatal("Draining server should be alive but not ready.")
+  }
+}
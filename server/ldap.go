@@ -0,0 +1,242 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "crypto/hmac"
+  "crypto/sha256"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/go-ldap/ldap/v3"
+  log "github.com/sirupsen/logrus"
+)
+
+// ErrHashUnsupported LDAP can only verify plain passwords
+var ErrHashUnsupported = errors.New("password hash is not supported by ldap, set send-password in the client config")
+
+// ldapCacheEntry successful authentication cached until expire
+type ldapCacheEntry struct {
+  digest []byte
+  expire time.Time
+}
+
+// LDAPBackend authenticate the users against a LDAP directory
+type LDAPBackend struct {
+  config *utils.LDAPConfig
+
+  // cache key is the HMAC of the password with a random per process key
+  cacheKey []byte
+  cacheMu  sync.Mutex
+  cache    map[string]ldapCacheEntry
+}
+
+// NewLDAPBackend return a LDAP backend instance
+func NewLDAPBackend(config *utils.LDAPConfig) *LDAPBackend {
+  return &LDAPBackend{
+    config:   config,
+    cacheKey: utils.StringToBytes(utils.RandomString(32)),
+    cache:    make(map[string]ldapCacheEntry),
+  }
+}
+
+func (l *LDAPBackend) digest(password string) []byte {
+  mac := hmac.New(sha256.New, l.cacheKey)
+  mac.Write(utils.StringToBytes(password))
+  return mac.Sum(nil)
+}
+
+func (l *LDAPBackend) cached(user string, password string) bool {
+  l.cacheMu.Lock()
+  defer l.cacheMu.Unlock()
+
+  entry, ok := l.cache[user]
+  if !ok {
+    return false
+  }
+
+  if time.Now().After(entry.expire) {
+    delete(l.cache, user)
+    return false
+  }
+
+  return hmac.Equal(entry.digest, l.digest(password))
+}
+
+func (l *LDAPBackend) store(user string, password string) {
+  if l.config.CacheTTL < 0 {
+    return
+  }
+
+  l.cacheMu.Lock()
+  defer l.cacheMu.Unlock()
+
+  l.cache[user] = ldapCacheEntry{
+    digest: l.digest(password),
+    expire: time.Now().Add(time.Duration(l.config.CacheTTL) * time.Second),
+  }
+}
+
+func (l *LDAPBackend) dial() (*ldap.Conn, error) {
+  tlsConfig := &tls.Config{InsecureSkipVerify: l.config.InsecureSkipVerify}
+
+  conn, err := ldap.DialURL(l.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+  if err != nil {
+    return nil, err
+  }
+
+  if l.config.StartTLS {
+    if err = conn.StartTLS(tlsConfig); err != nil {
+      conn.Close()
+      return nil, err
+    }
+  }
+
+  return conn, nil
+}
+
+// userDN build the DN from the template, or search it with the service account
+func (l *LDAPBackend) userDN(conn *ldap.Conn, user string) (string, error) {
+  if l.config.UserDNTemplate != "" {
+    return fmt.Sprintf(l.config.UserDNTemplate, ldap.EscapeDN(user)), nil
+  }
+
+  if l.config.BindDN != "" {
+    if err := conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+      return "", fmt.Errorf("failed to bind service account: %w", err)
+    }
+  }
+
+  result, err := conn.Search(ldap.NewSearchRequest(
+    l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+    fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(user)), []string{"dn"}, nil))
+  if err != nil {
+    return "", fmt.Errorf("failed to search user: %w", err)
+  }
+
+  if len(result.Entries) != 1 {
+    return "", fmt.Errorf("user search returned %d entries", len(result.Entries))
+  }
+
+  return result.Entries[0].DN, nil
+}
+
+// checkGroups check the user is member of one of the allowed groups
+func (l *LDAPBackend) checkGroups(conn *ldap.Conn, userDN string) error {
+  if len(l.config.AllowedGroups) == 0 {
+    return nil
+  }
+
+  result, err := conn.Search(ldap.NewSearchRequest(
+    l.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+    fmt.Sprintf(l.config.GroupFilter, ldap.EscapeFilter(userDN)), []string{"cn"}, nil))
+  if err != nil {
+    return fmt.Errorf("failed to search groups: %w", err)
+  }
+
+  for _, entry := range result.Entries {
+    for _, group := range l.config.AllowedGroups {
+      if entry.GetAttributeValue("cn") == group {
+        return nil
+      }
+    }
+  }
+
+  return fmt.Errorf("%s is not member of allowed groups", userDN)
+}
+
+func (l *LDAPBackend) Authenticate(user string, password string) error {
+  // an empty password is an unauthenticated bind, which always succeeds
+  if user == "" || password == "" {
+    return utils.ErrAuthFailed
+  }
+
+  if l.cached(user, password) {
+    return nil
+  }
+
+  conn, err := l.dial()
+  if err != nil {
+    log.Errorln("Failed to connect ldap server:", err)
+    return utils.ErrAuthFailed
+  }
+  defer conn.Close()
+
+  dn, err := l.userDN(conn, user)
+  if err != nil {
+    log.Errorf("Failed to find ldap user(%s), error: %v.", user, err)
+    return utils.ErrAuthFailed
+  }
+
+  if err = conn.Bind(dn, password); err != nil {
+    log.Errorf("Failed to bind ldap user(%s), error: %v.", dn, err)
+    return utils.ErrAuthFailed
+  }
+
+  // search groups with the service account if configured, user may not read groups
+  if l.config.BindDN != "" {
+    if err = conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+      log.Errorln("Failed to bind ldap service account:", err)
+      return utils.ErrAuthFailed
+    }
+  }
+
+  if err = l.checkGroups(conn, dn); err != nil {
+    log.Errorf("Failed to check ldap groups of user(%s), error: %v.", user, err)
+    return utils.ErrAuthFailed
+  }
+
+  l.store(user, password)
+
+  return nil
+}
+
+func (l *LDAPBackend) AuthenticateHash(user string, hash string) error {
+  return ErrHashUnsupported
+}
+
+func (l *LDAPBackend) Lookup(user string) error {
+  if user == "" {
+    return utils.ErrAuthFailed
+  }
+
+  conn, err := l.dial()
+  if err != nil {
+    log.Errorln("Failed to connect ldap server:", err)
+    return utils.ErrAuthFailed
+  }
+  defer conn.Close()
+
+  if l.config.BindDN != "" {
+    if err = conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+      log.Errorln("Failed to bind ldap service account:", err)
+      return utils.ErrAuthFailed
+    }
+  }
+
+  dn, err := l.userDN(conn, user)
+  if err != nil {
+    log.Errorf("Failed to find ldap user(%s), error: %v.", user, err)
+    return utils.ErrAuthFailed
+  }
+
+  // the template builds the DN of any name, read the entry
+  if l.config.UserDNTemplate != "" {
+    result, err := conn.Search(ldap.NewSearchRequest(
+      dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+      "(objectClass=*)", []string{"dn"}, nil))
+    if err != nil || len(result.Entries) != 1 {
+      log.Errorf("Failed to find ldap user(%s), error: %v.", dn, err)
+      return utils.ErrAuthFailed
+    }
+  }
+
+  if err = l.checkGroups(conn, dn); err != nil {
+    log.Errorf("Failed to check ldap groups of user(%s), error: %v.", user, err)
+    return utils.ErrAuthFailed
+  }
+
+  return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net"
+  "net/url"
+  "strings"
+  "testing"
+
+  ber "github.com/go-asn1-ber/asn1-ber"
+  "github.com/go-ldap/ldap/v3"
+)
+
+// testLDAPEntry directory entry served by the test ldap server
+type testLDAPEntry struct {
+  dn       string
+  password string
+  attrs    map[string][]string
+}
+
+// testLDAPServer in-process ldap server supporting simple bind and equality search
+type testLDAPServer struct {
+  listener net.Listener
+  entries  []testLDAPEntry
+}
+
+func newTestLDAPServer(t *testing.T, entries []testLDAPEntry) *testLDAPServer {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal("Failed to listen:", err)
+  }
+
+  s := &testLDAPServer{listener: listener, entries: entries}
+  t.Cleanup(func() { listener.Close() })
+
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go s.serve(conn)
+    }
+  }()
+
+  return s
+}
+
+func (s *testLDAPServer) url() string {
+  return "ldap://" + s.listener.Addr().String()
+}
+
+func ldapResult(msgID int64, tag ber.Tag, code int) *ber.Packet {
+  envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+  envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+
+  op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+  op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+  envelope.AppendChild(op)
+
+  return envelope
+}
+
+func ldapEntry(msgID int64, entry testLDAPEntry) *ber.Packet {
+  envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+  envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+
+  op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"))
+
+  attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+  for name, values := range entry.attrs {
+    attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+    attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+    set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+    for _, value := range values {
+      set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+    }
+    attr.AppendChild(set)
+    attrs.AppendChild(attr)
+  }
+  op.AppendChild(attrs)
+  envelope.AppendChild(op)
+
+  return envelope
+}
+
+// match check a "(attr=value)" equality filter
+func (e testLDAPEntry) match(filter string) bool {
+  filter = strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")")
+  name, value, ok := strings.Cut(filter, "=")
+  if !ok {
+    return false
+  }
+
+  // presence filter, every entry has an object class
+  if value == "*" {
+    return name == "objectClass" || len(e.attrs[name]) > 0
+  }
+
+  for _, v := range e.attrs[name] {
+    if v == value {
+      return true
+    }
+  }
+
+  return false
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+  defer conn.Close()
+
+  for {
+    packet, err := ber.ReadPacket(conn)
+    if err != nil || len(packet.Children) < 2 {
+      return
+    }
+
+    msgID, _ := packet.Children[0].Value.(int64)
+    req := packet.Children[1]
+
+    switch req.Tag {
+    case ldap.ApplicationBindRequest:
+      dn := req.Children[1].Data.String()
+      password := req.Children[2].Data.String()
+
+      code := ldap.LDAPResultInvalidCredentials
+      for _, entry := range s.entries {
+        if entry.dn == dn && entry.password != "" && entry.password == password {
+          code = ldap.LDAPResultSuccess
+        }
+      }
+      conn.Write(ldapResult(msgID, ldap.ApplicationBindResponse, code).Bytes())
+    case ldap.ApplicationSearchRequest:
+      base := req.Children[0].Data.String()
+      filter, err := ldap.DecompileFilter(req.Children[6])
+      if err != nil {
+        conn.Write(ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError).Bytes())
+        continue
+      }
+
+      for _, entry := range s.entries {
+        if strings.HasSuffix(entry.dn, base) && entry.match(filter) {
+          conn.Write(ldapEntry(msgID, entry).Bytes())
+        }
+      }
+      conn.Write(ldapResult(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+    case ldap.ApplicationUnbindRequest:
+      return
+    }
+  }
+}
+
+var testDirectory = []testLDAPEntry{
+  {dn: "cn=service,dc=example,dc=org", password: "service-pass"},
+  {dn: "uid=alice,ou=people,dc=example,dc=org", password: "alice-pass", attrs: map[string][]string{"uid": {"alice"}}},
+  {dn: "uid=bob,ou=people,dc=example,dc=org", password: "bob-pass", attrs: map[string][]string{"uid": {"bob"}}},
+  {dn: "cn=clip,ou=groups,dc=example,dc=org", attrs: map[string][]string{
+    "cn":     {"clip"},
+    "member": {"uid=alice,ou=people,dc=example,dc=org"},
+  }},
+}
+
+func TestLDAPBindTemplate(t *testing.T) {
+  server := newTestLDAPServer(t, testDirectory)
+
+  backend := NewLDAPBackend(&utils.LDAPConfig{
+    URL:            server.url(),
+    UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+    CacheTTL:       300,
+  })
+
+  if err := backend.Authenticate("alice", "alice-pass"); err != nil {
+    t.Fatal("Alice should be authenticated:", err)
+  }
+
+  if backend.Authenticate("alice", "wrong") == nil {
+    t.Fatal("Wrong password should fail.")
+  }
+
+  if backend.Authenticate("alice", "") == nil {
+    t.Fatal("Empty password should fail.")
+  }
+
+  if backend.AuthenticateHash("alice", "$2a$10$hash") == nil {
+    t.Fatal("Password hash should not be supported.")
+  }
+
+  if err := backend.Lookup("alice"); err != nil {
+    t.Fatal("Alice should be found:", err)
+  }
+
+  if backend.Lookup("carol") == nil {
+    t.Fatal("Unknown user should not be found.")
+  }
+
+  // cached after the directory is gone
+  server.listener.Close()
+  if err := backend.Authenticate("alice", "alice-pass"); err != nil {
+    t.Fatal("Alice should be cached:", err)
+  }
+
+  if backend.Authenticate("alice", "wrong") == nil {
+    t.Fatal("Cache should not accept the wrong password.")
+  }
+}
+
+func TestLDAPSearchBindGroups(t *testing.T) {
+  server := newTestLDAPServer(t, testDirectory)
+
+  backend := NewLDAPBackend(&utils.LDAPConfig{
+    URL:           server.url(),
+    BindDN:        "cn=service,dc=example,dc=org",
+    BindPassword:  "service-pass",
+    BaseDN:        "ou=people,dc=example,dc=org",
+    UserFilter:    "(uid=%s)",
+    GroupBaseDN:   "ou=groups,dc=example,dc=org",
+    GroupFilter:   "(member=%s)",
+    AllowedGroups: []string{"clip"},
+    CacheTTL:      -1,
+  })
+
+  if err := backend.Authenticate("alice", "alice-pass"); err != nil {
+    t.Fatal("Alice should be authenticated:", err)
+  }
+
+  if backend.Authenticate("bob", "bob-pass") == nil {
+    t.Fatal("Bob is not member of the allowed groups.")
+  }
+
+  if backend.Authenticate("carol", "carol-pass") == nil {
+    t.Fatal("Unknown user should fail.")
+  }
+
+  if err := backend.Lookup("alice"); err != nil {
+    t.Fatal("Alice should be found:", err)
+  }
+
+  if backend.Lookup("bob") == nil {
+    t.Fatal("Bob is not member of the allowed groups.")
+  }
+}
+
+func TestChainedBackend(t *testing.T) {
+  handler := setupTestServer(t)
+  server := newTestLDAPServer(t, testDirectory)
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "local", Password: "local-pass"}})
+
+  backend := chainedBackend{localBackend{}, NewLDAPBackend(&utils.LDAPConfig{
+    URL:            server.url(),
+    UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+  })}
+
+  if err := backend.Authenticate("local", "local-pass"); err != nil {
+    t.Fatal("Local user should be authenticated:", err)
+  }
+
+  if err := backend.Authenticate("alice", "alice-pass"); err != nil {
+    t.Fatal("Ldap user should be authenticated:", err)
+  }
+
+  if backend.Authenticate("alice", "local-pass") == nil {
+    t.Fatal("Wrong password should fail.")
+  }
+
+  Authenticator = backend
+  if _, _, _, ok := authWS([]byte("alice:alice-pass:with:colon:auto")); ok {
+    t.Fatal("Wrong websocket password should fail.")
+  }
+
+  if user, mode, _, ok := authWS([]byte("alice:alice-pass:auto")); !ok || user != "alice" || mode != "auto" {
+    t.Fatal("Websocket password auth failed:", user, mode)
+  }
+
+  // the registered user would be tried before the directory user
+  GlobalConfig.AuthBackend = "chained"
+  browser := newTestBrowser(handler)
+  browser.do("GET", "/register", nil)
+  browser.do("POST", "/register", url.Values{"username": {"alice"}, "password": {"other-pass"}})
+  if DB.GetUserByName("alice") != nil {
+    t.Fatal("Registration should be disabled with the directory.")
+  }
+}
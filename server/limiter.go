@@ -0,0 +1,164 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  log "github.com/sirupsen/logrus"
+)
+
+// limitEntry failures of an ip or username
+type limitEntry struct {
+  // failures in the current window
+  failures int
+
+  // start of the current window
+  windowStart time.Time
+
+  // consecutive lockouts, each one doubles the lockout duration
+  lockouts int
+
+  // locked until this time
+  lockedUntil time.Time
+}
+
+// AuthLimiter per-IP and per-username brute-force protection with exponential lockout
+type AuthLimiter struct {
+  sync.Mutex
+
+  config  *utils.AuthLimitConfig
+  entries map[string]*limitEntry
+}
+
+// NewAuthLimiter return a limiter instance
+func NewAuthLimiter(config *utils.AuthLimitConfig) *AuthLimiter {
+  return &AuthLimiter{
+    config:  config,
+    entries: make(map[string]*limitEntry),
+  }
+}
+
+// limitKeys return the limiter keys of the remote ip and the username
+func limitKeys(ip string, user string) []string {
+  keys := []string{"ip:" + ip}
+  if user != "" {
+    keys = append(keys, "user:"+user)
+  }
+
+  return keys
+}
+
+// Check return the remaining lockout of the keys, zero if the attempt is allowed
+func (l *AuthLimiter) Check(keys ...string) time.Duration {
+  l.Lock()
+  defer l.Unlock()
+
+  var remain time.Duration
+  now := time.Now()
+  for _, key := range keys {
+    if entry, ok := l.entries[key]; ok && entry.lockedUntil.After(now) {
+      if d := entry.lockedUntil.Sub(now); d > remain {
+        remain = d
+      }
+    }
+  }
+
+  return remain
+}
+
+// Fail record a failed attempt, the keys exceeding max attempts are locked out
+func (l *AuthLimiter) Fail(keys ...string) {
+  var lockouts []utils.AuditInfo
+  defer func() {
+    // record after unlocking, the database may be slow
+    for i := range lockouts {
+      recordAudit(&lockouts[i])
+    }
+  }()
+
+  l.Lock()
+  defer l.Unlock()
+
+  now := time.Now()
+  window := time.Duration(l.config.Window) * time.Second
+  for _, key := range keys {
+    entry, ok := l.entries[key]
+    if !ok {
+      entry = &limitEntry{windowStart: now}
+      l.entries[key] = entry
+    }
+
+    if now.Sub(entry.windowStart) > window {
+      entry.failures = 0
+      entry.windowStart = now
+    }
+
+    entry.failures++
+    if entry.failures < l.config.MaxAttempts {
+      continue
+    }
+
+    // exponential lockout, capped by max lockout
+    lockout := float64(l.config.Lockout) * math.Pow(2, float64(entry.lockouts))
+    lockout = math.Min(lockout, float64(l.config.MaxLockout))
+
+    entry.lockouts++
+    entry.failures = 0
+    entry.windowStart = now
+    entry.lockedUntil = now.Add(time.Duration(lockout) * time.Second)
+
+    log.Warnf("Locked out %s for %d seconds.", key, int(lockout))
+
+    audit := utils.AuditInfo{Event: AuditLockout, Detail: fmt.Sprintf("locked out %d seconds", int(lockout))}
+    if user, ok := strings.CutPrefix(key, "user:"); ok {
+      audit.Username = user
+    } else if ip, ok := strings.CutPrefix(key, "ip:"); ok {
+      audit.RemoteIP = ip
+    } else {
+      audit.Detail = key + " " + audit.Detail
+    }
+    lockouts = append(lockouts, audit)
+  }
+}
+
+// Succeed reset the keys after a successful authentication. The ip keys expire with the
+// window only, so the logins of a valid account never clear the failures of the ip.
+func (l *AuthLimiter) Succeed(keys ...string) {
+  l.Lock()
+  defer l.Unlock()
+
+  for _, key := range keys {
+    if !strings.HasPrefix(key, "ip:") {
+      delete(l.entries, key)
+    }
+  }
+}
+
+// Cleanup remove the entries which are neither locked nor failed recently
+func (l *AuthLimiter) Cleanup() {
+  l.Lock()
+  defer l.Unlock()
+
+  now := time.Now()
+  idle := time.Duration(l.config.Window+l.config.MaxLockout) * time.Second
+  for key, entry := range l.entries {
+    if entry.lockedUntil.Before(now) && now.Sub(entry.windowStart) > idle {
+      delete(l.entries, key)
+    }
+  }
+}
+
+// retrySeconds round up the lockout to seconds
+func retrySeconds(d time.Duration) int {
+  return int(math.Ceil(d.Seconds()))
+}
+
+// retryAfter format the lockout as Retry-After seconds
+func retryAfter(d time.Duration) string {
+  return strconv.Itoa(retrySeconds(d))
+}
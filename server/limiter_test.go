@@ -0,0 +1,118 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+  setupTestServer(t)
+
+  limiter := NewAuthLimiter(&utils.AuthLimitConfig{MaxAttempts: 2, Window: 60, Lockout: 10, MaxLockout: 25})
+
+  keys := limitKeys("10.0.0.1", "u1")
+  limiter.Fail(keys...)
+  if limiter.Check(keys...) != 0 {
+    t.Fatal("One failure should not lock out.")
+  }
+
+  limiter.Fail(keys...)
+  if remain := limiter.Check(keys...); remain <= 0 || remain > 10*time.Second {
+    t.Fatal("Two failures should lock out for 10 seconds:", remain)
+  }
+
+  // the username is locked from any ip
+  if limiter.Check(limitKeys("10.0.0.2", "u1")...) == 0 {
+    t.Fatal("Username should be locked out from another ip.")
+  }
+
+  if limiter.Check(limitKeys("10.0.0.2", "u2")...) != 0 {
+    t.Fatal("Other ip and user should not be locked out.")
+  }
+
+  // lockout doubles, capped by max lockout
+  limiter.Fail(keys...)
+  limiter.Fail(keys...)
+  if remain := limiter.Check(keys...); remain <= 10*time.Second || remain > 20*time.Second {
+    t.Fatal("Second lockout should be 20 seconds:", remain)
+  }
+
+  limiter.Fail(keys...)
+  limiter.Fail(keys...)
+  if remain := limiter.Check(keys...); remain <= 20*time.Second || remain > 25*time.Second {
+    t.Fatal("Third lockout should be capped to 25 seconds:", remain)
+  }
+
+  limiter.Succeed(keys...)
+  if limiter.Check("user:u1") != 0 {
+    t.Fatal("Success should reset the lockout of the user.")
+  }
+  if limiter.Check(limitKeys("10.0.0.1", "")...) == 0 {
+    t.Fatal("Success should keep the lockout of the ip.")
+  }
+}
+
+func TestAuthLimiterSucceed(t *testing.T) {
+  setupTestServer(t)
+
+  limiter := NewAuthLimiter(&utils.AuthLimitConfig{MaxAttempts: 2, Window: 60, Lockout: 10, MaxLockout: 25})
+
+  // a login of a valid account between the guesses keeps the failures of the ip
+  limiter.Fail(limitKeys("10.0.0.1", "victim1")...)
+  limiter.Succeed(limitKeys("10.0.0.1", "attacker")...)
+  limiter.Fail(limitKeys("10.0.0.1", "victim2")...)
+  if limiter.Check(limitKeys("10.0.0.1", "")...) == 0 {
+    t.Fatal("Ip should be locked out after the failures around a success.")
+  }
+
+  // the lockouts of the ip still escalate
+  limiter.Succeed(limitKeys("10.0.0.1", "attacker")...)
+  limiter.Fail(limitKeys("10.0.0.1", "victim3")...)
+  limiter.Fail(limitKeys("10.0.0.1", "victim4")...)
+  if remain := limiter.Check(limitKeys("10.0.0.1", "")...); remain <= 10*time.Second {
+    t.Fatal("Second lockout of the ip should be doubled:", remain)
+  }
+
+  // the users failed once are not locked
+  if limiter.Check("user:victim1") != 0 || limiter.Check("user:attacker") != 0 {
+    t.Fatal("Users should not be locked out.")
+  }
+}
+
+func TestBasicAuthLockout(t *testing.T) {
+  handler := setupTestServer(t)
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  request := func(password string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("POST", "/clipboard/set", strings.NewReader(`{"client_id":"script","content":"hello"}`))
+    req.SetBasicAuth("u1", password)
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, req)
+    return w
+  }
+
+  if w := request("pass"); w.Code != http.StatusOK {
+    t.Fatal("Correct password should be accepted:", w.Code)
+  }
+
+  for i := 0; i < GlobalConfig.AuthLimit.MaxAttempts; i++ {
+    if w := request("wrong"); w.Code != http.StatusUnauthorized {
+      t.Fatal("Wrong password should be rejected:", w.Code)
+    }
+  }
+
+  w := request("pass")
+  if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+    t.Fatal("Locked out user should get 429:", w.Code, w.Header().Get("Retry-After"))
+  }
+
+  if _, _, _, ok := authWS([]byte("u1:pass:auto")); !ok {
+    t.Fatal("authWS itself is not limited, the handshake is.")
+  }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// clipBucket token bucket of the clips of a user
+type clipBucket struct {
+  tokens  float64
+  updated time.Time
+}
+
+// ClipLimiter size, storage quota and rate limits of the clips of each user
+type ClipLimiter struct {
+  sync.Mutex
+
+  config  *utils.LimitsConfig
+  buckets map[string]*clipBucket
+}
+
+// limitMessages the violated limits shown on the content page
+var limitMessages = map[error]string{
+  utils.ErrClipTooLarge:  "内容过大",
+  utils.ErrQuotaExceeded: "存储空间已满",
+  utils.ErrTooManyClips:  "发送过于频繁, 请稍后再试",
+}
+
+// clientReply message to a client sent by the router, dropped if the client is closed
+type clientReply struct {
+  client *Client
+  data   []byte
+}
+
+// NewClipLimiter return a limiter instance
+func NewClipLimiter(config *utils.LimitsConfig) *ClipLimiter {
+  return &ClipLimiter{
+    config:  config,
+    buckets: make(map[string]*clipBucket),
+  }
+}
+
+// Limits return the limits of the clips, sent to the clients in the ready action
+func (l *ClipLimiter) Limits() utils.ServerLimits {
+  return utils.ServerLimits{
+    MaxText:  l.config.MaxText,
+    MaxImage: l.config.MaxImage,
+    MaxFile:  l.config.MaxFile,
+    Quota:    l.config.Quota,
+    Rate:     l.config.Rate,
+    Burst:    l.config.Burst,
+  }
+}
+
+// take take a clip from the bucket of the user, return the wait until the next clip
+// is allowed, zero if this one is
+func (l *ClipLimiter) take(user string) time.Duration {
+  if l.config.Rate <= 0 {
+    return 0
+  }
+
+  l.Lock()
+  defer l.Unlock()
+
+  burst := float64(l.config.Burst)
+  if burst < 1 {
+    burst = 1
+  }
+  perSecond := float64(l.config.Rate) / 60
+
+  now := time.Now()
+  bucket, ok := l.buckets[user]
+  if !ok {
+    bucket = &clipBucket{tokens: burst, updated: now}
+    l.buckets[user] = bucket
+  }
+
+  bucket.tokens += now.Sub(bucket.updated).Seconds() * perSecond
+  if bucket.tokens > burst {
+    bucket.tokens = burst
+  }
+  bucket.updated = now
+
+  if bucket.tokens >= 1 {
+    bucket.tokens--
+    return 0
+  }
+
+  return time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+}
+
+// Check check the clip of the user against the limits, the quota only if the clip is
+// stored in the history, return the violated limit and the wait for the rate limit.
+// The type and size are given by utils.ClipTypeOf. The rate is checked last, so the
+// rejected clips keep the allowance of the user.
+func (l *ClipLimiter) Check(user string, clipType string, size int, content *utils.ClipContentInfo) (time.Duration, error) {
+  limits := l.Limits()
+  if limit := limits.MaxSize(clipType); limit > 0 && size > limit {
+    return 0, utils.ErrClipTooLarge
+  }
+
+  if content != nil && limits.Quota > 0 {
+    // the database errors are reported by the insert
+    usage, err := DB.GetStorageUsage(content.Username, content.Channel, content.ClientID)
+    if err == nil && usage+int64(len(content.Content)) > limits.Quota {
+      return 0, utils.ErrQuotaExceeded
+    }
+  }
+
+  if wait := l.take(user); wait > 0 {
+    return wait, utils.ErrTooManyClips
+  }
+
+  return 0, nil
+}
+
+// Cleanup remove the buckets which are full again
+func (l *ClipLimiter) Cleanup() {
+  l.Lock()
+  defer l.Unlock()
+
+  if l.config.Rate <= 0 {
+    return
+  }
+
+  full := time.Duration(float64(l.config.Burst) / float64(l.config.Rate) * float64(time.Minute))
+  for user, bucket := range l.buckets {
+    if time.Since(bucket.updated) > full {
+      delete(l.buckets, user)
+    }
+  }
+}
+
+// rejectClip report the violated limit to the client by the error action, the
+// connection is kept
+func (c *Client) rejectClip(err error, wait time.Duration, size int) {
+  c.logger().Warnf("Rejected clip of %d bytes: %v.", size, err)
+  metricLimited.WithLabelValues(utils.ErrorCode(err)).Inc()
+  c.audit(utils.AuditInfo{Event: AuditClipboardPush, Detail: err.Error() + ", " + strconv.Itoa(size) + " bytes"})
+
+  c.sendError(err, wait)
+}
+
+// limitResponse set the http status of the violated limit
+func limitResponse(rest *RestfulRespInfo, err error, wait time.Duration) {
+  metricLimited.WithLabelValues(utils.ErrorCode(err)).Inc()
+
+  switch err {
+  case utils.ErrClipTooLarge:
+    rest.Response.Code = http.StatusRequestEntityTooLarge
+    rest.Response.Message = "Clip Is Too Large."
+  case utils.ErrQuotaExceeded:
+    rest.Response.Code = http.StatusInsufficientStorage
+    rest.Response.Message = "Storage Quota Exceeded."
+  default:
+    rest.Writer.Header().Set("Retry-After", retryAfter(wait))
+    rest.Response.Code = http.StatusTooManyRequests
+    rest.Response.Message = "Too Many Clips."
+  }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/base64"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestClipLimits(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  GlobalConfig.Limits = utils.LimitsConfig{MaxText: 8, MaxImage: 16, Quota: 200, Rate: 60, Burst: 2}
+
+  check := func(user string, data []byte, content *utils.ClipContentInfo) (time.Duration, error) {
+    clipType, size := utils.ClipTypeOf(data)
+    return ClipLimits.Check(user, clipType, size, content)
+  }
+
+  image, _ := utils.EncodeToBytes(utils.ClipBoardBuff{Type: utils.CLIP_IMAGE, Buff: make([]byte, 12)})
+  if _, err := check("u1", textClip("123456789"), nil); err != utils.ErrClipTooLarge {
+    t.Fatal("Text over its limit should be rejected:", err)
+  }
+  if _, err := check("u1", image, nil); err != nil {
+    t.Fatal("Image within its limit should be allowed:", err)
+  }
+
+  // the burst is used up, the next clip is allowed after a second
+  check("u1", textClip("a"), nil)
+  if wait, err := check("u1", textClip("b"), nil); err != utils.ErrTooManyClips || wait <= 0 || wait > time.Second {
+    t.Fatal("Clips over the burst should be rate limited:", wait, err)
+  }
+  if _, err := check("u2", textClip("b"), nil); err != nil {
+    t.Fatal("Other users should have their own rate:", err)
+  }
+
+  GlobalConfig.Limits.Rate = 0
+
+  content := &utils.ClipContentInfo{ClientID: "c1", Username: "u1", Content: strings.Repeat("x", 150)}
+  DB.InsertClipContent(content)
+
+  // replacing the clip of the device only counts the new one
+  if _, err := check("u1", textClip("a"), content); err != nil {
+    t.Fatal("Replaced clip should not count:", err)
+  }
+  if _, err := check("u1", textClip("a"), &utils.ClipContentInfo{ClientID: "c2", Username: "u1", Content: strings.Repeat("x", 100)}); err != utils.ErrQuotaExceeded {
+    t.Fatal("Clips over the quota should be rejected:", err)
+  }
+
+  // the clips over the quota keep the rate allowance
+  GlobalConfig.Limits.Rate, GlobalConfig.Limits.Burst = 60, 1
+  over := &utils.ClipContentInfo{ClientID: "c1", Username: "u5", Content: strings.Repeat("x", 250)}
+  for i := 0; i < 3; i++ {
+    if _, err := check("u5", textClip("a"), over); err != utils.ErrQuotaExceeded {
+      t.Fatal("Clips over the quota should be rejected before the rate:", err)
+    }
+  }
+  if _, err := check("u5", textClip("a"), nil); err != nil {
+    t.Fatal("Rejected clips should not use the rate:", err)
+  }
+  GlobalConfig.Limits.Rate, GlobalConfig.Limits.Burst = 0, 2
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  conn, _ := registerWs(t, server, "c1", "u1:pass:auto")
+  defer disconnect(t, conn, "c1")
+
+  // the violation is replied and the connection is kept
+  for _, text := range []string{"too large text", "ok"} {
+    sendWs(conn, utils.ActionClipboardChanged, "c1", textClip(text))
+  }
+
+  reply := readWs(t, conn)
+  info := &utils.ErrorInfo{}
+  if reply.Action != utils.ActionError || json.Unmarshal(reply.Data, info) != nil || info.Code != utils.ErrorTooLarge {
+    t.Fatal("Clip over the limit should be replied with an error:", info.Code)
+  }
+
+  for i := 0; i < 100 && DB.GetClipContentByID("c1") != base64.StdEncoding.EncodeToString(textClip("ok")); i++ {
+    time.Sleep(10 * time.Millisecond)
+  }
+  if DB.GetClipContentByID("c1") != base64.StdEncoding.EncodeToString(textClip("ok")) {
+    t.Fatal("Connection should be kept after a rejected clip.")
+  }
+
+  req, _ := http.NewRequest("POST", server.URL+"/clipboard/set", strings.NewReader(`{"client_id":"script","content":"too large text"}`))
+  req.SetBasicAuth("u1", "pass")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal("Failed to set clipboard:", err)
+  }
+  resp.Body.Close()
+
+  if resp.StatusCode != http.StatusRequestEntityTooLarge {
+    t.Fatal("Rest clip over the limit should be rejected:", resp.StatusCode)
+  }
+}
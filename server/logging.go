@@ -0,0 +1,55 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "net/http"
+  "regexp"
+
+  "github.com/google/uuid"
+  log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader header carrying the request ID, taken from the proxy if valid
+const requestIDHeader = "X-Request-ID"
+
+// contextRequestID request context key of the request ID
+const contextRequestID contextKey = "request-id"
+
+// the request IDs accepted from the proxy, anything else is replaced
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMDW assign an ID to each request, it is logged and returned in the response header
+func RequestIDMDW(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    id := r.Header.Get(requestIDHeader)
+    if !requestIDPattern.MatchString(id) {
+      id = uuid.NewString()
+    }
+
+    w.Header().Set(requestIDHeader, id)
+
+    ctx := context.WithValue(r.Context(), contextRequestID, id)
+    next.ServeHTTP(w, r.WithContext(ctx))
+  })
+}
+
+// requestID return the ID of the request assigned by RequestIDMDW
+func requestID(r *http.Request) string {
+  id, _ := r.Context().Value(contextRequestID).(string)
+  return id
+}
+
+// reqLog return the logger carrying the request fields
+func reqLog(r *http.Request) *log.Entry {
+  fields := log.Fields{
+    utils.LogFieldRequestID:  requestID(r),
+    utils.LogFieldRemoteAddr: clientIP(r),
+  }
+
+  if user, ok := r.Context().Value(contextUser).(string); ok {
+    fields[utils.LogFieldUsername] = user
+  }
+
+  return log.WithFields(fields)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+
+  "github.com/gorilla/mux"
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promauto"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  log "github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "clipboard"
+
+var (
+  metricClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+    Namespace: metricsNamespace,
+    Name:      "websocket_clients",
+    Help:      "Connected websocket clients by mode.",
+  }, []string{"mode"})
+
+  metricRegistrations = promauto.NewCounter(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "websocket_registrations_total",
+    Help:      "Succeeded websocket client registrations.",
+  })
+
+  metricHandshakeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "websocket_handshake_failures_total",
+    Help:      "Failed websocket handshakes by reason.",
+  }, []string{"reason"})
+
+  metricFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+    Namespace: metricsNamespace,
+    Name:      "broadcast_fanout_clients",
+    Help:      "Clients a clipboard change is pushed to.",
+    Buckets:   []float64{0, 1, 2, 3, 5, 8, 13, 21},
+  })
+
+  metricBroadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+    Namespace: metricsNamespace,
+    Name:      "broadcast_duration_seconds",
+    Help:      "Time from sending a clipboard change to the router until it is queued to all clients.",
+    Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+  })
+
+  metricDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "broadcast_duplicates_total",
+    Help:      "Clipboard changes not broadcast because they equal the latest clip of the user.",
+  })
+
+  metricPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "direct_pushes_total",
+    Help:      "Direct pushes to a single client by delivery result.",
+  }, []string{"delivered"})
+
+  metricLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "limit_violations_total",
+    Help:      "Clips rejected by the size, quota and rate limits by error code.",
+  }, []string{"code"})
+
+  metricMessageSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: metricsNamespace,
+    Name:      "message_size_bytes",
+    Help:      "Size of the clipboard content received by source.",
+    Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+  }, []string{"source"})
+
+  metricDBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: metricsNamespace,
+    Name:      "db_operation_duration_seconds",
+    Help:      "Latency of the database operations.",
+    Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+  }, []string{"operation"})
+
+  metricHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+    Namespace: metricsNamespace,
+    Name:      "http_requests_total",
+    Help:      "Http requests by route, method and status code.",
+  }, []string{"route", "method", "code"})
+
+  metricSessions = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+    Namespace: metricsNamespace,
+    Name:      "sessions",
+    Help:      "Sessions in the session store, including the expired ones.",
+  }, func() float64 {
+    if SessionStore == nil {
+      return 0
+    }
+
+    n, err := SessionStore.Count()
+    if err != nil {
+      log.Errorln("Failed to count sessions:", err)
+    }
+    return float64(n)
+  })
+)
+
+// clientMode label value of the client mode
+func clientMode(c *Client) string {
+  if c.auto {
+    return "auto"
+  }
+
+  return "manual"
+}
+
+// observeDB record the latency of the database operations
+func observeDB(operation string, d time.Duration) {
+  metricDBDuration.WithLabelValues(operation).Observe(d.Seconds())
+}
+
+// statusWriter remember the status code of the response, websocket upgrades need the hijacker
+type statusWriter struct {
+  http.ResponseWriter
+  code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+  w.code = code
+  w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hijacker, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("response writer is not a hijacker")
+  }
+
+  w.code = http.StatusSwitchingProtocols
+  return hijacker.Hijack()
+}
+
+// MetricsMDW count the requests by route template, so the path variables do not explode the labels
+func MetricsMDW(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+    next.ServeHTTP(sw, r)
+
+    route := "unknown"
+    if current := mux.CurrentRoute(r); current != nil {
+      if tpl, err := current.GetPathTemplate(); err == nil {
+        route = tpl
+      }
+    }
+
+    metricHTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.code)).Inc()
+  })
+}
+
+// ServeMetrics serve /metrics on the metrics address, it is plain http and should not be public
+func ServeMetrics(addr string) *http.Server {
+  handler := http.NewServeMux()
+  handler.Handle("/metrics", promhttp.Handler())
+
+  server := &http.Server{
+    Addr:    addr,
+    Handler: handler,
+  }
+
+  go func() {
+    if err := server.ListenAndServe(); err != http.ErrServerClosed {
+      log.Errorln("Failed to serve metrics:", err)
+    }
+  }()
+
+  return server
+}
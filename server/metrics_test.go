@@ -0,0 +1,69 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+  "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.SetObserver(observeDB)
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  clients := testutil.ToFloat64(metricClients.WithLabelValues("auto"))
+  failures := testutil.ToFloat64(metricHandshakeFailures.WithLabelValues("auth"))
+
+  register := func(data string) *websocket.Conn {
+    conn, _ := registerWs(t, server, "c1", data)
+    return conn
+  }
+
+  conn := register("u1:pass:auto")
+  if n := testutil.ToFloat64(metricClients.WithLabelValues("auto")); n != clients+1 {
+    t.Fatal("Auto client should be counted:", n)
+  }
+
+  register("u1:wrong:auto").Close()
+  if n := testutil.ToFloat64(metricHandshakeFailures.WithLabelValues("auth")); n != failures+1 {
+    t.Fatal("Handshake failure should be counted:", n)
+  }
+
+  req, _ := http.NewRequest("POST", server.URL+"/clipboard/set", strings.NewReader(`{"client_id":"script","content":"hello"}`))
+  req.SetBasicAuth("u1", "pass")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal("Failed to set clipboard:", err)
+  }
+  resp.Body.Close()
+
+  if n := testutil.ToFloat64(metricHTTPRequests.WithLabelValues("/clipboard/set", "POST", "200")); n < 1 {
+    t.Fatal("Request should be counted by route:", n)
+  }
+
+  if testutil.CollectAndCount(metricDBDuration) == 0 || testutil.CollectAndCount(metricFanout) == 0 {
+    t.Fatal("Database and broadcast metrics should be observed.")
+  }
+
+  if n := testutil.ToFloat64(metricSessions); n != 0 {
+    t.Fatal("No session should be stored:", n)
+  }
+
+  disconnect(t, conn, "c1")
+  for i := 0; i < 100 && testutil.ToFloat64(metricClients.WithLabelValues("auto")) != clients; i++ {
+    time.Sleep(10 * time.Millisecond)
+  }
+  if n := testutil.ToFloat64(metricClients.WithLabelValues("auto")); n != clients {
+    t.Fatal("Disconnected client should not be counted:", n)
+  }
+}
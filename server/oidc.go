@@ -0,0 +1,189 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+
+  "github.com/coreos/go-oidc/v3/oidc"
+  "golang.org/x/oauth2"
+)
+
+const cookieOIDCState string = "oidc-state"
+const cookieOIDCNonce string = "oidc-nonce"
+
+// OIDCAuth OpenID Connect relying party
+type OIDCAuth struct {
+  config   *utils.OIDCConfig
+  verifier *oidc.IDTokenVerifier
+  oauth2   oauth2.Config
+}
+
+// NewOIDCAuth discover the identity provider and return the relying party
+func NewOIDCAuth(ctx context.Context, config *utils.OIDCConfig) (*OIDCAuth, error) {
+  provider, err := oidc.NewProvider(ctx, config.Issuer)
+  if err != nil {
+    return nil, fmt.Errorf("failed to discover provider(%s): %w", config.Issuer, err)
+  }
+
+  return &OIDCAuth{
+    config:   config,
+    verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+    oauth2: oauth2.Config{
+      ClientID:     config.ClientID,
+      ClientSecret: config.ClientSecret,
+      RedirectURL:  config.RedirectURL,
+      Endpoint:     provider.Endpoint(),
+      Scopes:       config.Scopes,
+    },
+  }, nil
+}
+
+// oidcIdentity the user at the identity provider, the username claim is only used to
+// provision a new user
+type oidcIdentity struct {
+  Issuer   string
+  Subject  string
+  Username string
+}
+
+// identity exchange the authorization code and return the identity of the id token
+func (o *OIDCAuth) identity(ctx context.Context, code string, nonce string) (*oidcIdentity, error) {
+  token, err := o.oauth2.Exchange(ctx, code)
+  if err != nil {
+    return nil, fmt.Errorf("failed to exchange code: %w", err)
+  }
+
+  rawIDToken, ok := token.Extra("id_token").(string)
+  if !ok {
+    return nil, errors.New("no id_token in token response")
+  }
+
+  idToken, err := o.verifier.Verify(ctx, rawIDToken)
+  if err != nil {
+    return nil, fmt.Errorf("failed to verify id token: %w", err)
+  }
+
+  if idToken.Nonce != nonce {
+    return nil, errors.New("id token nonce mismatch")
+  }
+
+  var claims map[string]interface{}
+  if err = idToken.Claims(&claims); err != nil {
+    return nil, fmt.Errorf("failed to parse claims: %w", err)
+  }
+
+  user, _ := claims[o.config.UsernameClaim].(string)
+  if user == "" {
+    return nil, fmt.Errorf("claim %s is missing", o.config.UsernameClaim)
+  }
+
+  return &oidcIdentity{Issuer: idToken.Issuer, Subject: idToken.Subject, Username: user}, nil
+}
+
+// LoginOIDCHandlerFunc redirect to the identity provider
+func (clip *ClipHandler) LoginOIDCHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  if OIDC == nil {
+    http.NotFound(w, r)
+    return
+  }
+
+  state := utils.RandomString(16)
+  nonce := utils.RandomString(16)
+
+  session := getSession(r)
+  session.Values[cookieOIDCState] = state
+  session.Values[cookieOIDCNonce] = nonce
+  saveSession(w, r, session)
+
+  http.Redirect(w, r, OIDC.oauth2.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// OIDCCallbackHandlerFunc handler for the identity provider redirection
+func (clip *ClipHandler) OIDCCallbackHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  if OIDC == nil {
+    http.NotFound(w, r)
+    return
+  }
+
+  session := getSession(r)
+  state, _ := session.Values[cookieOIDCState].(string)
+  nonce, _ := session.Values[cookieOIDCNonce].(string)
+
+  // state and nonce can only be used once
+  delete(session.Values, cookieOIDCState)
+  delete(session.Values, cookieOIDCNonce)
+  saveSession(w, r, session)
+
+  if state == "" || r.URL.Query().Get("state") != state {
+    reqLog(r).Errorln("Invalid single sign-on state.")
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "单点登录失败，请重新登录！"))
+    return
+  }
+
+  if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+    reqLog(r).Errorln("Single sign-on failed:", errMsg, r.URL.Query().Get("error_description"))
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "单点登录失败，请重新登录！"))
+    return
+  }
+
+  identity, err := OIDC.identity(r.Context(), r.URL.Query().Get("code"), nonce)
+  if err != nil {
+    reqLog(r).Errorln("Single sign-on failed:", err)
+    auditRequest(r, AuditLogin, "", false, "oidc: "+err.Error())
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "单点登录失败，请重新登录！"))
+    return
+  }
+
+  // the identity is linked to a user by its issuer and subject, the username claim never
+  // signs in an existing user
+  user := DB.GetOIDCLink(identity.Issuer, identity.Subject)
+  if user == "" {
+    user = GetSessionUser(r)
+
+    switch {
+    case user != "":
+      // linked explicitly by the signed in user
+      reqLog(r).Infof("Linked single sign-on identity(%s) to user(%s).", identity.Subject, user)
+    case DB.GetUserByName(identity.Username) != nil:
+      reqLog(r).Errorf("Single sign-on user(%s) is a local user not linked to the identity.", identity.Username)
+      auditRequest(r, AuditLogin, identity.Username, false, "oidc: user not linked")
+      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "账号未绑定单点登录，请先用密码登录后绑定！"))
+      return
+    case !OIDC.config.AutoProvision:
+      reqLog(r).Errorf("Single sign-on user(%s) is not exist.", identity.Username)
+      auditRequest(r, AuditLogin, identity.Username, false, "oidc: user not exist")
+      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "用户不存在，请联系管理员！"))
+      return
+    default:
+      // just-in-time provisioning, the random password is never shown so the user signs in with single sign-on only
+      user = identity.Username
+      err = DB.InsertUserInfo([]utils.AuthConfig{{User: user, Password: utils.RandomString(24)}})
+      if err != nil {
+        reqLog(r).Errorln("Failed to provision single sign-on user:", user, err)
+        clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "单点登录失败，请重新登录！"))
+        return
+      }
+
+      reqLog(r).Infoln("Provisioned single sign-on user:", user)
+      auditRequest(r, AuditRegister, user, true, "oidc provisioning")
+    }
+
+    if err = DB.LinkOIDC(identity.Issuer, identity.Subject, user); err != nil {
+      reqLog(r).Errorln("Failed to link single sign-on identity:", user, err)
+      clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "单点登录失败，请重新登录！"))
+      return
+    }
+  } else if DB.GetUserByName(user) == nil {
+    reqLog(r).Errorf("Single sign-on user(%s) is not exist.", user)
+    auditRequest(r, AuditLogin, user, false, "oidc: user not exist")
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in.html", newPageInfo(w, r, "用户不存在，请联系管理员！"))
+    return
+  }
+
+  reqLog(r).Infoln("Single sign-on succeed:", user)
+
+  finishLogin(w, r, user, "oidc")
+}
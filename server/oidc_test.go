@@ -0,0 +1,183 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "context"
+  "crypto/rand"
+  "crypto/rsa"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/go-jose/go-jose/v3"
+  "github.com/go-jose/go-jose/v3/jwt"
+)
+
+// mockProvider minimal OpenID Connect identity provider
+type mockProvider struct {
+  server  *httptest.Server
+  key     *rsa.PrivateKey
+  subject string
+  nonce   string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    t.Fatal("Failed to generate key:", err)
+  }
+
+  p := &mockProvider{key: key}
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]interface{}{
+      "issuer":                                p.server.URL,
+      "authorization_endpoint":                p.server.URL + "/auth",
+      "token_endpoint":                        p.server.URL + "/token",
+      "jwks_uri":                              p.server.URL + "/keys",
+      "id_token_signing_alg_values_supported": []string{"RS256"},
+    })
+  })
+  mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+      {Key: &p.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+    }})
+  })
+  mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    if r.FormValue("code") != "good-code" {
+      http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+      return
+    }
+
+    signer, _ := jose.NewSigner(jose.SigningKey{
+      Algorithm: jose.RS256,
+      Key:       jose.JSONWebKey{Key: p.key, KeyID: "test"},
+    }, (&jose.SignerOptions{}).WithType("JWT"))
+
+    idToken, _ := jwt.Signed(signer).Claims(map[string]interface{}{
+      "iss":                p.server.URL,
+      "aud":                "clip",
+      "sub":                p.subject,
+      "exp":                time.Now().Add(time.Hour).Unix(),
+      "iat":                time.Now().Unix(),
+      "nonce":              p.nonce,
+      "preferred_username": p.subject,
+    }).CompactSerialize()
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+      "access_token": "access",
+      "token_type":   "Bearer",
+      "expires_in":   3600,
+      "id_token":     idToken,
+    })
+  })
+
+  p.server = httptest.NewServer(mux)
+  t.Cleanup(p.server.Close)
+
+  return p
+}
+
+// loginOIDC run the authorization code flow, return the callback response
+func loginOIDC(t *testing.T, browser *testBrowser, provider *mockProvider, code string) *httptest.ResponseRecorder {
+  w := browser.do("GET", "/login/oidc", nil)
+  if w.Code != http.StatusFound {
+    t.Fatal("Login should redirect to provider:", w.Code)
+  }
+
+  authURL, err := url.Parse(w.Header().Get("Location"))
+  if err != nil || !strings.HasPrefix(authURL.String(), provider.server.URL+"/auth") {
+    t.Fatal("Bad authorization url:", authURL)
+  }
+
+  provider.nonce = authURL.Query().Get("nonce")
+
+  return browser.do("GET", "/login/oidc/callback?code="+code+"&state="+authURL.Query().Get("state"), nil)
+}
+
+func TestOIDCLogin(t *testing.T) {
+  handler := setupTestServer(t)
+  provider := newMockProvider(t)
+
+  GlobalConfig.OIDC = utils.OIDCConfig{
+    Issuer:        provider.server.URL,
+    ClientID:      "clip",
+    ClientSecret:  "secret",
+    RedirectURL:   "https://clip.example/login/oidc/callback",
+    Scopes:        []string{"openid"},
+    UsernameClaim: "preferred_username",
+  }
+
+  var err error
+  OIDC, err = NewOIDCAuth(context.Background(), &GlobalConfig.OIDC)
+  if err != nil {
+    t.Fatal("Failed to init oidc:", err)
+  }
+  defer func() { OIDC = nil }()
+
+  // unknown user without provisioning
+  provider.subject = "sso-user"
+  browser := newTestBrowser(handler)
+  w := loginOIDC(t, browser, provider, "good-code")
+  if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "用户不存在") {
+    t.Fatal("Unknown user should be rejected:", w.Code)
+  }
+
+  // bad authorization code
+  w = loginOIDC(t, browser, provider, "bad-code")
+  if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "单点登录失败") {
+    t.Fatal("Bad code should be rejected:", w.Code)
+  }
+
+  // bad state
+  w = browser.do("GET", "/login/oidc/callback?code=good-code&state=forged", nil)
+  if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "单点登录失败") {
+    t.Fatal("Forged state should be rejected:", w.Code)
+  }
+
+  // just-in-time provisioning
+  GlobalConfig.OIDC.AutoProvision = true
+  w = loginOIDC(t, browser, provider, "good-code")
+  if w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Login should succeed:", w.Code, w.Header().Get("Location"))
+  }
+
+  if DB.GetUserByName("sso-user") == nil {
+    t.Fatal("User should be provisioned.")
+  }
+
+  w = browser.do("GET", "/content", nil)
+  if w.Code != http.StatusOK {
+    t.Fatal("Session should be created:", w.Code)
+  }
+
+  // the username claim of an existing local user is not enough
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "admin", Password: "admin-pass"}})
+  provider.subject = "admin"
+  browser = newTestBrowser(handler)
+  w = loginOIDC(t, browser, provider, "good-code")
+  if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "账号未绑定单点登录") {
+    t.Fatal("Local user not linked should be rejected:", w.Code)
+  }
+
+  // the signed in user links the identity
+  browser.do("GET", "/login", nil)
+  if w = browser.do("POST", "/login", url.Values{"username": {"admin"}, "password": {"admin-pass"}}); w.Code != http.StatusFound {
+    t.Fatal("Password login should succeed:", w.Code)
+  }
+  if w = loginOIDC(t, browser, provider, "good-code"); w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Signed in user should link the identity:", w.Code)
+  }
+
+  browser = newTestBrowser(handler)
+  if w = loginOIDC(t, browser, provider, "good-code"); w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Linked identity should sign in:", w.Code)
+  }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "sort"
+  "time"
+)
+
+// devicesRequest presence query answered by the router
+type devicesRequest struct {
+  username string
+  reply    chan []utils.DeviceInfo
+}
+
+// DevicesRespInfo response of the presence API
+type DevicesRespInfo struct {
+  Code    int                `json:"code"`
+  Message string             `json:"message"`
+  Data    []utils.DeviceInfo `json:"data"`
+}
+
+// deviceInfo return the presence of the client
+func (c *Client) deviceInfo() utils.DeviceInfo {
+  return utils.DeviceInfo{
+    ClientID:   c.id,
+    Mode:       clientMode(c),
+    Connected:  c.connected.Format(time.RFC3339),
+    RemoteAddr: c.remoteIP,
+    Version:    c.version,
+    Platform:   c.platform,
+  }
+}
+
+// Devices return the online devices of the user, sorted by client ID
+func (r *Router) Devices(username string) []utils.DeviceInfo {
+  req := &devicesRequest{username: username, reply: make(chan []utils.DeviceInfo, 1)}
+  r.devices <- req
+
+  return <-req.reply
+}
+
+// userDevices list the registered clients of the user, only called by the router
+func (r *Router) userDevices(username string) []utils.DeviceInfo {
+  devices := []utils.DeviceInfo{}
+  if tmpList, ok := r.clients[username]; ok {
+    for i := tmpList.Front(); i != nil; i = i.Next() {
+      devices = append(devices, i.Value.(*Client).deviceInfo())
+    }
+  }
+
+  sort.SliceStable(devices, func(i, j int) bool {
+    return devices[i].ClientID < devices[j].ClientID
+  })
+
+  return devices
+}
+
+// notifyPresence tell the other clients of the user that the client joined or left,
+// only called by the router
+func (r *Router) notifyPresence(client *Client, event string) {
+  tmpList, ok := r.clients[client.username]
+  if !ok {
+    return
+  }
+
+  data, _ := json.Marshal(&utils.PresenceEvent{Event: event, Device: client.deviceInfo()})
+  b := (&utils.WebsocketMessage{
+    Action: utils.ActionPresence,
+    UserID: client.id,
+    Data:   data,
+  }).Encode()
+
+  for i := tmpList.Front(); i != nil; i = i.Next() {
+    if tmp := i.Value.(*Client); tmp != client && !tmp.closed {
+      tmp.send <- b
+    }
+  }
+}
+
+// DevicesHandlerFunc list the online devices of the user
+func (clip *ClipHandler) DevicesHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  resp := DevicesRespInfo{
+    Code:    http.StatusOK,
+    Message: "Get devices succeed.",
+    Data:    clip.router.Devices(RequestUser(r)),
+  }
+
+  b, _ := json.Marshal(resp)
+
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(resp.Code)
+  w.Write(b)
+}
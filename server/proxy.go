@@ -0,0 +1,93 @@
+package main
+
+import (
+  "net"
+  "net/http"
+  "strings"
+)
+
+// networks of the reverse proxies whose X-Forwarded headers are trusted
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies parse the trusted proxy addresses, single ips or CIDRs
+func initTrustedProxies(proxies []string) error {
+  trustedProxies = nil
+
+  for _, proxy := range proxies {
+    if !strings.Contains(proxy, "/") {
+      if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+        proxy += "/32"
+      } else {
+        proxy += "/128"
+      }
+    }
+
+    _, ipNet, err := net.ParseCIDR(proxy)
+    if err != nil {
+      return err
+    }
+    trustedProxies = append(trustedProxies, ipNet)
+  }
+
+  return nil
+}
+
+// trustedProxy check the peer is a trusted proxy, the peers of the unix socket have no ip
+// and are always trusted
+func trustedProxy(addr string) bool {
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    return addr == "" || addr == "@"
+  }
+
+  for _, ipNet := range trustedProxies {
+    if ipNet.Contains(ip) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// peerIP return the ip of the connection peer
+func peerIP(r *http.Request) string {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+
+  return host
+}
+
+// clientIP return the remote ip of the request. Behind trusted proxies it is the last
+// address of X-Forwarded-For which is not a trusted proxy.
+func clientIP(r *http.Request) string {
+  ip := peerIP(r)
+  if !trustedProxy(ip) {
+    return ip
+  }
+
+  forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+  for i := len(forwarded) - 1; i >= 0; i-- {
+    addr := strings.TrimSpace(forwarded[i])
+    if addr == "" {
+      continue
+    }
+
+    ip = addr
+    if !trustedProxy(addr) {
+      break
+    }
+  }
+
+  return ip
+}
+
+// requestSecure check the request came over https, directly or by a trusted proxy
+func requestSecure(r *http.Request) bool {
+  if r.TLS != nil || GlobalConfig.TLSEnabled() {
+    return true
+  }
+
+  return trustedProxy(peerIP(r)) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestTrustedProxy(t *testing.T) {
+  tlsOff := false
+  GlobalConfig = &utils.ServerConfig{TLS: &tlsOff}
+
+  if err := initTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+    t.Fatal("Failed to parse trusted proxies:", err)
+  }
+  defer initTrustedProxies(nil)
+
+  req := httptest.NewRequest("GET", "/", nil)
+  req.RemoteAddr = "10.0.0.2:1234"
+  req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9, 192.168.1.1")
+  req.Header.Set("X-Forwarded-Proto", "https")
+
+  if ip := clientIP(req); ip != "203.0.113.9" {
+    t.Fatal("Client ip should be the last untrusted forwarded address:", ip)
+  }
+  if !requestSecure(req) {
+    t.Fatal("Forwarded https from a trusted proxy should be secure.")
+  }
+
+  // headers from other peers are ignored
+  req.RemoteAddr = "203.0.113.1:1234"
+  if ip := clientIP(req); ip != "203.0.113.1" || requestSecure(req) {
+    t.Fatal("Untrusted peer should not be forwarded:", ip)
+  }
+
+  // the peers of the unix socket are the local proxy
+  req.RemoteAddr = "@"
+  if ip := clientIP(req); ip != "203.0.113.9" {
+    t.Fatal("Unix socket peer should be trusted:", ip)
+  }
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "io"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// textClip encode the text as a clipboard buffer
+func textClip(text string) []byte {
+  clipBuff, _ := utils.EncodeToBytes(utils.ClipBoardBuff{
+    Type: utils.CLIP_TEXT,
+    Buff: utils.StringToBytes(text),
+  })
+
+  return clipBuff
+}
+
+// auditPush record a direct push of the http request
+func auditPush(r *http.Request, user string, clientID string, target string, size int, delivered bool) {
+  recordAudit(&utils.AuditInfo{
+    Event:    AuditClipboardPush,
+    Username: user,
+    ClientID: clientID,
+    RemoteIP: clientIP(r),
+    Success:  delivered,
+    Detail:   "direct to " + target + ", " + strconv.Itoa(size) + " bytes",
+  })
+}
+
+// handClipboardPushMsg send the clip to one client of the user, the router replies the result
+func (c *Client) handClipboardPushMsg(wsm *utils.WebsocketMessage) error {
+  if c.id == "" || c.username == "" {
+    return utils.ErrUnAuthenticatedClient
+  }
+
+  if !utils.ScopeAllows(c.scope, utils.ScopeWrite) {
+    return utils.ErrPermissionDenied
+  }
+
+  if wsm.Target == "" {
+    return utils.ErrBadAction
+  }
+
+  metricMessageSize.WithLabelValues("websocket").Observe(float64(len(wsm.Data)))
+
+  clipType, size := utils.ClipTypeOf(wsm.Data)
+  if wait, err := ClipLimits.Check(c.username, clipType, size, nil); err != nil {
+    c.rejectClip(err, wait, len(wsm.Data))
+    return nil
+  }
+
+  c.router.broadcast <- &Message{
+    id:       c.id,
+    username: c.username,
+    content:  wsm.Data,
+    hash:     utils.ContentHash(wsm.Data),
+    clipType: clipType,
+    target:   wsm.Target,
+    sender:   c,
+    created:  time.Now(),
+  }
+
+  c.audit(utils.AuditInfo{Event: AuditClipboardPush, Success: true, Detail: "direct to " + wsm.Target + ", " + strconv.Itoa(len(wsm.Data)) + " bytes"})
+
+  return nil
+}
+
+// RestPushClipHandlerFunc send the text to one online client of the user
+func (clip *ClipHandler) RestPushClipHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := RequestUser(r)
+
+  // restful API reponse sender
+  rest := RestfulRespInfo{
+    Writer: w,
+    Response: utils.RespInfo{
+      Code:    http.StatusOK,
+      Message: "Push clipboard succeed.",
+    },
+  }
+
+  defer rest.send()
+
+  body, err := io.ReadAll(r.Body)
+  if err != nil {
+    rest.Response.Code = http.StatusInternalServerError
+    rest.Response.Message = err.Error()
+    return
+  }
+
+  var dataInfo utils.DataInfo
+  if err = json.Unmarshal(body, &dataInfo); err != nil || dataInfo.Target == "" {
+    rest.Response.Code = http.StatusBadRequest
+    rest.Response.Message = "Invalid Push Request."
+    return
+  }
+
+  metricMessageSize.WithLabelValues("rest").Observe(float64(len(dataInfo.Content)))
+
+  clipBuff := textClip(dataInfo.Content)
+  if wait, err := ClipLimits.Check(user, utils.ClipTypeText, len(dataInfo.Content), nil); err != nil {
+    limitResponse(&rest, err, wait)
+    return
+  }
+
+  delivered := clip.router.Push(&Message{
+    id:       dataInfo.ClientID,
+    username: user,
+    content:  clipBuff,
+    hash:     utils.ContentHash(clipBuff),
+    clipType: utils.ClipTypeText,
+    target:   dataInfo.Target,
+    created:  time.Now(),
+  })
+
+  auditPush(r, user, dataInfo.ClientID, dataInfo.Target, len(dataInfo.Content), delivered)
+
+  if !delivered {
+    rest.Response.Code = http.StatusNotFound
+    rest.Response.Message = "Target Device Is Not Online."
+  }
+}
+
+// DoPushHandlerFunc send the text of the content page to one online client of the user
+func (clip *ClipHandler) DoPushHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetSessionUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/", http.StatusFound)
+    return
+  }
+
+  target := r.PostFormValue("target")
+  content := r.PostFormValue("content")
+  if target == "" {
+    clip.renderContent(w, r, user, "请填写目标设备")
+    return
+  }
+
+  clipBuff := textClip(content)
+  if _, err := ClipLimits.Check(user, utils.ClipTypeText, len(content), nil); err != nil {
+    metricLimited.WithLabelValues(utils.ErrorCode(err)).Inc()
+    clip.renderContent(w, r, user, "发送失败: "+limitMessages[err])
+    return
+  }
+
+  delivered := clip.router.Push(&Message{
+    id:       "web",
+    username: user,
+    content:  clipBuff,
+    hash:     utils.ContentHash(clipBuff),
+    clipType: utils.ClipTypeText,
+    target:   target,
+    created:  time.Now(),
+  })
+
+  auditPush(r, user, "web", target, len(content), delivered)
+
+  if !delivered {
+    clip.renderContent(w, r, user, "目标设备不在线: "+target)
+    return
+  }
+
+  clip.renderContent(w, r, user, "已发送到 "+target)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+
+  "github.com/gorilla/websocket"
+)
+
+func TestDirectPush(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  register := func(id string, mode string) *websocket.Conn {
+    conn, _ := registerWs(t, server, id, "u1:pass:"+mode)
+    return conn
+  }
+
+  laptop := register("laptop", "auto")
+  room := register("room", "manual")
+
+  push := &utils.WebsocketMessage{Action: utils.ActionClipboardPush, UserID: "laptop", Data: []byte("slides"), Target: "room"}
+  laptop.WriteMessage(websocket.BinaryMessage, push.Encode())
+
+  if wsm := readWs(t, room); wsm.Action != utils.ActionClipboardChanged || string(wsm.Data) != "slides" {
+    t.Fatal("Manual client should receive the direct push:", wsm.Action)
+  }
+
+  var result utils.PushResult
+  if wsm := readWs(t, laptop); wsm.Action != utils.ActionPushResult || json.Unmarshal(wsm.Data, &result) != nil || !result.Delivered {
+    t.Fatal("Sender should get the delivery result:", wsm.Action, result)
+  }
+
+  push.Target = "phone"
+  laptop.WriteMessage(websocket.BinaryMessage, push.Encode())
+  if wsm := readWs(t, laptop); json.Unmarshal(wsm.Data, &result) != nil || result.Delivered || result.Target != "phone" {
+    t.Fatal("Push to an offline device should not be delivered:", result)
+  }
+
+  req, _ := http.NewRequest("POST", server.URL+"/clipboard/push", strings.NewReader(`{"client_id":"script","target":"phone","content":"x"}`))
+  req.SetBasicAuth("u1", "pass")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal("Failed to push:", err)
+  }
+  resp.Body.Close()
+
+  if resp.StatusCode != http.StatusNotFound {
+    t.Fatal("Push to an offline device should fail:", resp.StatusCode)
+  }
+
+  disconnect(t, laptop, "laptop")
+  disconnect(t, room, "room")
+}
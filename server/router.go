@@ -3,6 +3,14 @@ package main
 import (
   "clipboard-remote/utils"
   "container/list"
+  "context"
+  "encoding/json"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+
+  "github.com/gorilla/websocket"
 )
 
 // Router maintains the set of active clients and broadcasts messages to the
@@ -19,6 +27,36 @@ type Router struct {
 
   // Register request from client
   register chan *Client
+
+  // Channel subscription of a registered client
+  subscribe chan *subscription
+
+  // Online devices of a user
+  devices chan *devicesRequest
+
+  // Replies to a single client, e.g. errors
+  replies chan *clientReply
+
+  // Liveness check, the router replies whether it is draining
+  check chan chan bool
+
+  // Drain request with the seconds the clients wait before reconnecting
+  drain chan int
+
+  // Refuse new clients after draining, with the shutdown error and the close frame
+  draining       bool
+  closeMsg       []byte
+  reconnectDelay time.Duration
+
+  // Connections whose writer is still running
+  conns sync.WaitGroup
+
+  // Upgraded connections not registered yet, closed when draining
+  connect chan *Client
+  pending map[*Client]bool
+
+  // content hash of the latest clip of each user and channel, the same clip is not broadcast again
+  latest map[string]string
 }
 
 // Message info
@@ -31,6 +69,24 @@ type Message struct {
 
   // message content
   content []byte
+
+  // content hash, see utils.ContentHash
+  hash string
+
+  // type name of the clip, empty if unknown, see utils.ClipTypeOf
+  clipType string
+
+  // channel of the clip, the clipboard of the user if empty
+  channel string
+
+  // client ID of a direct push, the result is replied to the sending client and the
+  // delivered channel if set
+  target    string
+  sender    *Client
+  delivered chan bool
+
+  // when the message is sent to the router
+  created time.Time
 }
 
 // NewRouter return router instance
@@ -39,7 +95,132 @@ func NewRouter() *Router {
     broadcast:  make(chan *Message),
     unregister: make(chan *Client),
     register:   make(chan *Client),
+    subscribe:  make(chan *subscription),
+    devices:    make(chan *devicesRequest),
+    replies:    make(chan *clientReply),
+    check:      make(chan chan bool),
+    drain:      make(chan int),
+    connect:    make(chan *Client),
+    pending:    make(map[*Client]bool),
     clients:    make(map[string]*list.List),
+    latest:     make(map[string]string),
+  }
+}
+
+// Status check the router loop is alive, return whether it is draining
+func (r *Router) Status(ctx context.Context) (bool, error) {
+  reply := make(chan bool, 1)
+
+  select {
+  case r.check <- reply:
+  case <-ctx.Done():
+    return false, ctx.Err()
+  }
+
+  select {
+  case draining := <-reply:
+    return draining, nil
+  case <-ctx.Done():
+    return false, ctx.Err()
+  }
+}
+
+// Drain close all the clients with a shutdown error and a going away frame telling them
+// when to reconnect, and wait until the frames are written or the context is done
+func (r *Router) Drain(ctx context.Context, reconnectDelay int) error {
+  select {
+  case r.drain <- reconnectDelay:
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+
+  done := make(chan struct{})
+  go func() {
+    r.conns.Wait()
+    close(done)
+  }()
+
+  select {
+  case <-done:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+// latestKey key of the latest clip of the user or the channel
+func (m *Message) latestKey() string {
+  if m.channel != "" {
+    return "#" + m.channel
+  }
+
+  return m.username
+}
+
+// receives return whether the client receives the message, the sender excluded
+func (m *Message) receives(c *Client) bool {
+  if !c.auto || !c.accepts(m.clipType) || !utils.ScopeAllows(c.scope, utils.ScopeRead) {
+    return false
+  }
+
+  if m.channel != "" {
+    return c.channels[m.channel] && !(c.username == m.username && c.id == m.id)
+  }
+
+  return c.username == m.username && c.id != m.id
+}
+
+// Push send the message to its target client only, return whether it is delivered
+func (r *Router) Push(message *Message) bool {
+  message.delivered = make(chan bool, 1)
+  r.broadcast <- message
+
+  return <-message.delivered
+}
+
+// push deliver a direct push to the online client of the user, whatever its mode
+func (r *Router) push(message *Message) {
+  delivered := false
+  if tmpList, ok := r.clients[message.username]; ok {
+    for i := tmpList.Front(); i != nil; i = i.Next() {
+      tmp := i.Value.(*Client)
+      if tmp.id != message.target || !tmp.accepts(message.clipType) || !utils.ScopeAllows(tmp.scope, utils.ScopeRead) {
+        continue
+      }
+
+      tmp.send <- (&utils.WebsocketMessage{
+        Action: utils.ActionClipboardChanged,
+        UserID: message.id,
+        Data:   message.content,
+        Hash:   message.hash,
+        Target: message.target,
+      }).Encode()
+      delivered = true
+      break
+    }
+  }
+
+  if message.delivered != nil {
+    message.delivered <- delivered
+  }
+
+  if sender := message.sender; sender != nil && !sender.closed {
+    data, _ := json.Marshal(&utils.PushResult{Target: message.target, Delivered: delivered})
+    sender.send <- (&utils.WebsocketMessage{
+      Action: utils.ActionPushResult,
+      UserID: sender.id,
+      Data:   data,
+    }).Encode()
+  }
+
+  metricPushes.WithLabelValues(strconv.FormatBool(delivered)).Inc()
+}
+
+// closeClient close the send buffer once, the writer then sends the close frame
+func closeClient(client *Client) {
+  if !client.closed {
+    client.closed = true
+    close(client.send)
   }
 }
 
@@ -47,8 +228,36 @@ func NewRouter() *Router {
 func (r *Router) run() {
   for {
     select {
+    // upgraded connection, refused after draining
+    case client := <-r.connect:
+      if r.draining {
+        client.send <- errorMessage(client.id, utils.ErrServerShutdown, r.reconnectDelay)
+        client.closeMsg = r.closeMsg
+        closeClient(client)
+        continue
+      }
+
+      r.pending[client] = true
     // register client
     case client := <-r.register:
+      delete(r.pending, client)
+
+      // closed by the drain before the handshake
+      if client.closed {
+        continue
+      }
+
+      if r.draining {
+        client.send <- errorMessage(client.id, utils.ErrServerShutdown, r.reconnectDelay)
+        client.closeMsg = r.closeMsg
+        closeClient(client)
+        continue
+      }
+
+      if client.ready != nil {
+        client.send <- client.ready
+      }
+
       if tmpList, ok := r.clients[client.username]; ok {
         tmpList.PushBack(client)
       } else {
@@ -56,37 +265,131 @@ func (r *Router) run() {
         tmpList.PushBack(client)
         r.clients[client.username] = tmpList
       }
+
+      metricClients.WithLabelValues(clientMode(client)).Inc()
+      metricRegistrations.Inc()
+
+      r.notifyPresence(client, utils.PresenceJoin)
     // unregister client
     case client := <-r.unregister:
+      delete(r.pending, client)
+
       if tmpList, ok := r.clients[client.username]; ok {
         for i := tmpList.Front(); i != nil; i = i.Next() {
-          if tmp := i.Value.(*Client); tmp.id == client.id {
+          if tmp := i.Value.(*Client); tmp == client {
             tmpList.Remove(i)
-
-            // close client send buffer
-            close(tmp.send)
+            metricClients.WithLabelValues(clientMode(client)).Dec()
+            r.notifyPresence(client, utils.PresenceLeave)
             break
           }
         }
       }
+
+      // close client send buffer, also for the clients never registered
+      closeClient(client)
+    // replace the channels of the client and reply the subscribed ones
+    case sub := <-r.subscribe:
+      if sub.client.closed {
+        continue
+      }
+
+      sub.client.channels = sub.channels
+
+      names := make([]string, 0, len(sub.channels))
+      for name := range sub.channels {
+        names = append(names, name)
+      }
+      sort.Strings(names)
+      data, _ := json.Marshal(names)
+
+      sub.client.send <- (&utils.WebsocketMessage{
+        Action: utils.ActionSubscribe,
+        UserID: sub.client.id,
+        Data:   data,
+      }).Encode()
+    // online devices of the user
+    case req := <-r.devices:
+      req.reply <- r.userDevices(req.username)
+    // reply to a single client
+    case rep := <-r.replies:
+      if !rep.client.closed {
+        rep.client.send <- rep.data
+      }
+    // liveness check
+    case reply := <-r.check:
+      reply <- r.draining
+    // close all clients
+    case reconnectDelay := <-r.drain:
+      r.draining = true
+      r.closeMsg = websocket.FormatCloseMessage(websocket.CloseGoingAway, utils.GoingAwayReason(reconnectDelay))
+      r.reconnectDelay = time.Duration(reconnectDelay) * time.Second
+
+      for _, tmpList := range r.clients {
+        for i := tmpList.Front(); i != nil; i = i.Next() {
+          tmp := i.Value.(*Client)
+          tmp.send <- errorMessage(tmp.id, utils.ErrServerShutdown, r.reconnectDelay)
+          tmp.closeMsg = r.closeMsg
+          closeClient(tmp)
+          metricClients.WithLabelValues(clientMode(tmp)).Dec()
+        }
+      }
+      r.clients = make(map[string]*list.List)
+
+      for tmp := range r.pending {
+        tmp.send <- errorMessage(tmp.id, utils.ErrServerShutdown, r.reconnectDelay)
+        tmp.closeMsg = r.closeMsg
+        closeClient(tmp)
+      }
+      r.pending = make(map[*Client]bool)
     // broadcast client message
     case message := <-r.broadcast:
-      if tmpList, ok := r.clients[message.username]; ok {
+      if message.target != "" {
+        r.push(message)
+        continue
+      }
+
+      // an echo of the latest clip, e.g. a device writing a received clip to its clipboard
+      if message.hash != "" && r.latest[message.latestKey()] == message.hash {
+        metricDuplicates.Inc()
+        continue
+      }
+      r.latest[message.latestKey()] = message.hash
+
+      // the clients of the user, or the subscribers of the channel from any user
+      lists := []*list.List{r.clients[message.username]}
+      if message.channel != "" {
+        lists = lists[:0]
+        for _, tmpList := range r.clients {
+          lists = append(lists, tmpList)
+        }
+      }
+
+      wsm := &utils.WebsocketMessage{
+        Action:  utils.ActionClipboardChanged,
+        UserID:  message.id,
+        Data:    message.content,
+        Hash:    message.hash,
+        Channel: message.channel,
+      }
+      b := wsm.Encode()
+
+      fanout := 0
+      for _, tmpList := range lists {
+        if tmpList == nil {
+          continue
+        }
+
         for i := tmpList.Front(); i != nil; i = i.Next() {
-          if tmp := i.Value.(*Client); message.id == tmp.id || !tmp.auto {
-            continue
-          } else {
+          if tmp := i.Value.(*Client); message.receives(tmp) {
             // add content to other client send buffer
-            wsm := &utils.WebsocketMessage{
-              Action: utils.ActionClipboardChanged,
-              UserID: message.id,
-              Data:   message.content,
-            }
-
-            tmp.send <- wsm.Encode()
+            tmp.send <- b
+            fanout++
           }
         }
       }
+
+      metricFanout.Observe(float64(fanout))
+      metricBroadcastLatency.Observe(time.Since(message.created).Seconds())
     }
   }
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+// nextMessage return the next message queued to the client, the presence events are skipped
+func nextMessage(t *testing.T, c *Client) *utils.WebsocketMessage {
+  t.Helper()
+
+  for {
+    select {
+    case b := <-c.send:
+      wsm := &utils.WebsocketMessage{}
+      if wsm.Decode(b); wsm.Action != utils.ActionPresence {
+        return wsm
+      }
+    case <-time.After(time.Second):
+      t.Fatal("No message queued to client:", c.id)
+    }
+  }
+}
+
+func TestBroadcastDedupe(t *testing.T) {
+  router := NewRouter()
+  go router.run()
+
+  newClient := func(id string) *Client {
+    c := &Client{router: router, send: make(chan []byte, 4), id: id, username: "u1", auto: true, scope: utils.ScopeReadWrite}
+    router.register <- c
+    return c
+  }
+  c1, c2 := newClient("c1"), newClient("c2")
+
+  push := func(from *Client, data string) {
+    router.broadcast <- &Message{id: from.id, username: "u1", content: []byte(data), hash: utils.ContentHash([]byte(data)), created: time.Now()}
+  }
+
+  push(c1, "hello")
+  if wsm := nextMessage(t, c2); wsm.Hash != utils.ContentHash([]byte("hello")) {
+    t.Fatal("Broadcast should carry the content hash:", wsm.Hash)
+  }
+
+  // c2 writes the clip to its clipboard and sends it back
+  push(c2, "hello")
+  push(c2, "world")
+
+  if wsm := nextMessage(t, c1); string(wsm.Data) != "world" {
+    t.Fatal("Echo of the latest clip should not be broadcast:", string(wsm.Data))
+  }
+}
+
+func TestPresence(t *testing.T) {
+  handler := setupTestServer(t)
+
+  router := NewRouter()
+  go router.run()
+
+  newClient := func(id string, auto bool) *Client {
+    c := &Client{router: router, send: make(chan []byte, 4), id: id, username: "u1", auto: auto, remoteIP: "10.0.0.1", connected: time.Now(), version: "1.2.0"}
+    router.register <- c
+    return c
+  }
+
+  laptop := newClient("laptop", true)
+  room := newClient("room", false)
+
+  wsm := <-laptop.send
+  event := &utils.WebsocketMessage{}
+  if event.Decode(wsm); event.Action != utils.ActionPresence || !strings.Contains(string(event.Data), `"event":"join"`) {
+    t.Fatal("Other device should be told about the join:", string(event.Data))
+  }
+
+  devices := router.Devices("u1")
+  if len(devices) != 2 || devices[0].ClientID != "laptop" || devices[1].Mode != "manual" || devices[1].Version != "1.2.0" {
+    t.Fatal("Online devices should be listed:", devices)
+  }
+
+  router.unregister <- room
+  if event.Decode(<-laptop.send); !strings.Contains(string(event.Data), `"event":"leave"`) {
+    t.Fatal("Other device should be told about the leave:", string(event.Data))
+  }
+
+  if devices := router.Devices("u2"); devices == nil || len(devices) != 0 {
+    t.Fatal("User without device should get an empty list:", devices)
+  }
+
+  // the API lists the devices of the router of the handler, none here
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+  req := httptest.NewRequest("GET", "/clipboard/devices", nil)
+  req.SetBasicAuth("u1", "pass")
+
+  w := httptest.NewRecorder()
+  handler.ServeHTTP(w, req)
+  if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"data":[]`) {
+    t.Fatal("Devices API should answer the online devices:", w.Code, w.Body.String())
+  }
+}
@@ -6,6 +6,7 @@ import (
   "context"
   "flag"
   "io/fs"
+  "net"
   "net/http"
   "os"
   "os/signal"
@@ -16,8 +17,6 @@ import (
 
   "github.com/gorilla/mux"
   "github.com/gorilla/websocket"
-  "github.com/grandcat/zeroconf"
-  "github.com/michaeljs1990/sqlitestore"
   "github.com/robfig/cron/v3"
   log "github.com/sirupsen/logrus"
 )
@@ -25,6 +24,7 @@ import (
 var (
   configDir  = flag.String("d", "", "server config directory")
   configFile = flag.String("f", "", "server config file")
+  issueCert  = flag.String("issue-client-cert", "", "issue a client certificate for user or user/device by the generated CA and exit")
 
   upgrader = websocket.Upgrader{
     ReadBufferSize:    4096,
@@ -39,7 +39,22 @@ var (
   GlobalConfig *utils.ServerConfig
 
   // session store for sqlite
-  SessionStore *sqlitestore.SqliteStore
+  SessionStore *SqliteSessionStore
+
+  // OpenID Connect relying party, nil if single sign-on is not configured
+  OIDC *OIDCAuth
+
+  // user credentials verifier selected by auth-backend
+  Authenticator AuthBackend
+
+  // brute-force protection of the authentication entry points
+  Limiter *AuthLimiter
+
+  // size, quota and rate limits of the clips
+  ClipLimits *ClipLimiter
+
+  // TLS certificate of the server, reloaded on change
+  Certificates *CertReloader
 )
 
 type DisplayInfo struct {
@@ -47,46 +62,65 @@ type DisplayInfo struct {
   Timestamp string
   UserName  string
   Content   string
+  Online    bool
 }
 
 func init() {
-  // Set the report callers to true
-  log.SetReportCaller(true)
-  // Set the formatter to include the function name and line number
-  log.SetFormatter(&utils.Formatter{
-    HideKeys:    true,
-    CallerFirst: true,
-    NoColors:    true,
-  })
-
-  // Set the output to the standard output
-  log.SetOutput(os.Stdout)
-
-  // Set the log level
-  log.SetLevel(log.InfoLevel)
+  // text log of info level to stdout until the config is loaded
+  utils.SetupLog(&utils.LogConfig{}, "server")
 }
 
 func InitHttpRouter(sockRouter *Router) *mux.Router {
   clipHandler := NewClipHandler(sockRouter)
 
   muxRouter := mux.NewRouter()
+  muxRouter.Use(RequestIDMDW)
+  muxRouter.Use(MetricsMDW)
+
+  // Health checks for the load balancer and the orchestrator
+  muxRouter.HandleFunc("/healthz", clipHandler.HealthzHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/readyz", clipHandler.ReadyzHandlerFunc).Methods("GET")
+
+  // Certificate fingerprints and the generated CA for the clients
+  muxRouter.HandleFunc("/certificate", clipHandler.CertificateHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/certificate/ca.crt", clipHandler.CACertHandlerFunc).Methods("GET")
 
   // Handle websocket
   muxRouter.HandleFunc(GlobalConfig.WebsocketPath, clipHandler.WsHandlerFunc)
 
   // Handle restful
   restRouter := muxRouter.PathPrefix("/clipboard").Subrouter()
-  restRouter.HandleFunc("/get", clipHandler.RestGetClipHandlerFunc)
-  restRouter.HandleFunc("/set", clipHandler.RestSetClipHandlerFunc)
+  restRouter.HandleFunc("/get", RequireScope(utils.ScopeRead, clipHandler.RestGetClipHandlerFunc))
+  restRouter.HandleFunc("/set", RequireScope(utils.ScopeWrite, clipHandler.RestSetClipHandlerFunc))
+  restRouter.HandleFunc("/push", RequireScope(utils.ScopeWrite, clipHandler.RestPushClipHandlerFunc)).Methods("POST")
+  restRouter.HandleFunc("/devices", RequireScope(utils.ScopeRead, clipHandler.DevicesHandlerFunc)).Methods("GET")
   restRouter.Use(UserBasicAuthMDW)
 
+  // Handle administrator restful
+  adminRouter := muxRouter.PathPrefix("/admin").Subrouter()
+  adminRouter.HandleFunc("/users/{user}/2fa", RequireScope(utils.ScopeReadWrite, clipHandler.AdminTwoFactorHandlerFunc)).Methods("PUT")
+  adminRouter.HandleFunc("/audit", RequireScope(utils.ScopeRead, clipHandler.AdminAuditHandlerFunc)).Methods("GET")
+  adminRouter.HandleFunc("/audit/export", RequireScope(utils.ScopeRead, clipHandler.AdminAuditExportHandlerFunc)).Methods("GET")
+  adminRouter.Use(UserBasicAuthMDW, AdminMDW)
+
   // Handle static resource
-  muxRouter.HandleFunc("/login", clipHandler.DoLoginHandlerFunc).Methods("POST")
+  muxRouter.HandleFunc("/login", CSRFMDW(clipHandler.DoLoginHandlerFunc)).Methods("POST")
   muxRouter.HandleFunc("/login", clipHandler.LoginHtmlHandlerFunc).Methods("GET")
-  muxRouter.HandleFunc("/register", clipHandler.DoRegisterHandlerFunc).Methods("POST")
+  muxRouter.HandleFunc("/login/oidc", clipHandler.LoginOIDCHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/login/oidc/callback", clipHandler.OIDCCallbackHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/login/2fa", CSRFMDW(clipHandler.DoTwoFactorHandlerFunc)).Methods("POST")
+  muxRouter.HandleFunc("/login/2fa", clipHandler.TwoFactorHtmlHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/2fa/setup", CSRFMDW(clipHandler.DoTotpSetupHandlerFunc)).Methods("POST")
+  muxRouter.HandleFunc("/2fa/setup", clipHandler.TotpSetupHtmlHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/2fa/disable", CSRFMDW(clipHandler.DoTotpDisableHandlerFunc)).Methods("POST")
+  muxRouter.HandleFunc("/register", CSRFMDW(clipHandler.DoRegisterHandlerFunc)).Methods("POST")
   muxRouter.HandleFunc("/register", clipHandler.RegisterHtmlHandlerFunc).Methods("GET")
-  muxRouter.HandleFunc("/logout", clipHandler.DoLogoutHandlerFunc)
+  muxRouter.HandleFunc("/tokens", CSRFMDW(clipHandler.DoCreateTokenHandlerFunc)).Methods("POST")
+  muxRouter.HandleFunc("/tokens", clipHandler.TokensHtmlHandlerFunc).Methods("GET")
+  muxRouter.HandleFunc("/tokens/revoke", CSRFMDW(clipHandler.DoRevokeTokenHandlerFunc)).Methods("POST")
+  muxRouter.HandleFunc("/logout", CSRFMDW(clipHandler.DoLogoutHandlerFunc)).Methods("POST")
   muxRouter.HandleFunc("/reflesh", clipHandler.DoReflashHandlerFunc)
+  muxRouter.HandleFunc("/push", CSRFMDW(clipHandler.DoPushHandlerFunc)).Methods("POST")
 
   staticFs, _ := fs.Sub(static.StaticFiles, "static")
   muxRouter.PathPrefix("/css").Handler(http.FileServer(http.FS(staticFs)))
@@ -109,6 +143,17 @@ func main() {
     }
   }
 
+  // Issue a client certificate by the generated CA, then exit
+  if *issueCert != "" {
+    certFile, err := issueClientCert(path.Join(tmpHomeDir, "certificate"), *issueCert)
+    if err != nil {
+      log.Errorln("Failed to issue client certificate:", err)
+      return
+    }
+    log.Infoln("Issued client certificate:", certFile)
+    return
+  }
+
   tmpConfigFile := *configFile
   if tmpConfigFile != "" {
     if !filepath.IsAbs(tmpConfigFile) {
@@ -127,61 +172,55 @@ func main() {
 
   GlobalConfig = tmpConfig
 
-  // Set the log level from config file
-  switch GlobalConfig.Log.LogLevel {
-  case "debug":
-    log.SetLevel(log.DebugLevel)
-  case "info":
-    log.SetLevel(log.InfoLevel)
-  case "warn":
-    log.SetLevel(log.WarnLevel)
-  case "error":
-    log.SetLevel(log.ErrorLevel)
-  case "fatal":
-    log.SetLevel(log.FatalLevel)
-  }
-
-  // Set the log file
-  if GlobalConfig.Log.LogPath != "" {
-    logfile, err := os.OpenFile(GlobalConfig.Log.LogPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
-    if err != nil {
-      log.Errorf("Failed to open log file(%s), err: %v.", GlobalConfig.Log.LogPath, err)
-      // print the log info to stdout
-    } else {
-      log.SetOutput(logfile)
-    }
-  }
+  // Set the log level, format and file from config file
+  utils.SetupLog(&GlobalConfig.Log, "server")
 
-  // Init sqlite database
-  dbFilePath := path.Join(tmpHomeDir, "server.sqlite3")
-  if utils.Exists(dbFilePath) {
-    DB = utils.InitDB(dbFilePath)
-  } else {
-    DB = utils.InitDB(dbFilePath)
-    err = DB.CreateUserInfoTable()
-    if err != nil {
-      log.Errorln("Failed to create user info table:", err)
-      DB.Close()
-      return
-    }
+  // Init sqlite database, the tables are created if not exist
+  DB = utils.InitDB(path.Join(tmpHomeDir, "server.sqlite3"))
+  err = DB.CreateTables()
+  if err != nil {
+    log.Errorln("Failed to create database tables:", err)
+    DB.Close()
+    return
+  }
+  defer DB.Close()
+  DB.SetObserver(observeDB)
 
-    DB.CreateContentInfoTable()
+  // Generate the session key on first start if not configured
+  if GlobalConfig.Session.Key == "" {
+    GlobalConfig.Session.Key, err = utils.LoadOrCreateKey(path.Join(tmpHomeDir, "session.key"))
     if err != nil {
-      log.Errorln("Failed to create content info table:", err)
-      DB.Close()
+      log.Errorln("Failed to load session key:", err)
       return
     }
   }
-  defer DB.Close()
 
   // Init Session database
-  SessionStore, err = sqlitestore.NewSqliteStore(
-    path.Join(tmpHomeDir, "session.sqlite3"), "sessions", "/", GlobalConfig.Session.MaxAge, []byte(GlobalConfig.Session.Key))
+  SessionStore, err = newSessionStore(path.Join(tmpHomeDir, "session.sqlite3"), &GlobalConfig.Session)
+  if err != nil {
+    log.Errorln("Failed to init session store:", err)
+    return
+  }
+
+  // Init authentication backend
+  Authenticator, err = NewAuthBackend(GlobalConfig)
   if err != nil {
-    log.Errorln("Failed to init session store.")
+    log.Errorln("Failed to init auth backend:", err)
     return
   }
 
+  Limiter = NewAuthLimiter(&GlobalConfig.AuthLimit)
+  ClipLimits = NewClipLimiter(&GlobalConfig.Limits)
+
+  // Init single sign-on
+  if GlobalConfig.OIDC.Issuer != "" {
+    OIDC, err = NewOIDCAuth(context.Background(), &GlobalConfig.OIDC)
+    if err != nil {
+      log.Errorln("Failed to init single sign-on:", err)
+      return
+    }
+  }
+
   err = DB.InsertUserInfo(GlobalConfig.Auths)
   if err != nil {
     log.Errorln("Failed to add user info to database:", err)
@@ -198,44 +237,148 @@ func main() {
       log.Infoln("Succeed to vacuum database.")
     }
   })
+  c.AddFunc("@every 10m", Limiter.Cleanup)
+  c.AddFunc("@every 10m", ClipLimits.Cleanup)
   c.Start()
-  // Register auto find
-  autoFind, err := zeroconf.Register("clipboard", "_cliphttp._tcp", "local.", 443, []string{"txtv=0", "lo=1", "la=2"}, nil)
-  if err != nil {
-    log.Errorln("Failed to register auto find info:", err)
-    return
-  }
-  defer autoFind.Shutdown()
-
   // Create a new router
   router := NewRouter()
   // Run the router
   go router.run()
 
+  if err = checkChannels(GlobalConfig.Channels); err != nil {
+    log.Errorln("Failed to load channels:", err)
+    return
+  }
+
+  // X-Forwarded headers are only trusted from these proxies
+  if err = initTrustedProxies(GlobalConfig.TrustedProxies); err != nil {
+    log.Errorln("Failed to parse trusted proxies:", err)
+    return
+  }
+
   server := http.Server{
     Addr:    GlobalConfig.Address,
     Handler: InitHttpRouter(router),
   }
 
-  quit := make(chan os.Signal, 1)
+  if GlobalConfig.TLSEnabled() {
+    // Load the certificate, generate one signed by a local CA if not configured
+    if GlobalConfig.Certificate.CertFile != "" || GlobalConfig.Certificate.KeyFile != "" {
+      Certificates, err = NewCertReloader(GlobalConfig.Certificate.CertFile, GlobalConfig.Certificate.KeyFile)
+    } else {
+      Certificates, err = generateCert(path.Join(tmpHomeDir, "certificate"), certHosts(GlobalConfig))
+    }
+    if err != nil {
+      log.Errorln("Failed to load certificate:", err)
+      return
+    }
+    log.Infoln("Certificate fingerprint (sha256):", Certificates.Fingerprint())
+
+    watchCtx, stopWatch := context.WithCancel(context.Background())
+    defer stopWatch()
+    if err := Certificates.Watch(watchCtx); err != nil {
+      log.Errorln("Failed to watch certificate:", err)
+    }
+
+    server.TLSConfig, err = serverTLSConfig(&GlobalConfig.ClientAuth, Certificates)
+    if err != nil {
+      log.Errorln("Failed to init client certificate authentication:", err)
+      return
+    }
+  } else if GlobalConfig.ClientAuth.Mode != "none" {
+    log.Errorln("Client certificate authentication needs tls enabled.")
+    return
+  }
+
+  // Register auto find with the real port, path and certificate fingerprint
+  if GlobalConfig.MDNSEnabled() && GlobalConfig.Address != "" {
+    autoFind, err := announce(GlobalConfig)
+    if err != nil {
+      log.Errorln("Failed to register auto find info:", err)
+      return
+    }
+    defer autoFind.Shutdown()
+
+    if Certificates != nil {
+      reannounce(GlobalConfig, Certificates, autoFind)
+    }
+  }
+
+  // Prometheus metrics on a separate address
+  var metricsServer *http.Server
+  if GlobalConfig.MetricsAddr != "" {
+    metricsServer = ServeMetrics(GlobalConfig.MetricsAddr)
+    log.Infoln("Serve metrics on:", GlobalConfig.MetricsAddr)
+  }
+
+  quit := make(chan os.Signal, 2)
+
+  serve := func(listen func() error) {
+    go func() {
+      if err := listen(); err != http.ErrServerClosed {
+        log.Errorln("Start service failed:", err)
+        quit <- syscall.SIGTERM
+      }
+    }()
+  }
+
+  if GlobalConfig.Address != "" {
+    if GlobalConfig.TLSEnabled() {
+      serve(func() error { return server.ListenAndServeTLS("", "") })
+    } else {
+      // TLS is terminated by the reverse proxy
+      serve(server.ListenAndServe)
+    }
+  }
 
-  go func() {
-    err = server.ListenAndServeTLS(GlobalConfig.Certificate.CertFile, GlobalConfig.Certificate.KeyFile)
-    if err != http.ErrServerClosed {
-      log.Errorln("Start service failed:", err)
-      quit <- syscall.SIGTERM
+  // plain http on the unix socket for the local reverse proxy
+  if GlobalConfig.UnixSocket != "" {
+    os.Remove(GlobalConfig.UnixSocket)
+    listener, err := net.Listen("unix", GlobalConfig.UnixSocket)
+    if err != nil {
+      log.Errorln("Failed to listen unix socket:", err)
+      return
     }
-  }()
+    defer os.Remove(GlobalConfig.UnixSocket)
+
+    serve(func() error { return server.Serve(listener) })
+    log.Infoln("Serve on unix socket:", GlobalConfig.UnixSocket)
+  }
 
   log.Infoln("Server start succeed.")
 
-  signal.Notify(quit, os.Interrupt)
+  // reload the certificate on SIGHUP, the websocket connections are kept
+  if Certificates != nil {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+      for range hup {
+        if err := Certificates.Reload(); err != nil {
+          log.Errorln("Failed to reload certificate:", err)
+        } else {
+          log.Infoln("Certificate reloaded, fingerprint:", Certificates.Fingerprint())
+        }
+      }
+    }()
+  }
+
+  signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
   <-quit
   log.Infoln("Waiting for shutdown finishing...")
-  ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+  ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GlobalConfig.Shutdown.Timeout)*time.Second)
   defer cancel()
+  if metricsServer != nil {
+    metricsServer.Shutdown(ctx)
+  }
+
+  // stop accepting new connections, the hijacked websockets are not covered
   if err := server.Shutdown(ctx); err != nil {
-    log.Fatalf("Shutdown server err: %v.", err)
+    log.Errorln("Failed to shutdown server:", err)
+  }
+
+  // tell the websocket clients when to come back
+  if err := router.Drain(ctx, GlobalConfig.Shutdown.ReconnectDelay); err != nil {
+    log.Errorln("Failed to drain websocket clients:", err)
   }
   log.Infoln("Server shutdown succeed.")
 }
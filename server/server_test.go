@@ -0,0 +1,158 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+)
+
+// setupTestServer init the global database, session store and config in a temp directory
+func setupTestServer(t *testing.T) http.Handler {
+  dir := t.TempDir()
+
+  GlobalConfig = &utils.ServerConfig{
+    WebsocketPath: "/websocket",
+    MaxMsgSize:    1024 * 1024,
+    Session:       utils.SessionConfig{Key: "test-session-key", MaxAge: 3600},
+    AuthLimit:     utils.AuthLimitConfig{MaxAttempts: 5, Window: 300, Lockout: 60, MaxLockout: 3600},
+  }
+
+  Authenticator = localBackend{}
+  Limiter = NewAuthLimiter(&GlobalConfig.AuthLimit)
+  ClipLimits = NewClipLimiter(&GlobalConfig.Limits)
+
+  DB = utils.InitDB(filepath.Join(dir, "server.sqlite3"))
+  if err := DB.CreateTables(); err != nil {
+    t.Fatal("Failed to create tables:", err)
+  }
+  t.Cleanup(DB.Close)
+
+  store, err := newSessionStore(filepath.Join(dir, "session.sqlite3"), &GlobalConfig.Session)
+  if err != nil {
+    t.Fatal("Failed to init session store:", err)
+  }
+  SessionStore = store
+  t.Cleanup(store.Close)
+
+  router := NewRouter()
+  go router.run()
+
+  return InitHttpRouter(router)
+}
+
+// disconnect close the websocket of the client and wait for its termination to be recorded,
+// so the server no longer writes the database of the test when it is cleaned up
+func disconnect(t *testing.T, conn *websocket.Conn, clientID string) {
+  conn.Close()
+  for i := 0; i < 100; i++ {
+    if audits, _ := DB.GetAudits(&utils.AuditFilter{Event: AuditDeviceTerminate, ClientID: clientID}); len(audits) > 0 {
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  t.Fatal("Disconnection should be recorded:", clientID)
+}
+
+// dialWs open a websocket connection to the test server, offering compression
+func dialWs(t *testing.T, server *httptest.Server) *websocket.Conn {
+  t.Helper()
+
+  dialer := websocket.Dialer{EnableCompression: true}
+  conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/websocket", nil)
+  if err != nil {
+    t.Fatal("Failed to dial websocket:", err)
+  }
+
+  return conn
+}
+
+// sendWs send the action of the client
+func sendWs(conn *websocket.Conn, action utils.WebsocketAction, id string, data []byte) {
+  msg := &utils.WebsocketMessage{Action: action, UserID: id, Data: data}
+  conn.WriteMessage(websocket.BinaryMessage, msg.Encode())
+}
+
+// registerWs dial the test server and send the handshake of the client, return the reply
+func registerWs(t *testing.T, server *httptest.Server, id string, handshake string) (*websocket.Conn, *utils.WebsocketMessage) {
+  t.Helper()
+
+  conn := dialWs(t, server)
+  sendWs(conn, utils.ActionHandshakeRegister, id, []byte(handshake))
+
+  return conn, readWs(t, conn)
+}
+
+// readWs read the next message of the connection, the presence events are skipped
+func readWs(t *testing.T, conn *websocket.Conn) *utils.WebsocketMessage {
+  t.Helper()
+
+  for {
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    _, b, err := conn.ReadMessage()
+    wsm := &utils.WebsocketMessage{}
+    if err != nil || wsm.Decode(b) != nil {
+      t.Fatal("Failed to read message:", err)
+    }
+
+    if wsm.Action != utils.ActionPresence {
+      return wsm
+    }
+  }
+}
+
+// csrfPattern hidden CSRF field of the html pages
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// testBrowser keeps cookies between requests to the handler, and posts the CSRF token of the last page
+type testBrowser struct {
+  handler http.Handler
+  cookies map[string]*http.Cookie
+  csrf    string
+}
+
+func newTestBrowser(handler http.Handler) *testBrowser {
+  return &testBrowser{handler: handler, cookies: map[string]*http.Cookie{}}
+}
+
+func (b *testBrowser) do(method string, target string, form url.Values) *httptest.ResponseRecorder {
+  var req *http.Request
+  if form != nil {
+    if _, ok := form[csrfFormField]; !ok && b.csrf != "" {
+      form.Set(csrfFormField, b.csrf)
+    }
+    req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  } else {
+    req = httptest.NewRequest(method, target, nil)
+  }
+
+  for _, c := range b.cookies {
+    req.AddCookie(c)
+  }
+
+  w := httptest.NewRecorder()
+  b.handler.ServeHTTP(w, req)
+
+  for _, c := range w.Result().Cookies() {
+    if c.MaxAge < 0 {
+      delete(b.cookies, c.Name)
+    } else {
+      b.cookies[c.Name] = c
+    }
+  }
+
+  if m := csrfPattern.FindStringSubmatch(w.Body.String()); m != nil {
+    b.csrf = m[1]
+  }
+
+  return w
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "crypto/subtle"
+  "database/sql"
+  "net/http"
+  "strings"
+
+  "github.com/gorilla/sessions"
+  "github.com/michaeljs1990/sqlitestore"
+  log "github.com/sirupsen/logrus"
+)
+
+const cookieCSRFToken string = "csrf-token"
+
+// csrfFormField hidden form field carrying the CSRF token
+const csrfFormField = "csrf_token"
+
+// csrfHeader header carrying the CSRF token for scripts
+const csrfHeader = "X-CSRF-Token"
+
+// SqliteSessionStore sqlite session store which can count its sessions
+type SqliteSessionStore struct {
+  *sqlitestore.SqliteStore
+
+  db *sql.DB
+}
+
+// Count return the rows of the session table
+func (s *SqliteSessionStore) Count() (int, error) {
+  var n int
+  err := s.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n)
+  return n, err
+}
+
+// newSessionStore open the sqlite session store. The table is created with AUTOINCREMENT
+// before the store does it, otherwise the ID of a deleted session is reused by the next
+// one and the old cookie would be valid again.
+func newSessionStore(file string, config *utils.SessionConfig) (*SqliteSessionStore, error) {
+  db, err := sql.Open("sqlite3", file)
+  if err != nil {
+    return nil, err
+  }
+
+  // drop the table of older versions, the sessions are only logged out
+  var schema string
+  db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'sessions'").Scan(&schema)
+  if schema != "" && !strings.Contains(schema, "AUTOINCREMENT") {
+    log.Warnln("Recreate the session table, all the users need to login again.")
+    if _, err = db.Exec("DROP TABLE sessions"); err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+
+  _, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_data LONGBLOB,
+    created_on TIMESTAMP DEFAULT 0,
+    modified_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_on TIMESTAMP DEFAULT 0
+  )`)
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
+
+  store, err := sqlitestore.NewSqliteStoreFromConnection(db, "sessions", "/", config.MaxAge, []byte(config.Key))
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
+
+  return &SqliteSessionStore{SqliteStore: store, db: db}, nil
+}
+
+// getSession return the web session, the store only keeps path and max age so the
+// cookie attributes are set here, the cookie is only secure over https
+func getSession(r *http.Request) *sessions.Session {
+  session, _ := SessionStore.Get(r, cookieSessionName)
+
+  session.Options.HttpOnly = true
+  session.Options.Secure = requestSecure(r)
+  session.Options.SameSite = http.SameSiteLaxMode
+
+  return session
+}
+
+// rotateSession move the session values to a new session ID, so an ID planted before
+// login is useless afterwards. The CSRF token is renewed as well.
+func rotateSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
+  session := getSession(r)
+  if session.IsNew {
+    delete(session.Values, cookieCSRFToken)
+    return session
+  }
+
+  values := make(map[interface{}]interface{}, len(session.Values))
+  for k, v := range session.Values {
+    if k != cookieCSRFToken {
+      values[k] = v
+    }
+  }
+
+  // delete the old session, the cookie is replaced by the next save
+  if err := SessionStore.Delete(r, w, session); err != nil {
+    reqLog(r).Errorln("Failed to delete old session:", err)
+  }
+
+  session.ID = ""
+  session.IsNew = true
+  session.Values = values
+
+  return session
+}
+
+// saveSession save the session, a new session is only inserted once per request
+func saveSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+  if err := SessionStore.Save(r, w, session); err != nil {
+    reqLog(r).Errorln("Failed to save session:", err)
+    return
+  }
+
+  session.IsNew = false
+}
+
+// CSRFToken return the CSRF token of the session, it is created on first use so it
+// must be called before writing the response body
+func CSRFToken(w http.ResponseWriter, r *http.Request) string {
+  session := getSession(r)
+
+  token, ok := session.Values[cookieCSRFToken].(string)
+  if !ok {
+    token = utils.RandomString(32)
+    session.Values[cookieCSRFToken] = token
+
+    saveSession(w, r, session)
+  }
+
+  return token
+}
+
+// CSRFMDW reject the form posts without the CSRF token of the session
+func CSRFMDW(next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    expected, _ := getSession(r).Values[cookieCSRFToken].(string)
+
+    token := r.Header.Get(csrfHeader)
+    if token == "" {
+      token = r.PostFormValue(csrfFormField)
+    }
+
+    if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+      reqLog(r).Errorf("Invalid CSRF token of %s %s from %s.", r.Method, r.URL.Path, clientIP(r))
+      http.Error(w, "Invalid CSRF Token.", http.StatusForbidden)
+      return
+    }
+
+    next(w, r)
+  }
+}
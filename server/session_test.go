@@ -0,0 +1,64 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/url"
+  "testing"
+)
+
+func TestCSRFAndSessionRotation(t *testing.T) {
+  handler := setupTestServer(t)
+
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  browser := newTestBrowser(handler)
+  login := url.Values{"username": {"u1"}, "password": {"pass"}}
+
+  if w := browser.do("POST", "/login", login); w.Code != http.StatusForbidden {
+    t.Fatal("Login without CSRF token should be rejected:", w.Code)
+  }
+
+  browser.do("GET", "/login", nil)
+  before := browser.cookies[cookieSessionName]
+  if before == nil || !before.HttpOnly || !before.Secure || before.SameSite != http.SameSiteLaxMode {
+    t.Fatal("Session cookie attributes not set:", before)
+  }
+
+  forged := url.Values{"username": {"u1"}, "password": {"pass"}, csrfFormField: {"forged"}}
+  if w := browser.do("POST", "/login", forged); w.Code != http.StatusForbidden {
+    t.Fatal("Login with forged CSRF token should be rejected:", w.Code)
+  }
+
+  if w := browser.do("POST", "/login", login); w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Login with CSRF token failed:", w.Code, w.Header().Get("Location"))
+  }
+
+  after := browser.cookies[cookieSessionName]
+  if after == nil || after.Value == before.Value {
+    t.Fatal("Session ID should be rotated on login.")
+  }
+
+  // the session ID from before the login is useless
+  planted := newTestBrowser(handler)
+  planted.cookies[cookieSessionName] = before
+  if w := planted.do("GET", "/content", nil); w.Code != http.StatusFound {
+    t.Fatal("Old session should not be logged in:", w.Code)
+  }
+
+  if w := browser.do("GET", "/content", nil); w.Code != http.StatusOK {
+    t.Fatal("Logged in user should see the content:", w.Code)
+  }
+
+  if w := browser.do("GET", "/logout", nil); w.Code != http.StatusMethodNotAllowed {
+    t.Fatal("Logout should be POST only:", w.Code)
+  }
+
+  if w := browser.do("POST", "/logout", url.Values{}); w.Code != http.StatusFound {
+    t.Fatal("Logout failed:", w.Code)
+  }
+
+  if w := browser.do("GET", "/content", nil); w.Code != http.StatusFound {
+    t.Fatal("User should be logged out:", w.Code)
+  }
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// TokenPageInfo template data for the personal API token page
+type TokenPageInfo struct {
+  Message  string
+  NewToken string
+  Tokens   []TokenDisplayInfo
+  CSRF     string
+}
+
+// TokenDisplayInfo token info shown in the token page
+type TokenDisplayInfo struct {
+  ID       int64
+  Name     string
+  Scope    string
+  Created  string
+  Expires  string
+  LastUsed string
+  Expired  bool
+}
+
+// bearerToken return the token of the bearer authorization header
+func bearerToken(r *http.Request) string {
+  auth := r.Header.Get("Authorization")
+  if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+    return ""
+  }
+
+  return strings.TrimSpace(auth[7:])
+}
+
+// authToken find the valid token of the secret
+func authToken(secret string) (*utils.APITokenInfo, error) {
+  if !strings.HasPrefix(secret, utils.APITokenPrefix) {
+    return nil, utils.ErrAuthFailed
+  }
+
+  token := DB.GetAPIToken(secret)
+  if token == nil || token.Expired() {
+    return nil, utils.ErrAuthFailed
+  }
+
+  return token, nil
+}
+
+// RequestScope return the scope granted by UserBasicAuthMDW
+func RequestScope(r *http.Request) string {
+  if scope, ok := r.Context().Value(contextScope).(string); ok {
+    return scope
+  }
+
+  return utils.ScopeReadWrite
+}
+
+// RequireScope reject requests whose token does not cover the scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    granted := RequestScope(r)
+    if !utils.ScopeAllows(granted, scope) {
+      reqLog(r).Errorf("Token scope(%s) of user(%s) does not allow %s.", granted, RequestUser(r), scope)
+
+      rest := RestfulRespInfo{
+        Writer: w,
+        Response: utils.RespInfo{
+          Code:    http.StatusForbidden,
+          Message: "Permission Denied.",
+        },
+      }
+
+      rest.send()
+      return
+    }
+
+    next(w, r)
+  }
+}
+
+func (clip *ClipHandler) renderTokens(w http.ResponseWriter, r *http.Request, user string, page TokenPageInfo) {
+  page.CSRF = CSRFToken(w, r)
+
+  for _, token := range DB.GetAPITokens(user) {
+    expires := "never"
+    if token.Expires != 0 {
+      expires = time.Unix(token.Expires, 0).Format("2006-01-02 15:04:05")
+    }
+
+    page.Tokens = append(page.Tokens, TokenDisplayInfo{
+      ID:       token.ID,
+      Name:     token.Name,
+      Scope:    token.Scope,
+      Created:  token.Created,
+      Expires:  expires,
+      LastUsed: token.LastUsed,
+      Expired:  token.Expired(),
+    })
+  }
+
+  clip.htmlTemplate.ExecuteTemplate(w, "tokens.html", page)
+}
+
+// TokensHtmlHandlerFunc handler for the personal API token page
+func (clip *ClipHandler) TokensHtmlHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetSessionUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  clip.renderTokens(w, r, user, TokenPageInfo{})
+}
+
+// DoCreateTokenHandlerFunc handler for creating a personal API token, the token is shown only once
+func (clip *ClipHandler) DoCreateTokenHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetSessionUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  r.ParseForm()
+
+  name := strings.TrimSpace(r.FormValue("name"))
+  scope := r.FormValue("scope")
+  days, _ := strconv.Atoi(r.FormValue("expires"))
+
+  if name == "" || (scope != utils.ScopeRead && scope != utils.ScopeWrite && scope != utils.ScopeReadWrite) || days < 0 {
+    clip.renderTokens(w, r, user, TokenPageInfo{Message: "名称或者权限无效！"})
+    return
+  }
+
+  token := &utils.APITokenInfo{
+    Username: user,
+    Name:     name,
+    Scope:    scope,
+  }
+  if days > 0 {
+    token.Expires = time.Now().AddDate(0, 0, days).Unix()
+  }
+
+  secret := utils.APITokenPrefix + utils.RandomString(32)
+  _, err := DB.InsertAPIToken(token, secret)
+  if err != nil {
+    reqLog(r).Errorf("Failed to create token(%s) for user(%s), error: %v.", name, user, err)
+    clip.renderTokens(w, r, user, TokenPageInfo{Message: "创建失败，名称可能已经存在！"})
+    return
+  }
+
+  reqLog(r).Infof("Token(%s) created for user(%s).", name, user)
+  auditRequest(r, AuditTokenCreate, user, true, name+", "+scope)
+
+  clip.renderTokens(w, r, user, TokenPageInfo{NewToken: secret})
+}
+
+// DoRevokeTokenHandlerFunc handler for revoking a personal API token
+func (clip *ClipHandler) DoRevokeTokenHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetSessionUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  r.ParseForm()
+
+  id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+  if !DB.DeleteAPIToken(user, id) {
+    clip.renderTokens(w, r, user, TokenPageInfo{Message: "撤销失败！"})
+    return
+  }
+
+  reqLog(r).Infof("Token(%d) revoked for user(%s).", id, user)
+  auditRequest(r, AuditTokenRevoke, user, true, "id "+strconv.FormatInt(id, 10))
+
+  http.Redirect(w, r, "/tokens", http.StatusFound)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func TestAPITokenAuth(t *testing.T) {
+  handler := setupTestServer(t)
+
+  DB.InsertAPIToken(&utils.APITokenInfo{Username: "u1", Name: "read", Scope: utils.ScopeRead}, "cbt_read")
+  DB.InsertAPIToken(&utils.APITokenInfo{Username: "u1", Name: "write", Scope: utils.ScopeWrite}, "cbt_write")
+  DB.InsertAPIToken(&utils.APITokenInfo{Username: "u1", Name: "old", Scope: utils.ScopeReadWrite, Expires: 1}, "cbt_old")
+
+  request := func(method string, target string, token string, body string) int {
+    req := httptest.NewRequest(method, target, strings.NewReader(body))
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, req)
+    return w.Code
+  }
+
+  if code := request("POST", "/clipboard/set", "cbt_write", `{"client_id":"script","content":"hello"}`); code != http.StatusOK {
+    t.Fatal("Write token should set clipboard:", code)
+  }
+
+  if code := request("GET", "/clipboard/get", "cbt_read", ""); code != http.StatusOK {
+    t.Fatal("Read token should get clipboard:", code)
+  }
+
+  if code := request("GET", "/clipboard/get", "cbt_write", ""); code != http.StatusForbidden {
+    t.Fatal("Write token should not get clipboard:", code)
+  }
+
+  if code := request("POST", "/clipboard/set", "cbt_read", `{"content":"hello"}`); code != http.StatusForbidden {
+    t.Fatal("Read token should not set clipboard:", code)
+  }
+
+  if code := request("GET", "/clipboard/get", "cbt_old", ""); code != http.StatusUnauthorized {
+    t.Fatal("Expired token should be rejected:", code)
+  }
+
+  if code := request("GET", "/clipboard/get", "cbt_unknown", ""); code != http.StatusUnauthorized {
+    t.Fatal("Unknown token should be rejected:", code)
+  }
+
+  if _, _, scope, ok := authWS([]byte("u1:cbt_read:auto")); !ok || scope != utils.ScopeRead {
+    t.Fatal("Websocket token auth failed.")
+  }
+
+  if _, _, _, ok := authWS([]byte("u2:cbt_read:auto")); ok {
+    t.Fatal("Websocket token of another user should fail.")
+  }
+
+  // not a token, the password starts with the prefix
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u3", Password: "cbt_password"}})
+  if _, _, scope, ok := authWS([]byte("u3:cbt_password:auto")); !ok || scope != utils.ScopeReadWrite {
+    t.Fatal("Password with the token prefix should be accepted.")
+  }
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+  "bytes"
+  "clipboard-remote/utils"
+  "encoding/base32"
+  "encoding/base64"
+  "html/template"
+  "image/png"
+  "net/http"
+  "strings"
+  "time"
+
+  "github.com/pquerna/otp"
+  "github.com/pquerna/otp/totp"
+)
+
+const (
+  // issuer shown in the authenticator application
+  totpIssuer = "clipboard-remote"
+
+  // number of recovery codes generated on enrollment
+  recoveryCodeCount = 10
+
+  // seconds of a TOTP time step
+  totpPeriod = 30
+)
+
+// totpOpts validation of the code of a single time step
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// totpSecretEncoding encoding of the stored secrets
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorPageInfo template data for two factor pages
+type TwoFactorPageInfo struct {
+  Message       string
+  QRCode        template.URL
+  Secret        string
+  RecoveryCodes []string
+  Enabled       bool
+  Required      bool
+  CSRF          string
+}
+
+// verifyTwoFactor check the TOTP code, or consume a recovery code
+func verifyTwoFactor(user string, code string) bool {
+  tf := DB.GetTwoFactor(user)
+  if tf == nil || !tf.Enabled {
+    return false
+  }
+
+  code = strings.TrimSpace(code)
+  if useTotpCode(user, strings.ReplaceAll(code, " ", ""), tf.Secret) {
+    return true
+  }
+
+  // the recovery codes are generated in lower case
+  return DB.UseRecoveryCode(user, strings.ToLower(code))
+}
+
+// useTotpCode check the TOTP code within one time step of the current one, each step is
+// accepted once, so a code can not be replayed
+func useTotpCode(user string, code string, secret string) bool {
+  now := time.Now()
+  for skew := -1; skew <= 1; skew++ {
+    t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+    if ok, _ := totp.ValidateCustom(code, secret, t, totpOpts); ok {
+      return DB.UseTwoFactorStep(user, t.Unix()/totpPeriod)
+    }
+  }
+
+  return false
+}
+
+// generateRecoveryCodes return a list of new random recovery codes
+func generateRecoveryCodes() []string {
+  codes := make([]string, 0, recoveryCodeCount)
+  for i := 0; i < recoveryCodeCount; i++ {
+    codes = append(codes, strings.ToLower(utils.RandomString(6)))
+  }
+
+  return codes
+}
+
+// TwoFactorHtmlHandlerFunc handler for the second login step page
+func (clip *ClipHandler) TwoFactorHtmlHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  if GetPendingUser(r) == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  clip.htmlTemplate.ExecuteTemplate(w, "sign_in_2fa.html", newPageInfo(w, r, ""))
+}
+
+// DoTwoFactorHandlerFunc handler for the second login step
+func (clip *ClipHandler) DoTwoFactorHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetPendingUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  r.ParseForm()
+
+  // separate key, so a correct password never resets the code guessing
+  keys := append(limitKeys(clientIP(r), ""), "2fa:"+user)
+  if remain := Limiter.Check(keys...); remain > 0 {
+    page := newPageInfo(w, r, "验证失败次数过多，请稍后再试！")
+
+    w.Header().Set("Retry-After", retryAfter(remain))
+    w.WriteHeader(http.StatusTooManyRequests)
+
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in_2fa.html", page)
+    return
+  }
+
+  if !verifyTwoFactor(user, r.FormValue("code")) {
+    reqLog(r).Errorf("Failed to verify two factor code of user(%s).", user)
+    Limiter.Fail(keys...)
+    auditRequest(r, AuditLogin, user, false, "two factor")
+
+    clip.htmlTemplate.ExecuteTemplate(w, "sign_in_2fa.html", newPageInfo(w, r, "验证码错误，请重新输入！"))
+    return
+  }
+
+  Limiter.Succeed(keys...)
+  auditRequest(r, AuditLogin, user, true, "two factor")
+
+  DelPendingUser(w, r)
+  SaveSessionUser(w, r, user)
+
+  http.Redirect(w, r, "/content", http.StatusFound)
+}
+
+// twoFactorSetupUser return the user allowed to enroll, pending users can only
+// enroll when two factor is required but not enabled yet
+func twoFactorSetupUser(r *http.Request) (string, bool) {
+  if user := GetSessionUser(r); user != "" {
+    return user, false
+  }
+
+  user := GetPendingUser(r)
+  if user == "" {
+    return "", false
+  }
+
+  tf := DB.GetTwoFactor(user)
+  if tf == nil || tf.Enabled || !tf.Required {
+    return "", false
+  }
+
+  return user, true
+}
+
+// TotpSetupHtmlHandlerFunc handler for the two factor enrollment page
+func (clip *ClipHandler) TotpSetupHtmlHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user, _ := twoFactorSetupUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  page := TwoFactorPageInfo{CSRF: CSRFToken(w, r)}
+  opts := totp.GenerateOpts{
+    Issuer:      totpIssuer,
+    AccountName: user,
+  }
+
+  tf := DB.GetTwoFactor(user)
+  if tf != nil {
+    page.Enabled = tf.Enabled
+    page.Required = tf.Required
+
+    // the secret of the pending enrollment is shown again, the scanned one stays valid
+    if secret, err := totpSecretEncoding.DecodeString(tf.Secret); err == nil && len(secret) > 0 {
+      opts.Secret = secret
+    }
+  }
+
+  if page.Enabled {
+    clip.htmlTemplate.ExecuteTemplate(w, "totp_setup.html", page)
+    return
+  }
+
+  key, err := totp.Generate(opts)
+  if err != nil {
+    reqLog(r).Errorln("Failed to generate totp key:", err)
+    http.Error(w, "Generate Two Factor Key Failed.", http.StatusInternalServerError)
+    return
+  }
+
+  if opts.Secret == nil {
+    err = DB.SetTwoFactorSecret(user, key.Secret())
+    if err != nil {
+      reqLog(r).Errorln("Failed to save totp secret for user:", user, err)
+      http.Error(w, "Generate Two Factor Key Failed.", http.StatusInternalServerError)
+      return
+    }
+  }
+
+  img, err := key.Image(200, 200)
+  if err != nil {
+    reqLog(r).Errorln("Failed to generate totp qr code:", err)
+    http.Error(w, "Generate Two Factor Key Failed.", http.StatusInternalServerError)
+    return
+  }
+
+  var buf bytes.Buffer
+  png.Encode(&buf, img)
+
+  page.Secret = key.Secret()
+  page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+
+  clip.htmlTemplate.ExecuteTemplate(w, "totp_setup.html", page)
+}
+
+// DoTotpSetupHandlerFunc handler for confirming two factor enrollment
+func (clip *ClipHandler) DoTotpSetupHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user, pending := twoFactorSetupUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  r.ParseForm()
+
+  tf := DB.GetTwoFactor(user)
+  if tf == nil || tf.Enabled || tf.Secret == "" || !useTotpCode(user, strings.TrimSpace(r.FormValue("code")), tf.Secret) {
+    reqLog(r).Errorf("Failed to verify two factor enrollment of user(%s).", user)
+
+    http.Redirect(w, r, "/2fa/setup", http.StatusFound)
+    return
+  }
+
+  codes := generateRecoveryCodes()
+  err := DB.EnableTwoFactor(user, codes)
+  if err != nil {
+    reqLog(r).Errorln("Failed to enable two factor for user:", user, err)
+    http.Error(w, "Enable Two Factor Failed.", http.StatusInternalServerError)
+    return
+  }
+
+  reqLog(r).Infoln("Two factor enabled for user:", user)
+  auditRequest(r, AuditTwoFactorEnable, user, true, "")
+
+  if pending {
+    DelPendingUser(w, r)
+    SaveSessionUser(w, r, user)
+  }
+
+  clip.htmlTemplate.ExecuteTemplate(w, "totp_setup.html", TwoFactorPageInfo{
+    CSRF:          CSRFToken(w, r),
+    Enabled:       true,
+    Required:      tf.Required,
+    RecoveryCodes: codes,
+  })
+}
+
+// DoTotpDisableHandlerFunc handler for disabling two factor, not allowed when it is required
+func (clip *ClipHandler) DoTotpDisableHandlerFunc(w http.ResponseWriter, r *http.Request) {
+  user := GetSessionUser(r)
+  if user == "" {
+    http.Redirect(w, r, "/login", http.StatusFound)
+    return
+  }
+
+  r.ParseForm()
+
+  tf := DB.GetTwoFactor(user)
+  if tf == nil || tf.Required || !verifyTwoFactor(user, r.FormValue("code")) {
+    clip.htmlTemplate.ExecuteTemplate(w, "totp_setup.html", TwoFactorPageInfo{
+      CSRF:     CSRFToken(w, r),
+      Message:  "验证码错误或者管理员要求开启两步验证，无法关闭！",
+      Enabled:  tf != nil && tf.Enabled,
+      Required: tf != nil && tf.Required,
+    })
+    return
+  }
+
+  err := DB.DisableTwoFactor(user)
+  if err != nil {
+    reqLog(r).Errorln("Failed to disable two factor for user:", user, err)
+    http.Error(w, "Disable Two Factor Failed.", http.StatusInternalServerError)
+    return
+  }
+
+  reqLog(r).Infoln("Two factor disabled for user:", user)
+  auditRequest(r, AuditTwoFactorDisable, user, true, "")
+
+  http.Redirect(w, r, "/2fa/setup", http.StatusFound)
+}
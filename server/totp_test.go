@@ -0,0 +1,91 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "net/http"
+  "net/url"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/pquerna/otp/totp"
+)
+
+// secretPattern and recoveryPattern the secret and the recovery codes of the enrollment page
+var secretPattern = regexp.MustCompile(`<p class="text-center"><code>([A-Z2-7]+)</code></p>`)
+var recoveryPattern = regexp.MustCompile(`<li><code>([^<]+)</code></li>`)
+
+func TestTwoFactor(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  login := func() *testBrowser {
+    browser := newTestBrowser(handler)
+    browser.do("GET", "/login", nil)
+    if w := browser.do("POST", "/login", url.Values{"username": {"u1"}, "password": {"pass"}}); w.Code != http.StatusFound {
+      t.Fatal("Password login should succeed:", w.Code)
+    }
+    return browser
+  }
+
+  // the secret of the pending enrollment is kept when the page is reloaded
+  browser := login()
+  secret := secretPattern.FindStringSubmatch(browser.do("GET", "/2fa/setup", nil).Body.String())
+  reloaded := secretPattern.FindStringSubmatch(browser.do("GET", "/2fa/setup", nil).Body.String())
+  if secret == nil || reloaded == nil || secret[1] != reloaded[1] {
+    t.Fatal("Enrollment secret should be kept:", secret, reloaded)
+  }
+
+  if w := browser.do("POST", "/2fa/setup", url.Values{"code": {"000000"}}); w.Code != http.StatusFound {
+    t.Fatal("Wrong enrollment code should be refused:", w.Code)
+  }
+
+  code, _ := totp.GenerateCode(secret[1], time.Now())
+  w := browser.do("POST", "/2fa/setup", url.Values{"code": {code}})
+  codes := recoveryPattern.FindAllStringSubmatch(w.Body.String(), -1)
+  if w.Code != http.StatusOK || len(codes) != recoveryCodeCount {
+    t.Fatal("Enrollment should show the recovery codes:", w.Code, len(codes))
+  }
+
+  // the second step is required after the password
+  browser = login()
+  if w = browser.do("GET", "/content", nil); w.Code != http.StatusFound {
+    t.Fatal("Content should wait for the second step:", w.Code)
+  }
+
+  browser.do("GET", "/login/2fa", nil)
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {"000000"}}); !strings.Contains(w.Body.String(), "验证码错误") {
+    t.Fatal("Wrong code should be refused:", w.Code)
+  }
+
+  // the recovery codes are accepted in upper case, once
+  recovery := strings.ToUpper(codes[0][1])
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {recovery}}); w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Recovery code should be accepted:", w.Code)
+  }
+
+  browser = login()
+  browser.do("GET", "/login/2fa", nil)
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {recovery}}); !strings.Contains(w.Body.String(), "验证码错误") {
+    t.Fatal("Used recovery code should be refused:", w.Code)
+  }
+
+  // the code of the enrollment is not accepted again
+  browser.do("GET", "/login/2fa", nil)
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {code}}); !strings.Contains(w.Body.String(), "验证码错误") {
+    t.Fatal("Enrollment code should not be replayed:", w.Code)
+  }
+
+  // the code of the next step is within the skew
+  code, _ = totp.GenerateCode(secret[1], time.Now().Add(totpPeriod*time.Second))
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {code}}); w.Code != http.StatusFound || w.Header().Get("Location") != "/content" {
+    t.Fatal("Code should be accepted:", w.Code)
+  }
+
+  browser = login()
+  browser.do("GET", "/login/2fa", nil)
+  if w = browser.do("POST", "/login/2fa", url.Values{"code": {code}}); !strings.Contains(w.Body.String(), "验证码错误") {
+    t.Fatal("Used code should be refused:", w.Code)
+  }
+}
@@ -3,7 +3,9 @@ package main
 import (
   "clipboard-remote/utils"
   "encoding/base64"
+  "encoding/json"
   "net/http"
+  "strconv"
   "strings"
   "time"
 
@@ -44,25 +46,113 @@ type Client struct {
 
   // is clipboard content change auto send
   auto bool
+
+  // scope granted by the credential, tokens may be read or write only
+  scope string
+
+  // user authenticated by the bearer token or the client certificate of the upgrade request
+  tokenUser string
+
+  // client id fixed by the client certificate
+  device string
+
+  // remote ip of the upgrade request
+  remoteIP string
+
+  // request ID of the upgrade request, logged with every message of the session
+  requestID string
+
+  // close frame sent when the connection is closed, normal closure if nil
+  closeMsg []byte
+
+  // send buffer is closed, only accessed by the router
+  closed bool
+
+  // ready message of the handshake, sent by the router when registering
+  ready []byte
+
+  // subscribed channels, only accessed by the router
+  channels map[string]bool
+
+  // when the client connected, its version from the user agent or the handshake and
+  // its platform, for the presence
+  connected time.Time
+  version   string
+  platform  string
+
+  // clip types accepted by the client, all if nil, e.g. for the older clients
+  clipTypes map[string]bool
+
+  // permessage-deflate negotiated by the upgrade request
+  compression bool
 }
 
 // handRegisterMsg register handle function
 func (c *Client) handRegisterMsg(wsm *utils.WebsocketMessage) error {
-  user, mode, ok := authWS(wsm.Data)
-  if !ok {
-    return utils.ErrAuthFailed
+  hs, err := utils.ParseHandshake(wsm.Data)
+  if err != nil {
+    metricHandshakeFailures.WithLabelValues("bad_handshake").Inc()
+    c.sendError(err, 0)
+    return err
+  }
+
+  var user, scope string
+  mode := hs.Mode
+  if c.tokenUser != "" {
+    // already authenticated by the upgrade request, only the mode is needed
+    user, scope = c.tokenUser, c.scope
+
+    if hs.User != "" && hs.User != user {
+      metricHandshakeFailures.WithLabelValues("token_user").Inc()
+      c.sendError(utils.ErrAuthFailed, 0)
+      return utils.ErrAuthFailed
+    }
+  } else {
+    name := hs.User
+    keys := limitKeys(c.remoteIP, name)
+    if remain := Limiter.Check(keys...); remain > 0 {
+      c.closeMsg = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, utils.RetryReason(retrySeconds(remain)))
+      metricHandshakeFailures.WithLabelValues("rate_limited").Inc()
+      c.sendError(utils.ErrRateLimited, remain)
+      return utils.ErrRateLimited
+    }
+
+    var ok bool
+    if hs.Protocol < utils.ProtocolVersion {
+      user, mode, scope, ok = authWS(wsm.Data)
+    } else {
+      user = hs.User
+      scope, ok = authSecret(hs.User, hs.Secret)
+    }
+    if !ok {
+      Limiter.Fail(keys...)
+      metricHandshakeFailures.WithLabelValues("auth").Inc()
+      c.audit(utils.AuditInfo{Event: AuditDeviceRegister, Username: name, ClientID: wsm.UserID})
+      c.sendError(utils.ErrAuthFailed, 0)
+      return utils.ErrAuthFailed
+    }
+
+    Limiter.Succeed(keys...)
   }
 
-  // reply ready message to client
+  c.id = wsm.UserID
+  if c.device != "" {
+    c.id = c.device
+  }
+
+  // reply ready message to client, with the negotiated features for the structured handshake
   shakeReadyMsg := &utils.WebsocketMessage{
     Action: utils.ActionHandshakeReady,
-    UserID: wsm.UserID,
+    UserID: c.id,
     Data:   nil,
   }
-  c.send <- shakeReadyMsg.Encode()
+  if hs.Protocol >= utils.ProtocolVersion {
+    shakeReadyMsg.Data, _ = json.Marshal(c.negotiate(hs))
+  }
+  c.ready = shakeReadyMsg.Encode()
 
-  c.id = wsm.UserID
   c.username = user
+  c.scope = scope
 
   if mode == "auto" {
     c.auto = true
@@ -70,9 +160,11 @@ func (c *Client) handRegisterMsg(wsm *utils.WebsocketMessage) error {
     c.auto = false
   }
 
-  // register client to router
+  // register client to router, which replies the ready message
   c.router.register <- c
 
+  c.audit(utils.AuditInfo{Event: AuditDeviceRegister, Success: true, Detail: "mode " + mode})
+
   return nil
 }
 
@@ -82,34 +174,115 @@ func (c *Client) handClipboardContentMsg(wsm *utils.WebsocketMessage) error {
     return utils.ErrUnAuthenticatedClient
   }
 
-  // insert clipboard data into database
-  err := DB.InsertClipContent(&utils.ClipContentInfo{
+  if !utils.ScopeAllows(c.scope, utils.ScopeWrite) {
+    return utils.ErrPermissionDenied
+  }
+
+  if wsm.Channel != "" && !channelMember(wsm.Channel, c.username, c.id) {
+    return utils.ErrPermissionDenied
+  }
+
+  metricMessageSize.WithLabelValues("websocket").Observe(float64(len(wsm.Data)))
+
+  content := &utils.ClipContentInfo{
     ClientID: c.id,
     Username: c.username,
     Content:  base64.StdEncoding.EncodeToString(wsm.Data),
-  })
+    Channel:  wsm.Channel,
+  }
+
+  clipType, size := utils.ClipTypeOf(wsm.Data)
+  if wait, err := ClipLimits.Check(c.username, clipType, size, content); err != nil {
+    c.rejectClip(err, wait, len(wsm.Data))
+    return nil
+  }
+
+  // insert clipboard data into database
+  err := DB.InsertClipContent(content)
 
   if err != nil {
-    log.Errorf("Failed to insert clipcontent to database, id: %s, user: %s.", c.id, c.username)
+    c.logger().Errorf("Failed to insert clipcontent to database, id: %s, user: %s.", c.id, c.username)
     // Ignore errors; therefore, no return
   }
 
+  c.audit(utils.AuditInfo{Event: AuditClipboardPush, Success: true, Detail: strconv.Itoa(len(wsm.Data)) + " bytes"})
+
   // broadcast clipboard content to user's all client
   c.router.broadcast <- &Message{
     id:       c.id,
     username: c.username,
     content:  wsm.Data,
+    hash:     utils.ContentHash(wsm.Data),
+    clipType: clipType,
+    channel:  wsm.Channel,
+    created:  time.Now(),
   }
 
   return nil
 }
 
+// logger return the logger carrying the session fields
+func (c *Client) logger() *log.Entry {
+  return log.WithFields(log.Fields{
+    utils.LogFieldRequestID:  c.requestID,
+    utils.LogFieldRemoteAddr: c.remoteIP,
+    utils.LogFieldClientID:   c.id,
+    utils.LogFieldUsername:   c.username,
+  })
+}
+
+// audit record an event of the client, user and client id default to the registered ones
+func (c *Client) audit(audit utils.AuditInfo) {
+  if audit.Username == "" {
+    audit.Username = c.username
+  }
+  if audit.ClientID == "" {
+    audit.ClientID = c.id
+  }
+  audit.RemoteIP = c.remoteIP
+
+  recordAudit(&audit)
+}
+
+// errorMessage encode the error action of the error to the client, the wait is sent
+// as the seconds before trying again
+func errorMessage(clientID string, err error, wait time.Duration) []byte {
+  info := &utils.ErrorInfo{Code: utils.ErrorCode(err), Message: err.Error()}
+  if wait > 0 {
+    info.RetryAfter = retrySeconds(wait)
+  }
+  data, _ := json.Marshal(info)
+
+  return (&utils.WebsocketMessage{
+    Action: utils.ActionError,
+    UserID: clientID,
+    Data:   data,
+  }).Encode()
+}
+
+// sendError report the error to the client by the router, before the connection is
+// closed if the error ends it
+func (c *Client) sendError(err error, wait time.Duration) {
+  if utils.ErrorCode(err) == "" {
+    return
+  }
+
+  c.router.replies <- &clientReply{client: c, data: errorMessage(c.id, err, wait)}
+}
+
 // readMsgFromWs read messages from the websocket connection to the router.
 func (c *Client) readMsgFromWs() {
+  // why the client is gone, recorded in the audit
+  reason := "disconnect"
+
   // clean func
   // clear function
   defer func() {
     c.router.unregister <- c
+
+    if c.username != "" {
+      c.audit(utils.AuditInfo{Event: AuditDeviceTerminate, Success: true, Detail: reason})
+    }
   }()
 
   // set pong message handler
@@ -121,7 +294,7 @@ func (c *Client) readMsgFromWs() {
     _, msg, err := c.conn.ReadMessage()
     if err != nil {
       if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-        log.Errorln("Read message from websocket, error:", err)
+        c.logger().Errorln("Read message from websocket, error:", err)
       }
       return
     }
@@ -130,29 +303,63 @@ func (c *Client) readMsgFromWs() {
     wsm := &utils.WebsocketMessage{}
     err = wsm.Decode(msg)
     if err != nil {
-      log.Errorf("Error message: %v.", err)
+      c.logger().Errorf("Error message: %v.", err)
+      c.sendError(utils.ErrBadAction, 0)
       continue
     }
 
+    entry := c.logger().WithField(utils.LogFieldAction, wsm.Action)
+
     switch wsm.Action {
     case utils.ActionHandshakeRegister:
+      // a client is registered to the router once only
+      if c.username != "" {
+        entry.Warnln("Ignored register message of registered client:", wsm.UserID)
+        c.sendError(utils.ErrBadAction, 0)
+        continue
+      }
+
       err = c.handRegisterMsg(wsm)
       if err != nil {
-        log.Errorf("Failed to handle register message from client: %s, error: %v.", wsm.UserID, err)
+        entry.Errorf("Failed to handle register message from client: %s, error: %v.", wsm.UserID, err)
         return
       }
-      log.Infoln("Client register succeed:", wsm.UserID)
+      entry.Infoln("Client register succeed:", wsm.UserID)
     case utils.ActionClipboardChanged:
       err = c.handClipboardContentMsg(wsm)
       if err != nil {
-        log.Errorf("Failed to handle clipboard message from client: %s, error: %v.", wsm.UserID, err)
+        entry.Errorf("Failed to handle clipboard message from client: %s, error: %v.", wsm.UserID, err)
+        c.sendError(err, 0)
+        reason = err.Error()
+        return
+      }
+      entry.Infoln("Client clipboard info change:", wsm.UserID)
+    case utils.ActionClipboardPush:
+      err = c.handClipboardPushMsg(wsm)
+      if err != nil {
+        entry.Errorf("Failed to handle push message from client: %s, error: %v.", wsm.UserID, err)
+        c.sendError(err, 0)
+        reason = err.Error()
+        return
+      }
+      entry.Infof("Client %s push to %s.", wsm.UserID, wsm.Target)
+    case utils.ActionSubscribe:
+      err = c.handSubscribeMsg(wsm)
+      if err != nil {
+        entry.Errorf("Failed to handle subscribe message from client: %s, error: %v.", wsm.UserID, err)
+        c.sendError(err, 0)
+        reason = err.Error()
         return
       }
-      log.Infoln("Client clipboard info change:", wsm.UserID)
+      entry.Infoln("Client subscribed channels:", utils.BytesToString(wsm.Data))
     case utils.ActionTerminate:
       // client unregister
-      log.Infoln("Client terminate:", wsm.UserID)
+      entry.Infoln("Client terminate:", wsm.UserID)
+      reason = "terminate"
       return
+    default:
+      entry.Warnln("Unknown action from client:", wsm.UserID)
+      c.sendError(utils.ErrBadAction, 0)
     }
   }
 }
@@ -168,6 +375,8 @@ func (c *Client) writeMsgToWs() {
 
     // quit then close the connection
     c.conn.Close()
+
+    c.router.conns.Done()
   }()
 
   for {
@@ -177,7 +386,7 @@ func (c *Client) writeMsgToWs() {
       c.conn.SetWriteDeadline(time.Now().Add(writeWait))
       if !ok {
         // the channel has been closed.
-        c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+        c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
         return
       }
 
@@ -201,47 +410,118 @@ func (c *Client) writeMsgToWs() {
       if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
         return
       }
-      log.Debugln("tiker timeout, send ping message.")
+      c.logger().Debugln("tiker timeout, send ping message.")
     }
   }
 }
 
-// authWS client authentication, return username, mode, succeed
-func authWS(token []byte) (string, string, bool) {
-  tokens := strings.Split(utils.BytesToString(token), ":")
-  if len(tokens) != 3 {
+// authWS client authentication, return username, mode, scope, succeed
+// the token is user:secret:mode, the secret is a personal API token, the
+// bcrypt hash of the password or the password itself, which may contain colons.
+func authWS(token []byte) (string, string, string, bool) {
+  data := utils.BytesToString(token)
+  first := strings.Index(data, ":")
+  last := strings.LastIndex(data, ":")
+  if first < 0 || first == last {
     log.Errorln("Invalid token:", token)
-    return "", "", false
+    return "", "", "", false
+  }
+
+  user, secret, mode := data[:first], data[first+1:last], data[last+1:]
+  scope, ok := authSecret(user, secret)
+
+  return user, mode, scope, ok
+}
+
+// authSecret authenticate the user by a personal API token, the bcrypt hash of the
+// password or the password itself, return the scope and whether it succeed
+func authSecret(user string, secret string) (string, bool) {
+  if user == "" || secret == "" {
+    log.Errorf("Empty user or secret of user(%s).", user)
+    return "", false
   }
-  user := tokens[0]
-  pass := DB.GetPassword(user)
-  if pass == "" {
-    return "", "", false
+
+  // a password may start with the token prefix too
+  if strings.HasPrefix(secret, utils.APITokenPrefix) {
+    apiToken, err := authToken(secret)
+    if err == nil && apiToken.Username == user {
+      return apiToken.Scope, true
+    }
+  }
+
+  var err error
+  if _, costErr := bcrypt.Cost(utils.StringToBytes(secret)); costErr == nil {
+    err = Authenticator.AuthenticateHash(user, secret)
+  } else {
+    err = Authenticator.Authenticate(user, secret)
   }
 
-  err := bcrypt.CompareHashAndPassword(utils.StringToBytes((tokens[1])), utils.StringToBytes(pass))
   if err != nil {
     log.Errorf("Failed to auth user(%s), error: %v.", user, err)
-    return user, tokens[2], false
+    return "", false
   }
 
-  return user, tokens[2], true
+  return utils.ScopeReadWrite, true
 }
 
 // ServeWs handles websocket requests from the peer.
 func ServeWs(router *Router, w http.ResponseWriter, r *http.Request) {
+  ip := clientIP(r)
+
+  // reject the handshake of locked out ip
+  if remain := Limiter.Check(limitKeys(ip, "")...); remain > 0 {
+    metricHandshakeFailures.WithLabelValues("rate_limited").Inc()
+    w.Header().Set("Retry-After", retryAfter(remain))
+    http.Error(w, "Too Many Authentication Failures.", http.StatusTooManyRequests)
+    return
+  }
+
+  // personal API token in the upgrade request
+  var apiToken *utils.APITokenInfo
+  if secret := bearerToken(r); secret != "" {
+    var err error
+    apiToken, err = authToken(secret)
+    if err != nil {
+      reqLog(r).Errorln("Failed to auth websocket token:", err)
+      Limiter.Fail(limitKeys(ip, "")...)
+      metricHandshakeFailures.WithLabelValues("token").Inc()
+      auditRequest(r, AuditDeviceRegister, "", false, "token")
+      http.Error(w, "Authentication Failed.", http.StatusUnauthorized)
+      return
+    }
+  }
+
   conn, err := upgrader.Upgrade(w, r, nil)
   if err != nil {
-    log.Errorln("Failed to accept wss socket:", err)
+    reqLog(r).Errorln("Failed to accept wss socket:", err)
     return
   }
 
   client := &Client{
-    router: router,
-    conn:   conn,
-    send:   make(chan []byte, 256),
+    router:      router,
+    conn:        conn,
+    send:        make(chan []byte, 256),
+    remoteIP:    ip,
+    requestID:   requestID(r),
+    connected:   time.Now(),
+    version:     utils.ClientVersion(r.UserAgent()),
+    compression: offersCompression(r),
   }
 
+  if apiToken != nil {
+    client.tokenUser = apiToken.Username
+    client.scope = apiToken.Scope
+  } else if user, device, ok := certificateUser(r); ok {
+    client.tokenUser = user
+    client.scope = utils.ScopeReadWrite
+    client.device = device
+  }
+
+  // the router waits the writer when draining, and closes the connection even if it
+  // never registers
+  router.conns.Add(1)
+  router.connect <- client
+
   // Allow collection of memory referenced by the caller by doing all work in
   // new goroutines.
   go client.writeMsgToWs()
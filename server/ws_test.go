@@ -0,0 +1,149 @@
+package main
+
+import (
+  "bytes"
+  "clipboard-remote/utils"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/gorilla/websocket"
+)
+
+func TestErrorAction(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  send := func(conn *websocket.Conn, action utils.WebsocketAction, data string) {
+    sendWs(conn, action, "c1", []byte(data))
+  }
+
+  errorCode := func(wsm *utils.WebsocketMessage) string {
+    info := &utils.ErrorInfo{}
+    if wsm.Action != utils.ActionError || json.Unmarshal(wsm.Data, info) != nil {
+      t.Fatal("Error action should be replied:", wsm.Action)
+    }
+    return info.Code
+  }
+
+  // a failed handshake is explained before the connection is closed
+  conn := dialWs(t, server)
+  send(conn, utils.ActionHandshakeRegister, "u1:wrong:auto")
+  if code := errorCode(readWs(t, conn)); code != utils.ErrorAuthFailed {
+    t.Fatal("Wrong password should be replied with auth failed:", code)
+  }
+  if _, _, err := conn.ReadMessage(); err == nil {
+    t.Fatal("Connection should be closed after the auth failure.")
+  }
+  conn.Close()
+
+  // unknown actions are rejected and the connection is kept
+  conn = dialWs(t, server)
+  defer disconnect(t, conn, "c1")
+
+  send(conn, "unknown", "")
+  if code := errorCode(readWs(t, conn)); code != utils.ErrorBadAction {
+    t.Fatal("Unknown action should be replied with bad action:", code)
+  }
+
+  send(conn, utils.ActionHandshakeRegister, "u1:pass:auto")
+  if wsm := readWs(t, conn); wsm.Action != utils.ActionHandshakeReady {
+    t.Fatal("Client should register after a bad action:", wsm.Action)
+  }
+}
+
+func TestStructuredHandshake(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+  GlobalConfig.Limits = utils.LimitsConfig{MaxText: 1024}
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  register := func(id string, data string) (*websocket.Conn, *utils.WebsocketMessage) {
+    conn, ready := registerWs(t, server, id, data)
+    if ready.Action != utils.ActionHandshakeReady {
+      t.Fatal("Client should be ready:", ready.Action)
+    }
+    return conn, ready
+  }
+
+  phone, ready := register("phone", `{"protocol":2,"user":"u1","secret":"pass","mode":"auto","version":"2.0.0","platform":"android","clip_types":["text","video"],"capabilities":["compression","e2e"]}`)
+  defer disconnect(t, phone, "phone")
+
+  info := &utils.ReadyInfo{}
+  if err := json.Unmarshal(ready.Data, info); err != nil || info.Protocol != utils.ProtocolVersion {
+    t.Fatal("Structured handshake should be replied with the ready info:", err)
+  }
+  if len(info.ClipTypes) != 1 || info.ClipTypes[0] != utils.ClipTypeText || len(info.Capabilities) != 1 || info.Capabilities[0] != utils.CapCompression {
+    t.Fatal("Only the supported clip types and capabilities should be negotiated:", info.ClipTypes, info.Capabilities)
+  }
+  if info.Limits.MaxText != 1024 || info.Limits.MaxMsgSize != GlobalConfig.MaxMsgSize {
+    t.Fatal("Ready info should carry the server limits:", info.Limits)
+  }
+
+  // the older clients keep the colon separated handshake
+  laptop, ready := register("laptop", "u1:pass:auto")
+  defer disconnect(t, laptop, "laptop")
+  if ready.Data != nil {
+    t.Fatal("Colon separated handshake should be replied without data.")
+  }
+
+  // the phone only gets the clip types it accepts
+  file, _ := utils.EncodeToBytes(utils.ClipBoardBuff{Type: utils.CLIP_PATH, Name: "a.txt", Buff: []byte("file")})
+  for _, data := range [][]byte{file, textClip("text")} {
+    msg := &utils.WebsocketMessage{Action: utils.ActionClipboardChanged, UserID: "laptop", Data: data}
+    laptop.WriteMessage(websocket.BinaryMessage, msg.Encode())
+  }
+
+  if wsm := readWs(t, phone); !bytes.Equal(wsm.Data, textClip("text")) {
+    t.Fatal("Client should only get the clip types it accepts.")
+  }
+
+  req, _ := http.NewRequest("GET", server.URL+"/clipboard/devices", nil)
+  req.SetBasicAuth("u1", "pass")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal("Failed to get devices:", err)
+  }
+  defer resp.Body.Close()
+
+  devices := DevicesRespInfo{}
+  json.NewDecoder(resp.Body).Decode(&devices)
+  if len(devices.Data) != 2 || devices.Data[1].Platform != "android" || devices.Data[1].Version != "2.0.0" {
+    t.Fatal("Presence should show the client info of the handshake:", devices.Data)
+  }
+}
+
+func TestRegisterTwice(t *testing.T) {
+  handler := setupTestServer(t)
+  DB.InsertUserInfo([]utils.AuthConfig{{User: "u1", Password: "pass"}})
+
+  server := httptest.NewServer(handler)
+  defer server.Close()
+
+  // the second register message is rejected and the connection is kept
+  first, _ := registerWs(t, server, "c1", "u1:pass:auto")
+  sendWs(first, utils.ActionHandshakeRegister, "c1", []byte("u1:pass:auto"))
+  wsm := readWs(t, first)
+  info := &utils.ErrorInfo{}
+  if wsm.Action != utils.ActionError || json.Unmarshal(wsm.Data, info) != nil || info.Code != utils.ErrorBadAction {
+    t.Fatal("Second register should be replied with bad action:", wsm.Action)
+  }
+
+  second, _ := registerWs(t, server, "c2", "u1:pass:auto")
+  defer disconnect(t, second, "c2")
+  third, _ := registerWs(t, server, "c3", "u1:pass:auto")
+  defer disconnect(t, third, "c3")
+
+  // the closed client is no longer in the router, the broadcast still arrives
+  disconnect(t, first, "c1")
+  sendWs(second, utils.ActionClipboardChanged, "c2", textClip("after"))
+  if wsm := readWs(t, third); !bytes.Equal(wsm.Data, textClip("after")) {
+    t.Fatal("Clip should be broadcast after the disconnection:", wsm.Action)
+  }
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/hex"
+  "encoding/pem"
+  "errors"
+  "math/big"
+  "net"
+  "os"
+  "strings"
+  "time"
+)
+
+// validity of the generated certificates
+const (
+  caValidDays   = 3650
+  certValidDays = 825
+)
+
+// CertRequest subject and usage of a certificate signed by the local CA
+type CertRequest struct {
+  CommonName string
+
+  // organizational unit of the subject
+  Unit string
+
+  // DNS names and IP addresses of the server
+  Hosts []string
+
+  // client authentication instead of server authentication
+  Client bool
+}
+
+// CertFingerprint sha256 hex digest of the DER certificate, used for pinning
+func CertFingerprint(der []byte) string {
+  sum := sha256.Sum256(der)
+  return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint lower case the fingerprint and strip the colons of the openssl format
+func NormalizeFingerprint(fingerprint string) string {
+  return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+// LoadCertFile return the first certificate of the PEM file
+func LoadCertFile(certFile string) (*x509.Certificate, error) {
+  b, err := os.ReadFile(certFile)
+  if err != nil {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(b)
+  if block == nil || block.Type != "CERTIFICATE" {
+    return nil, errors.New("no certificate in " + certFile)
+  }
+
+  return x509.ParseCertificate(block.Bytes)
+}
+
+// loadKeyFile return the PKCS8 private key of the PEM file
+func loadKeyFile(keyFile string) (*ecdsa.PrivateKey, error) {
+  b, err := os.ReadFile(keyFile)
+  if err != nil {
+    return nil, err
+  }
+
+  block, _ := pem.Decode(b)
+  if block == nil {
+    return nil, errors.New("no private key in " + keyFile)
+  }
+
+  key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    return nil, err
+  }
+
+  ecKey, ok := key.(*ecdsa.PrivateKey)
+  if !ok {
+    return nil, errors.New("not an ecdsa key in " + keyFile)
+  }
+
+  return ecKey, nil
+}
+
+// writeCertFiles save the certificate and the private key, only the owner can read the key
+func writeCertFiles(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+  keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+  if err != nil {
+    return err
+  }
+
+  err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+  if err != nil {
+    return err
+  }
+
+  return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func serialNumber() (*big.Int, error) {
+  return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// CreateCA generate a self-signed CA certificate and its private key
+func CreateCA(certFile string, keyFile string, commonName string) error {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return err
+  }
+
+  serial, err := serialNumber()
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  template := &x509.Certificate{
+    SerialNumber:          serial,
+    Subject:               pkix.Name{CommonName: commonName, Organization: []string{"clipboard-remote"}},
+    NotBefore:             now.Add(-time.Hour),
+    NotAfter:              now.AddDate(0, 0, caValidDays),
+    KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+    BasicConstraintsValid: true,
+    IsCA:                  true,
+    MaxPathLenZero:        true,
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    return err
+  }
+
+  return writeCertFiles(certFile, keyFile, der, key)
+}
+
+// CreateCert generate a certificate signed by the CA files
+func CreateCert(caCertFile string, caKeyFile string, certFile string, keyFile string, req *CertRequest) error {
+  caCert, err := LoadCertFile(caCertFile)
+  if err != nil {
+    return err
+  }
+
+  caKey, err := loadKeyFile(caKeyFile)
+  if err != nil {
+    return err
+  }
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return err
+  }
+
+  serial, err := serialNumber()
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  template := &x509.Certificate{
+    SerialNumber: serial,
+    Subject:      pkix.Name{CommonName: req.CommonName, Organization: []string{"clipboard-remote"}},
+    NotBefore:    now.Add(-time.Hour),
+    NotAfter:     now.AddDate(0, 0, certValidDays),
+    KeyUsage:     x509.KeyUsageDigitalSignature,
+    ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+  }
+
+  if req.Unit != "" {
+    template.Subject.OrganizationalUnit = []string{req.Unit}
+  }
+
+  if req.Client {
+    template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+  }
+
+  for _, host := range req.Hosts {
+    if ip := net.ParseIP(host); ip != nil {
+      template.IPAddresses = append(template.IPAddresses, ip)
+    } else if host != "" {
+      template.DNSNames = append(template.DNSNames, host)
+    }
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+  if err != nil {
+    return err
+  }
+
+  return writeCertFiles(certFile, keyFile, der, key)
+}
+
+// CertCoversHosts check the certificate file is valid for all the hosts and not about to expire
+func CertCoversHosts(certFile string, hosts []string) bool {
+  cert, err := LoadCertFile(certFile)
+  if err != nil {
+    return false
+  }
+
+  if time.Now().AddDate(0, 0, 30).After(cert.NotAfter) {
+    return false
+  }
+
+  for _, host := range hosts {
+    if cert.VerifyHostname(host) != nil {
+      return false
+    }
+  }
+
+  return true
+}
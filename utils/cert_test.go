@@ -0,0 +1,42 @@
+package utils
+
+import (
+  "crypto/x509"
+  "path/filepath"
+  "testing"
+)
+
+func TestCreateCert(t *testing.T) {
+  dir := t.TempDir()
+  caCert, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+  certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+  if err := CreateCA(caCert, caKey, "test CA"); err != nil {
+    t.Fatal("Failed to create CA:", err)
+  }
+
+  err := CreateCert(caCert, caKey, certFile, keyFile, &CertRequest{CommonName: "localhost", Hosts: []string{"localhost", "192.168.1.10"}})
+  if err != nil {
+    t.Fatal("Failed to create certificate:", err)
+  }
+
+  ca, _ := LoadCertFile(caCert)
+  cert, err := LoadCertFile(certFile)
+  if err != nil {
+    t.Fatal("Failed to load certificate:", err)
+  }
+
+  roots := x509.NewCertPool()
+  roots.AddCert(ca)
+  if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "192.168.1.10"}); err != nil {
+    t.Fatal("Certificate should be signed by the CA:", err)
+  }
+
+  if !CertCoversHosts(certFile, []string{"localhost", "192.168.1.10"}) || CertCoversHosts(certFile, []string{"10.0.0.1"}) {
+    t.Fatal("Hosts of the certificate are wrong.")
+  }
+
+  if fp := CertFingerprint(cert.Raw); len(fp) != 64 || NormalizeFingerprint("AB:CD") != "abcd" {
+    t.Fatal("Unexpected fingerprint:", fp)
+  }
+}
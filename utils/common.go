@@ -2,8 +2,13 @@ package utils
 
 import (
   "bytes"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
   "encoding/gob"
+  "encoding/hex"
   "os"
+  "strings"
 )
 
 type ClipType int
@@ -11,8 +16,49 @@ type ClipType int
 const (
   CLIP_TEXT ClipType = 0
   CLIP_PATH ClipType = 1
+  // image data, e.g. PNG
+  CLIP_IMAGE ClipType = 2
 )
 
+// clip type names of the handshake
+const (
+  ClipTypeText  = "text"
+  ClipTypeFile  = "file"
+  ClipTypeImage = "image"
+)
+
+var clipTypeNames = map[ClipType]string{
+  CLIP_TEXT:  ClipTypeText,
+  CLIP_PATH:  ClipTypeFile,
+  CLIP_IMAGE: ClipTypeImage,
+}
+
+// ClipTypeOf return the type name and the content size of the encoded clip, the type is
+// empty for the clips which can not be decoded, e.g. encrypted ones
+func ClipTypeOf(data []byte) (string, int) {
+  clip, err := DecodeToStruct(data)
+  if err != nil {
+    return "", len(data)
+  }
+
+  return clipTypeNames[clip.Type], len(clip.Buff)
+}
+
+// Personal API token
+const (
+  // APITokenPrefix distinguish tokens from passwords
+  APITokenPrefix = "cbt_"
+
+  ScopeRead      = "read"
+  ScopeWrite     = "write"
+  ScopeReadWrite = "read-write"
+)
+
+// ScopeAllows check whether the granted scope covers the required scope
+func ScopeAllows(scope string, want string) bool {
+  return scope == ScopeReadWrite || scope == want
+}
+
 type ClipBoardBuff struct {
   Type ClipType
   Name string
@@ -29,6 +75,8 @@ type DataInfo struct {
   ClientID string `json:"client_id,omitempty"`
   Type     string `json:"type,omitempty"`
   Content  string `json:"content,omitempty"`
+  Channel  string `json:"channel,omitempty"`
+  Target   string `json:"target,omitempty"`
 }
 
 func EncodeToBytes(cb ClipBoardBuff) ([]byte, error) {
@@ -58,3 +106,38 @@ func Exists(path string) bool {
   _, err := os.Stat(path)
   return !os.IsNotExist(err)
 }
+
+// HashSecret sha256 hex digest, used to store random secrets such as recovery codes
+func HashSecret(secret string) string {
+  sum := sha256.Sum256(StringToBytes(secret))
+  return hex.EncodeToString(sum[:])
+}
+
+// RandomString return a url safe random string from n random bytes
+func RandomString(n int) string {
+  b := make([]byte, n)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// LoadOrCreateKey return the key saved in the file, a random key is generated and saved on first use
+func LoadOrCreateKey(file string) (string, error) {
+  b, err := os.ReadFile(file)
+  if err == nil {
+    if key := strings.TrimSpace(string(b)); key != "" {
+      return key, nil
+    }
+  } else if !os.IsNotExist(err) {
+    return "", err
+  }
+
+  key := RandomString(32)
+  if err = os.WriteFile(file, []byte(key), 0600); err != nil {
+    return "", err
+  }
+
+  return key, nil
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+  file := filepath.Join(t.TempDir(), "session.key")
+
+  key, err := LoadOrCreateKey(file)
+  if err != nil || len(key) < 32 {
+    t.Fatal("Failed to create key:", key, err)
+  }
+
+  info, err := os.Stat(file)
+  if err != nil || info.Mode().Perm() != 0600 {
+    t.Fatal("Key file should be private:", err)
+  }
+
+  again, err := LoadOrCreateKey(file)
+  if err != nil || again != key {
+    t.Fatal("Key should be persisted:", again, err)
+  }
+}
+
+func TestClipTypeOf(t *testing.T) {
+  data, _ := EncodeToBytes(ClipBoardBuff{Type: CLIP_PATH, Name: "a.txt", Buff: []byte("12345")})
+  if clipType, size := ClipTypeOf(data); clipType != ClipTypeFile || size != 5 {
+    t.Fatal("File clip should be recognized with its content size:", clipType, size)
+  }
+
+  if clipType, size := ClipTypeOf([]byte("encrypted")); clipType != "" || size != 9 {
+    t.Fatal("Undecodable clip should have no type:", clipType, size)
+  }
+}
+
+func TestScopeAllows(t *testing.T) {
+  if !ScopeAllows(ScopeReadWrite, ScopeWrite) || !ScopeAllows(ScopeRead, ScopeRead) || ScopeAllows(ScopeRead, ScopeWrite) {
+    t.Fatal("Scope should cover itself and read-write everything.")
+  }
+}
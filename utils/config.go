@@ -2,6 +2,7 @@ package utils
 
 import (
   "os"
+  "path/filepath"
 
   log "github.com/sirupsen/logrus"
 
@@ -18,17 +19,89 @@ type ClientConfig struct {
   InsecureSkipVerify bool         `yaml:"skip-cert-verify"`
   HotKey             HotKeyConfig `yaml:"hotkey"`
   Mode               string       `yaml:"mode"`
+  SendPassword       bool         `yaml:"send-password"`
+
+  // sha256 fingerprint of the server or its CA certificate
+  PinnedCertSHA256 string `yaml:"pinned-cert-sha256"`
+  // CA certificates verifying the server
+  CAFile string `yaml:"ca-file"`
+  // record the fingerprint of the first connection and refuse the later mismatches
+  TrustOnFirstUse  bool   `yaml:"trust-on-first-use"`
+  KnownServersFile string `yaml:"known-servers"`
+
+  // https or http behind a TLS terminating proxy, the websocket uses wss or ws
+  Scheme string `yaml:"scheme"`
+
+  // client certificate authenticating to servers requiring mutual TLS
+  ClientCert string `yaml:"client-cert"`
+  ClientKey  string `yaml:"client-key"`
+
+  // find the server by mDNS, the configured server is the fallback
+  Discovery DiscoveryConfig `yaml:"discovery"`
+
+  Reconnect ReconnectConfig `yaml:"reconnect"`
+
+  // clips waiting for the connection
+  Queue QueueConfig `yaml:"queue"`
+
+  // channels received besides the clips of the user, and the channel the clips are sent to
+  Channels []string `yaml:"channels"`
+  Channel  string   `yaml:"channel"`
+
+  // highest handshake protocol version, the client falls back to 1 for the servers
+  // before the structured handshake
+  Protocol int `yaml:"protocol"`
+}
+
+// DiscoveryEnabled return whether the server is discovered by mDNS, true if not configured
+func (c *ClientConfig) DiscoveryEnabled() bool {
+  return c.Discovery.Enabled == nil || *c.Discovery.Enabled
 }
 
 // ServerConfig clipboard server config
 type ServerConfig struct {
-  Auths         []AuthConfig  `yaml:"auths"`
-  MaxMsgSize    int           `yaml:"max-msg-size"`
-  Address       string        `yaml:"addr"`
-  WebsocketPath string        `yaml:"websocket-path"`
-  Certificate   CertConfig    `yaml:"certificate"`
-  Log           LogConfig     `yaml:"log"`
-  Session       SessionConfig `yaml:"session"`
+  Auths          []AuthConfig     `yaml:"auths"`
+  Admins         []string         `yaml:"admins"`
+  MaxMsgSize     int              `yaml:"max-msg-size"`
+  Address        string           `yaml:"addr"`
+  TLS            *bool            `yaml:"tls"`
+  UnixSocket     string           `yaml:"unix-socket"`
+  TrustedProxies []string         `yaml:"trusted-proxies"`
+  WebsocketPath  string           `yaml:"websocket-path"`
+  Certificate    CertConfig       `yaml:"certificate"`
+  Log            LogConfig        `yaml:"log"`
+  Session        SessionConfig    `yaml:"session"`
+  OIDC           OIDCConfig       `yaml:"oidc"`
+  AuthBackend    string           `yaml:"auth-backend"`
+  LDAP           LDAPConfig       `yaml:"ldap"`
+  AuthLimit      AuthLimitConfig  `yaml:"auth-limit"`
+  MetricsAddr    string           `yaml:"metrics-addr"`
+  Shutdown       ShutdownConfig   `yaml:"shutdown"`
+  ClientAuth     ClientAuthConfig `yaml:"client-auth"`
+  MDNS           MDNSConfig       `yaml:"mdns"`
+  Channels       []ChannelConfig  `yaml:"channels"`
+  Limits         LimitsConfig     `yaml:"limits"`
+}
+
+// TLSEnabled return whether the server terminates TLS itself, true if not configured
+func (c *ServerConfig) TLSEnabled() bool {
+  return c.TLS == nil || *c.TLS
+}
+
+// MDNSEnabled return whether the server is announced by mDNS, true if not configured
+func (c *ServerConfig) MDNSEnabled() bool {
+  return c.MDNS.Enabled == nil || *c.MDNS.Enabled
+}
+
+// IsAdmin check whether the user is configured as administrator
+func (c *ServerConfig) IsAdmin(user string) bool {
+  for _, admin := range c.Admins {
+    if user != "" && admin == user {
+      return true
+    }
+  }
+
+  return false
 }
 
 type SessionConfig struct {
@@ -36,16 +109,143 @@ type SessionConfig struct {
   MaxAge int    `yaml:"max-age"`
 }
 
-// CertConfig config the certificate files
+// OIDCConfig OpenID Connect single sign-on config, disabled if no issuer
+type OIDCConfig struct {
+  Issuer        string   `yaml:"issuer"`
+  ClientID      string   `yaml:"client-id"`
+  ClientSecret  string   `yaml:"client-secret"`
+  RedirectURL   string   `yaml:"redirect-url"`
+  Scopes        []string `yaml:"scopes"`
+  UsernameClaim string   `yaml:"username-claim"`
+  AutoProvision bool     `yaml:"auto-provision"`
+  AutoRedirect  bool     `yaml:"auto-redirect"`
+}
+
+// LDAPConfig LDAP authentication backend config
+type LDAPConfig struct {
+  URL                string   `yaml:"url"`
+  StartTLS           bool     `yaml:"start-tls"`
+  InsecureSkipVerify bool     `yaml:"skip-cert-verify"`
+  UserDNTemplate     string   `yaml:"user-dn-template"`
+  BindDN             string   `yaml:"bind-dn"`
+  BindPassword       string   `yaml:"bind-password"`
+  BaseDN             string   `yaml:"base-dn"`
+  UserFilter         string   `yaml:"user-filter"`
+  GroupBaseDN        string   `yaml:"group-base-dn"`
+  GroupFilter        string   `yaml:"group-filter"`
+  AllowedGroups      []string `yaml:"allowed-groups"`
+  CacheTTL           int      `yaml:"cache-ttl"`
+}
+
+// LimitsConfig limits of the clips of each user, zero means unlimited
+type LimitsConfig struct {
+  // maximum clip sizes in bytes by type
+  MaxText  int `yaml:"max-text"`
+  MaxImage int `yaml:"max-image"`
+  MaxFile  int `yaml:"max-file"`
+
+  // bytes of the history stored for each user, base64 encoded
+  Quota int64 `yaml:"quota"`
+
+  // clips sent by each user per minute, in bursts of up to burst clips
+  Rate  int `yaml:"rate"`
+  Burst int `yaml:"burst"`
+}
+
+// AuthLimitConfig brute-force protection of the authentication, durations in seconds
+type AuthLimitConfig struct {
+  MaxAttempts int `yaml:"max-attempts"`
+  Window      int `yaml:"window"`
+  Lockout     int `yaml:"lockout"`
+  MaxLockout  int `yaml:"max-lockout"`
+}
+
+// ShutdownConfig graceful shutdown, durations in seconds
+type ShutdownConfig struct {
+  Timeout        int `yaml:"timeout"`
+  ReconnectDelay int `yaml:"reconnect-delay"`
+}
+
+// ChannelConfig named clipboard shared by its members
+type ChannelConfig struct {
+  Name string `yaml:"name"`
+
+  // usernames for all their devices, or user/device for a single device
+  Members []string `yaml:"members"`
+}
+
+// MDNSConfig announcement of the server on the local network
+type MDNSConfig struct {
+  // enabled if not configured
+  Enabled *bool `yaml:"enabled"`
+
+  // instance name, the hostname if not set
+  Name string `yaml:"name"`
+}
+
+// ReconnectConfig seconds between the reconnections, doubled after each failure
+type ReconnectConfig struct {
+  MinDelay int `yaml:"min-delay"`
+  MaxDelay int `yaml:"max-delay"`
+}
+
+// QueueConfig outgoing queue of the client, the oldest messages are dropped when it is full
+type QueueConfig struct {
+  MaxMessages int `yaml:"max-messages"`
+  MaxBytes    int `yaml:"max-bytes"`
+
+  // keep the queue across restarts, memory only if not set. Written only while
+  // disconnected, the clips are stored in plaintext
+  File string `yaml:"file"`
+}
+
+// DiscoveryConfig server discovery of the client
+type DiscoveryConfig struct {
+  // enabled if not configured
+  Enabled *bool `yaml:"enabled"`
+
+  // seconds to collect the answers
+  Timeout int `yaml:"timeout"`
+
+  // pick the server by instance name or certificate fingerprint
+  Name        string `yaml:"name"`
+  Fingerprint string `yaml:"fingerprint"`
+
+  // failed reconnections before switching between the configured and the discovered server
+  Retries int `yaml:"retries"`
+}
+
+// ClientAuthConfig mutual TLS authentication of the clients, the common name of the
+// certificate is the username and the organizational unit is the device
+type ClientAuthConfig struct {
+  // none, request (verify the certificate if given) or require
+  Mode string `yaml:"mode"`
+
+  // CA verifying the client certificates, the generated local CA if not set
+  CAFile string `yaml:"ca-file"`
+}
+
+// CertConfig config the certificate files, a local CA and certificate are generated if not set
 type CertConfig struct {
   CertFile string `yaml:"cert-file"`
   KeyFile  string `yaml:"key-file"`
+
+  // extra names and addresses of the generated certificate
+  Hosts []string `yaml:"hosts"`
 }
 
 // LogConfig log config, default is stdOut, level is info
 type LogConfig struct {
   LogPath  string `yaml:"path"`
   LogLevel string `yaml:"log-level"`
+
+  // text or json
+  Format string `yaml:"format"`
+
+  // rotation of the log file, size in megabytes and age in days
+  MaxSize    int `yaml:"max-size"`
+  MaxAge     int `yaml:"max-age"`
+  MaxBackups int `yaml:"max-backups"`
 }
 
 // AuthConfig auth config
@@ -85,6 +285,58 @@ func ClientConfigRead(configFile string) (*ClientConfig, error) {
     config.Log.LogLevel = "info"
   }
 
+  if config.Log.Format == "" {
+    config.Log.Format = "text"
+  }
+
+  if config.Log.MaxSize == 0 {
+    config.Log.MaxSize = 100
+  }
+
+  if config.Log.MaxAge == 0 {
+    config.Log.MaxAge = 30
+  }
+
+  if config.Scheme == "" {
+    config.Scheme = "https"
+  }
+
+  if config.KnownServersFile == "" {
+    config.KnownServersFile = filepath.Join(filepath.Dir(configFile), "known_servers")
+  }
+
+  if config.Discovery.Timeout <= 0 {
+    config.Discovery.Timeout = 3
+  }
+
+  if config.Discovery.Retries <= 0 {
+    config.Discovery.Retries = 3
+  }
+
+  if config.Reconnect.MinDelay <= 0 {
+    config.Reconnect.MinDelay = 1
+  }
+
+  if config.Reconnect.MaxDelay <= 0 {
+    config.Reconnect.MaxDelay = 120
+  }
+
+  if config.Reconnect.MaxDelay < config.Reconnect.MinDelay {
+    config.Reconnect.MaxDelay = config.Reconnect.MinDelay
+  }
+
+  if config.Queue.MaxMessages <= 0 {
+    config.Queue.MaxMessages = 100
+  }
+
+  if config.Queue.MaxBytes <= 0 {
+    config.Queue.MaxBytes = 64 << 20
+  }
+
+  if config.Protocol <= 0 {
+    config.Protocol = ProtocolVersion
+  }
+
   if config.HotKey.UploadKey == "" {
     config.HotKey.UploadKey = "Alt+C"
   }
@@ -122,17 +374,81 @@ func ServerConfigRead(configFile string) (*ServerConfig, error) {
     config.Log.LogLevel = "info"
   }
 
-  if config.MaxMsgSize == 0 {
-    config.MaxMsgSize = 10 * 1024 * 1024
+  if config.Log.Format == "" {
+    config.Log.Format = "text"
+  }
+
+  if config.Log.MaxSize == 0 {
+    config.Log.MaxSize = 100
   }
 
-  if config.Session.Key == "" {
-    config.Session.Key = "90po()PO12wq!@WQ"
+  if config.Log.MaxAge == 0 {
+    config.Log.MaxAge = 30
+  }
+
+  if config.MaxMsgSize == 0 {
+    config.MaxMsgSize = 10 * 1024 * 1024
   }
 
   if config.Session.MaxAge == 0 {
     config.Session.MaxAge = 3600
   }
 
+  if len(config.OIDC.Scopes) == 0 {
+    config.OIDC.Scopes = []string{"openid", "profile", "email"}
+  }
+
+  if config.OIDC.UsernameClaim == "" {
+    config.OIDC.UsernameClaim = "preferred_username"
+  }
+
+  if config.AuthBackend == "" {
+    config.AuthBackend = "local"
+  }
+
+  if config.LDAP.UserFilter == "" {
+    config.LDAP.UserFilter = "(uid=%s)"
+  }
+
+  if config.LDAP.GroupFilter == "" {
+    config.LDAP.GroupFilter = "(member=%s)"
+  }
+
+  if config.LDAP.CacheTTL == 0 {
+    config.LDAP.CacheTTL = 300
+  }
+
+  if config.AuthLimit.MaxAttempts == 0 {
+    config.AuthLimit.MaxAttempts = 5
+  }
+
+  if config.AuthLimit.Window == 0 {
+    config.AuthLimit.Window = 300
+  }
+
+  if config.AuthLimit.Lockout == 0 {
+    config.AuthLimit.Lockout = 60
+  }
+
+  if config.AuthLimit.MaxLockout == 0 {
+    config.AuthLimit.MaxLockout = 3600
+  }
+
+  if config.ClientAuth.Mode == "" {
+    config.ClientAuth.Mode = "none"
+  }
+
+  if config.Shutdown.Timeout == 0 {
+    config.Shutdown.Timeout = 10
+  }
+
+  if config.Shutdown.ReconnectDelay == 0 {
+    config.Shutdown.ReconnectDelay = 5
+  }
+
+  if config.Limits.Burst == 0 {
+    config.Limits.Burst = config.Limits.Rate
+  }
+
   return &config, nil
 }
@@ -1,8 +1,11 @@
 package utils
 
 import (
+  "context"
   "database/sql"
   "errors"
+  "strings"
+  "time"
 
   _ "github.com/mattn/go-sqlite3"
 )
@@ -12,11 +15,17 @@ type ClipContentInfo struct {
   Username  string
   Content   string
   Timestamp string
+
+  // channel of the clip, the clipboard of the user if empty
+  Channel string
 }
 
 type DBInfo struct {
   dbFile string
   conn   *sql.DB
+
+  // latency observer of the database operations, optional
+  observer func(operation string, d time.Duration)
 }
 
 //InitDB init sqlite database with specify file
@@ -39,6 +48,26 @@ func (db *DBInfo) Close() {
   }
 }
 
+// Ping check the database connection is alive
+func (db *DBInfo) Ping(ctx context.Context) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  return db.conn.PingContext(ctx)
+}
+
+// SetObserver set the latency observer of the database operations
+func (db *DBInfo) SetObserver(observer func(operation string, d time.Duration)) {
+  db.observer = observer
+}
+
+func (db *DBInfo) observe(operation string, start time.Time) {
+  if db.observer != nil {
+    db.observer(operation, time.Since(start))
+  }
+}
+
 func (db *DBInfo) createSQL(sql string) error {
   if db.conn == nil {
     return errors.New("sqlite is not init")
@@ -88,6 +117,8 @@ func (db *DBInfo) GetUserByName(username string) *AuthConfig {
     return nil
   }
 
+  defer db.observe("get_user", time.Now())
+
   auth := AuthConfig{}
   err := db.conn.QueryRow("SELECT username, password FROM userinfo WHERE username = ?", username).Scan(&auth.User, &auth.Password)
   if err != nil {
@@ -152,6 +183,14 @@ func (db *DBInfo) InsertClipContent(content *ClipContentInfo) error {
     return errors.New("sqlite is not init")
   }
 
+  defer db.observe("insert_content", time.Now())
+
+  if content.Channel != "" {
+    _, err := db.conn.Exec("REPLACE INTO channelcontent(channel, clientid, username, content) values(?, ?, ?, ?)",
+      content.Channel, content.ClientID, content.Username, content.Content)
+    return err
+  }
+
   stmt, err := db.conn.Prepare("REPLACE INTO contentinfo(clientid, username, content) values(?, ?, ?)")
   if err != nil {
     return err
@@ -167,8 +206,10 @@ func (db *DBInfo) GetClipContentByName(username string) string {
     return ""
   }
 
+  defer db.observe("get_content", time.Now())
+
   var content string
-  err := db.conn.QueryRow("SELECT content FROM contentinfo WHERE username = ? ORDER BY timestamp DESC", username).Scan(&content)
+  err := db.conn.QueryRow("SELECT content FROM contentinfo WHERE username = ? ORDER BY timestamp DESC, id DESC", username).Scan(&content)
   if err != nil {
     return ""
   } else {
@@ -182,7 +223,7 @@ func (db *DBInfo) GetClipContentByID(clientid string) string {
   }
 
   var content string
-  err := db.conn.QueryRow("SELECT content FROM contentinfo WHERE clientid = ? ORDER BY timestamp DESC", clientid).Scan(&content)
+  err := db.conn.QueryRow("SELECT content FROM contentinfo WHERE clientid = ? ORDER BY timestamp DESC, id DESC", clientid).Scan(&content)
   if err != nil {
     return ""
   } else {
@@ -195,6 +236,8 @@ func (db *DBInfo) GetClipContents() []ClipContentInfo {
     return nil
   }
 
+  defer db.observe("get_contents", time.Now())
+
   rows, err := db.conn.Query("SELECT clientid, username, content, timestamp FROM contentinfo;")
   if err != nil {
     return nil
@@ -214,12 +257,542 @@ func (db *DBInfo) GetClipContents() []ClipContentInfo {
   return clips
 }
 
+// CreateChannelContentTable latest clip of each device in the channels
+func (db *DBInfo) CreateChannelContentTable() error {
+  sql_table := `
+    CREATE TABLE IF NOT EXISTS channelcontent(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        channel VARCHAR(64) NOT NULL,
+        clientid VARCHAR(64) NOT NULL,
+        username VARCHAR(64) NOT NULL,
+        content VARCHAR(64) NOT NULL,
+        timestamp DEFAULT (STRFTIME('%Y-%m-%d %H:%M:%f', 'now', 'localtime')),
+        UNIQUE (channel, clientid, username)
+    );
+    `
+
+  return db.createSQL(sql_table)
+}
+
+// GetChannelContent return the latest clip of the channel
+func (db *DBInfo) GetChannelContent(channel string) string {
+  if db.conn == nil {
+    return ""
+  }
+
+  defer db.observe("get_channel_content", time.Now())
+
+  var content string
+  err := db.conn.QueryRow("SELECT content FROM channelcontent WHERE channel = ? ORDER BY timestamp DESC, id DESC", channel).Scan(&content)
+  if err != nil {
+    return ""
+  }
+
+  return content
+}
+
+// GetChannelContents return the latest clip of each device in the channel, newest first
+func (db *DBInfo) GetChannelContents(channel string) []ClipContentInfo {
+  if db.conn == nil {
+    return nil
+  }
+
+  defer db.observe("get_channel_contents", time.Now())
+
+  rows, err := db.conn.Query("SELECT clientid, username, content, timestamp FROM channelcontent WHERE channel = ? ORDER BY timestamp DESC, id DESC", channel)
+  if err != nil {
+    return nil
+  }
+  defer rows.Close()
+
+  var clips []ClipContentInfo
+  for rows.Next() {
+    clip := ClipContentInfo{Channel: channel}
+    if err := rows.Scan(&clip.ClientID, &clip.Username, &clip.Content, &clip.Timestamp); err != nil {
+      continue
+    }
+    clips = append(clips, clip)
+  }
+
+  return clips
+}
+
+// GetStorageUsage return the bytes of the clips stored by the user, except the clip
+// replaced by the next insert of the client to the channel, or to its clipboard if empty
+func (db *DBInfo) GetStorageUsage(username string, channel string, clientid string) (int64, error) {
+  if db.conn == nil {
+    return 0, errors.New("sqlite is not init")
+  }
+
+  defer db.observe("get_storage_usage", time.Now())
+
+  var usage int64
+  err := db.conn.QueryRow(`SELECT
+      (SELECT IFNULL(SUM(LENGTH(content)), 0) FROM contentinfo WHERE username = ? AND NOT (? = '' AND clientid = ?)) +
+      (SELECT IFNULL(SUM(LENGTH(content)), 0) FROM channelcontent WHERE username = ? AND NOT (channel = ? AND clientid = ?))`,
+    username, channel, clientid, username, channel, clientid).Scan(&usage)
+
+  return usage, err
+}
+
 func (db *DBInfo) VacuumDB() error {
   if db.conn == nil {
     return nil
   }
 
+  defer db.observe("vacuum", time.Now())
+
   _, err := db.conn.Exec("VACUUM")
 
   return err
 }
+
+// TwoFactorInfo TOTP two-factor state of a user
+type TwoFactorInfo struct {
+  Username string
+  Secret   string
+  Enabled  bool
+  Required bool
+}
+
+func (db *DBInfo) CreateTwoFactorTable() error {
+
+  // create two factor and recovery code tables if not exist
+  sql_table := `
+    CREATE TABLE IF NOT EXISTS twofactor(
+        uid INTEGER PRIMARY KEY AUTOINCREMENT,
+        username VARCHAR(64) UNIQUE NOT NULL,
+        secret VARCHAR(64) NOT NULL DEFAULT '',
+        enabled INTEGER NOT NULL DEFAULT 0,
+        required INTEGER NOT NULL DEFAULT 0,
+        laststep INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE TABLE IF NOT EXISTS recoverycode(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username VARCHAR(64) NOT NULL,
+        code VARCHAR(64) NOT NULL,
+        used INTEGER NOT NULL DEFAULT 0
+    );
+    `
+  return db.createSQL(sql_table)
+}
+
+func (db *DBInfo) GetTwoFactor(username string) *TwoFactorInfo {
+  if db.conn == nil {
+    return nil
+  }
+
+  defer db.observe("get_twofactor", time.Now())
+
+  info := TwoFactorInfo{}
+  err := db.conn.QueryRow("SELECT username, secret, enabled, required FROM twofactor WHERE username = ?", username).Scan(&info.Username, &info.Secret, &info.Enabled, &info.Required)
+  if err != nil {
+    return nil
+  } else {
+    return &info
+  }
+}
+
+// SetTwoFactorSecret store a new secret for enrollment, two factor stays disabled until EnableTwoFactor
+func (db *DBInfo) SetTwoFactorSecret(username string, secret string) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  _, err := db.conn.Exec(`INSERT INTO twofactor(username, secret, enabled) VALUES(?, ?, 0)
+    ON CONFLICT(username) DO UPDATE SET secret = excluded.secret, enabled = 0`, username, secret)
+  return err
+}
+
+// EnableTwoFactor enable two factor and replace the recovery codes of the user
+func (db *DBInfo) EnableTwoFactor(username string, recoveryCodes []string) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  tx, err := db.conn.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  _, err = tx.Exec("UPDATE twofactor SET enabled = 1 WHERE username = ? AND secret != ''", username)
+  if err != nil {
+    return err
+  }
+
+  _, err = tx.Exec("DELETE FROM recoverycode WHERE username = ?", username)
+  if err != nil {
+    return err
+  }
+
+  for _, code := range recoveryCodes {
+    _, err = tx.Exec("INSERT INTO recoverycode(username, code) VALUES(?, ?)", username, HashSecret(code))
+    if err != nil {
+      return err
+    }
+  }
+
+  return tx.Commit()
+}
+
+// DisableTwoFactor clear the secret and recovery codes, the required flag is kept
+func (db *DBInfo) DisableTwoFactor(username string) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  _, err := db.conn.Exec("UPDATE twofactor SET secret = '', enabled = 0 WHERE username = ?", username)
+  if err != nil {
+    return err
+  }
+
+  _, err = db.conn.Exec("DELETE FROM recoverycode WHERE username = ?", username)
+  return err
+}
+
+func (db *DBInfo) SetTwoFactorRequired(username string, required bool) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  _, err := db.conn.Exec(`INSERT INTO twofactor(username, required) VALUES(?, ?)
+    ON CONFLICT(username) DO UPDATE SET required = excluded.required`, username, required)
+  return err
+}
+
+// UseTwoFactorStep record the time step of an accepted TOTP code, return false if a code of
+// this step or a later one was accepted before
+func (db *DBInfo) UseTwoFactorStep(username string, step int64) bool {
+  if db.conn == nil {
+    return false
+  }
+
+  res, err := db.conn.Exec("UPDATE twofactor SET laststep = ? WHERE username = ? AND laststep < ?", step, username, step)
+  if err != nil {
+    return false
+  }
+
+  n, err := res.RowsAffected()
+  return err == nil && n > 0
+}
+
+// UseRecoveryCode mark the recovery code as used, return false if it is invalid or already used
+func (db *DBInfo) UseRecoveryCode(username string, code string) bool {
+  if db.conn == nil {
+    return false
+  }
+
+  res, err := db.conn.Exec("UPDATE recoverycode SET used = 1 WHERE username = ? AND code = ? AND used = 0", username, HashSecret(code))
+  if err != nil {
+    return false
+  }
+
+  n, err := res.RowsAffected()
+  return err == nil && n > 0
+}
+
+func (db *DBInfo) CreateOIDCLinkTable() error {
+
+  // create single sign-on link table if not exist
+  sql_table := `
+    CREATE TABLE IF NOT EXISTS oidclink(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        issuer VARCHAR(256) NOT NULL,
+        subject VARCHAR(256) NOT NULL,
+        username VARCHAR(64) NOT NULL,
+        UNIQUE (issuer, subject)
+    );
+    `
+  return db.createSQL(sql_table)
+}
+
+// GetOIDCLink return the user linked to the single sign-on identity, empty if not linked
+func (db *DBInfo) GetOIDCLink(issuer string, subject string) string {
+  if db.conn == nil {
+    return ""
+  }
+
+  defer db.observe("get_oidclink", time.Now())
+
+  var username string
+  err := db.conn.QueryRow("SELECT username FROM oidclink WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&username)
+  if err != nil {
+    return ""
+  }
+
+  return username
+}
+
+// LinkOIDC link the single sign-on identity to the user
+func (db *DBInfo) LinkOIDC(issuer string, subject string, username string) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  _, err := db.conn.Exec("INSERT INTO oidclink(issuer, subject, username) VALUES(?, ?, ?)", issuer, subject, username)
+  return err
+}
+
+// CreateTables create all tables if not exist
+func (db *DBInfo) CreateTables() error {
+  creators := []func() error{
+    db.CreateUserInfoTable,
+    db.CreateContentInfoTable,
+    db.CreateChannelContentTable,
+    db.CreateTwoFactorTable,
+    db.CreateAPITokenTable,
+    db.CreateAuditTable,
+    db.CreateOIDCLinkTable,
+  }
+
+  for _, create := range creators {
+    if err := create(); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// APITokenInfo personal API token, only the hash of the token is stored
+type APITokenInfo struct {
+  ID       int64
+  Username string
+  Name     string
+  Scope    string
+  Created  string
+  Expires  int64
+  LastUsed string
+}
+
+// Expired check whether the token is expired, zero expires means never
+func (t *APITokenInfo) Expired() bool {
+  return t.Expires != 0 && time.Now().Unix() > t.Expires
+}
+
+// Allows check whether the token scope covers the required scope
+func (t *APITokenInfo) Allows(scope string) bool {
+  return ScopeAllows(t.Scope, scope)
+}
+
+func (db *DBInfo) CreateAPITokenTable() error {
+
+  // create api token table if not exist
+  sql_table := `
+    CREATE TABLE IF NOT EXISTS apitoken(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username VARCHAR(64) NOT NULL,
+        name VARCHAR(64) NOT NULL,
+        token VARCHAR(64) UNIQUE NOT NULL,
+        scope VARCHAR(16) NOT NULL,
+        created DEFAULT (STRFTIME('%Y-%m-%d %H:%M:%f', 'now', 'localtime')),
+        expires INTEGER NOT NULL DEFAULT 0,
+        lastused VARCHAR(32) NOT NULL DEFAULT '',
+        UNIQUE (username, name)
+    );
+    `
+  return db.createSQL(sql_table)
+}
+
+// InsertAPIToken store the hash of a new token, return the token id
+func (db *DBInfo) InsertAPIToken(token *APITokenInfo, secret string) (int64, error) {
+  if db.conn == nil {
+    return 0, errors.New("sqlite is not init")
+  }
+
+  res, err := db.conn.Exec("INSERT INTO apitoken(username, name, token, scope, expires) VALUES(?, ?, ?, ?, ?)",
+    token.Username, token.Name, HashSecret(secret), token.Scope, token.Expires)
+  if err != nil {
+    return 0, err
+  }
+
+  return res.LastInsertId()
+}
+
+// GetAPIToken find the token by its secret and update the last used time
+func (db *DBInfo) GetAPIToken(secret string) *APITokenInfo {
+  if db.conn == nil {
+    return nil
+  }
+
+  defer db.observe("get_token", time.Now())
+
+  token := APITokenInfo{}
+  err := db.conn.QueryRow("SELECT id, username, name, scope, created, expires, lastused FROM apitoken WHERE token = ?", HashSecret(secret)).
+    Scan(&token.ID, &token.Username, &token.Name, &token.Scope, &token.Created, &token.Expires, &token.LastUsed)
+  if err != nil {
+    return nil
+  }
+
+  db.conn.Exec("UPDATE apitoken SET lastused = STRFTIME('%Y-%m-%d %H:%M:%f', 'now', 'localtime') WHERE id = ?", token.ID)
+
+  return &token
+}
+
+func (db *DBInfo) GetAPITokens(username string) []APITokenInfo {
+  if db.conn == nil {
+    return nil
+  }
+
+  rows, err := db.conn.Query("SELECT id, username, name, scope, created, expires, lastused FROM apitoken WHERE username = ? ORDER BY id", username)
+  if err != nil {
+    return nil
+  }
+  defer rows.Close()
+
+  var tokens []APITokenInfo
+  for rows.Next() {
+    token := APITokenInfo{}
+    err = rows.Scan(&token.ID, &token.Username, &token.Name, &token.Scope, &token.Created, &token.Expires, &token.LastUsed)
+    if err != nil {
+      continue
+    } else {
+      tokens = append(tokens, token)
+    }
+  }
+
+  return tokens
+}
+
+// DeleteAPIToken revoke the token of the user, return false if not found
+func (db *DBInfo) DeleteAPIToken(username string, id int64) bool {
+  if db.conn == nil {
+    return false
+  }
+
+  res, err := db.conn.Exec("DELETE FROM apitoken WHERE username = ? AND id = ?", username, id)
+  if err != nil {
+    return false
+  }
+
+  n, err := res.RowsAffected()
+  return err == nil && n > 0
+}
+
+// AuditInfo security or clipboard event, clipboard content is never recorded
+type AuditInfo struct {
+  ID        int64  `json:"id"`
+  Timestamp string `json:"timestamp"`
+  Event     string `json:"event"`
+  Username  string `json:"username"`
+  ClientID  string `json:"client_id,omitempty"`
+  RemoteIP  string `json:"remote_ip,omitempty"`
+  Success   bool   `json:"success"`
+  Detail    string `json:"detail,omitempty"`
+}
+
+// AuditFilter conditions of the audit query, empty conditions are ignored
+type AuditFilter struct {
+  Event    string
+  Username string
+  ClientID string
+  RemoteIP string
+
+  // "2006-01-02 15:04:05" local time, since is inclusive and until is exclusive
+  Since string
+  Until string
+
+  // nil means both
+  Success *bool
+
+  // zero means no limit
+  Limit int
+}
+
+func (db *DBInfo) CreateAuditTable() error {
+
+  // create audit table if not exist
+  sql_table := `
+    CREATE TABLE IF NOT EXISTS audit(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        timestamp DEFAULT (STRFTIME('%Y-%m-%d %H:%M:%f', 'now', 'localtime')),
+        event VARCHAR(32) NOT NULL,
+        username VARCHAR(64) NOT NULL DEFAULT '',
+        clientid VARCHAR(64) NOT NULL DEFAULT '',
+        remoteip VARCHAR(64) NOT NULL DEFAULT '',
+        success INTEGER NOT NULL DEFAULT 0,
+        detail TEXT NOT NULL DEFAULT ''
+    );
+    CREATE INDEX IF NOT EXISTS audit_username ON audit(username, id);
+    `
+  return db.createSQL(sql_table)
+}
+
+func (db *DBInfo) InsertAudit(audit *AuditInfo) error {
+  if db.conn == nil {
+    return errors.New("sqlite is not init")
+  }
+
+  defer db.observe("insert_audit", time.Now())
+
+  _, err := db.conn.Exec("INSERT INTO audit(event, username, clientid, remoteip, success, detail) VALUES(?, ?, ?, ?, ?, ?)",
+    audit.Event, audit.Username, audit.ClientID, audit.RemoteIP, audit.Success, audit.Detail)
+  return err
+}
+
+// GetAudits return the matched audit records, newest first
+func (db *DBInfo) GetAudits(filter *AuditFilter) ([]AuditInfo, error) {
+  if db.conn == nil {
+    return nil, errors.New("sqlite is not init")
+  }
+
+  defer db.observe("get_audits", time.Now())
+
+  var conds []string
+  var args []interface{}
+  add := func(cond string, arg interface{}) {
+    conds = append(conds, cond)
+    args = append(args, arg)
+  }
+
+  if filter.Event != "" {
+    add("event = ?", filter.Event)
+  }
+  if filter.Username != "" {
+    add("username = ?", filter.Username)
+  }
+  if filter.ClientID != "" {
+    add("clientid = ?", filter.ClientID)
+  }
+  if filter.RemoteIP != "" {
+    add("remoteip = ?", filter.RemoteIP)
+  }
+  if filter.Since != "" {
+    add("timestamp >= ?", filter.Since)
+  }
+  if filter.Until != "" {
+    add("timestamp < ?", filter.Until)
+  }
+  if filter.Success != nil {
+    add("success = ?", *filter.Success)
+  }
+
+  query := "SELECT id, timestamp, event, username, clientid, remoteip, success, detail FROM audit"
+  if len(conds) > 0 {
+    query += " WHERE " + strings.Join(conds, " AND ")
+  }
+  query += " ORDER BY id DESC"
+  if filter.Limit > 0 {
+    query += " LIMIT ?"
+    args = append(args, filter.Limit)
+  }
+
+  rows, err := db.conn.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var audits []AuditInfo
+  for rows.Next() {
+    audit := AuditInfo{}
+    err = rows.Scan(&audit.ID, &audit.Timestamp, &audit.Event, &audit.Username, &audit.ClientID, &audit.RemoteIP, &audit.Success, &audit.Detail)
+    if err != nil {
+      return nil, err
+    }
+    audits = append(audits, audit)
+  }
+
+  return audits, rows.Err()
+}
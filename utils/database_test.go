@@ -89,3 +89,204 @@ func TestContentDB(t *testing.T) {
     t.Fatal("Vacuum database error:", err)
   }
 }
+
+func TestTwoFactorDB(t *testing.T) {
+  db := InitDB("test-twofactor.sqlite3")
+  if db == nil {
+    t.Fatal("Failed to init sqlite.")
+  }
+  defer os.Remove("test-twofactor.sqlite3")
+  defer db.Close()
+
+  err := db.CreateTables()
+  if err != nil {
+    t.Fatal("Failed to create tables:", err)
+  }
+
+  if db.GetTwoFactor("u1") != nil {
+    t.Fatal("Two factor should not exist.")
+  }
+
+  err = db.SetTwoFactorRequired("u1", true)
+  if err != nil {
+    t.Fatal("Failed to set two factor required:", err)
+  }
+
+  err = db.SetTwoFactorSecret("u1", "SECRET")
+  if err != nil {
+    t.Fatal("Failed to set two factor secret:", err)
+  }
+
+  tf := db.GetTwoFactor("u1")
+  if tf == nil || tf.Enabled || !tf.Required || tf.Secret != "SECRET" {
+    t.Fatal("Two factor get failed:", tf)
+  }
+
+  err = db.EnableTwoFactor("u1", []string{"code1", "code2"})
+  if err != nil {
+    t.Fatal("Failed to enable two factor:", err)
+  }
+
+  if tf = db.GetTwoFactor("u1"); !tf.Enabled {
+    t.Fatal("Two factor should be enabled.")
+  }
+
+  if !db.UseRecoveryCode("u1", "code1") || db.UseRecoveryCode("u1", "code1") || db.UseRecoveryCode("u1", "code3") {
+    t.Fatal("Recovery code check failed.")
+  }
+
+  // a time step is accepted once, the earlier ones never again
+  if !db.UseTwoFactorStep("u1", 100) || db.UseTwoFactorStep("u1", 100) || db.UseTwoFactorStep("u1", 99) || !db.UseTwoFactorStep("u1", 101) {
+    t.Fatal("Time step check failed.")
+  }
+
+  err = db.DisableTwoFactor("u1")
+  if err != nil {
+    t.Fatal("Failed to disable two factor:", err)
+  }
+
+  tf = db.GetTwoFactor("u1")
+  if tf.Enabled || tf.Secret != "" || !tf.Required || db.UseRecoveryCode("u1", "code2") {
+    t.Fatal("Two factor disable failed:", tf)
+  }
+}
+
+func TestAPITokenDB(t *testing.T) {
+  db := InitDB("test-token.sqlite3")
+  if db == nil {
+    t.Fatal("Failed to init sqlite.")
+  }
+  defer os.Remove("test-token.sqlite3")
+  defer db.Close()
+
+  err := db.CreateTables()
+  if err != nil {
+    t.Fatal("Failed to create tables:", err)
+  }
+
+  id, err := db.InsertAPIToken(&APITokenInfo{Username: "u1", Name: "phone", Scope: ScopeRead}, "cbt_secret1")
+  if err != nil {
+    t.Fatal("Failed to insert token:", err)
+  }
+
+  _, err = db.InsertAPIToken(&APITokenInfo{Username: "u1", Name: "phone", Scope: ScopeWrite}, "cbt_secret2")
+  if err == nil {
+    t.Fatal("Token name should be unique per user.")
+  }
+
+  _, err = db.InsertAPIToken(&APITokenInfo{Username: "u1", Name: "old", Scope: ScopeReadWrite, Expires: 1}, "cbt_secret3")
+  if err != nil {
+    t.Fatal("Failed to insert token:", err)
+  }
+
+  token := db.GetAPIToken("cbt_secret1")
+  if token == nil || token.ID != id || token.Username != "u1" || token.Expired() || !token.Allows(ScopeRead) || token.Allows(ScopeWrite) {
+    t.Fatal("Token get failed:", token)
+  }
+
+  if db.GetAPIToken("cbt_unknown") != nil {
+    t.Fatal("Unknown token should not be found.")
+  }
+
+  if token = db.GetAPIToken("cbt_secret3"); token == nil || !token.Expired() {
+    t.Fatal("Token should be expired:", token)
+  }
+
+  if len(db.GetAPITokens("u1")) != 2 || len(db.GetAPITokens("u2")) != 0 {
+    t.Fatal("Token list failed.")
+  }
+
+  if db.DeleteAPIToken("u2", id) || !db.DeleteAPIToken("u1", id) || db.GetAPIToken("cbt_secret1") != nil {
+    t.Fatal("Token delete failed.")
+  }
+}
+
+func TestAuditDB(t *testing.T) {
+  db := InitDB("test-audit.sqlite3")
+  if db == nil {
+    t.Fatal("Failed to init sqlite.")
+  }
+  defer os.Remove("test-audit.sqlite3")
+  defer db.Close()
+
+  err := db.CreateTables()
+  if err != nil {
+    t.Fatal("Failed to create tables:", err)
+  }
+
+  records := []AuditInfo{
+    {Event: "login", Username: "u1", RemoteIP: "10.0.0.1", Success: false, Detail: "password"},
+    {Event: "login", Username: "u1", RemoteIP: "10.0.0.1", Success: true, Detail: "password"},
+    {Event: "clipboard.push", Username: "u1", ClientID: "c1", Success: true},
+    {Event: "login", Username: "u2", RemoteIP: "10.0.0.2", Success: true},
+  }
+  for i := range records {
+    if err = db.InsertAudit(&records[i]); err != nil {
+      t.Fatal("Failed to insert audit:", err)
+    }
+  }
+
+  audits, err := db.GetAudits(&AuditFilter{})
+  if err != nil || len(audits) != 4 || audits[0].Username != "u2" {
+    t.Fatal("Audits should be returned newest first:", audits, err)
+  }
+
+  failed := false
+  audits, _ = db.GetAudits(&AuditFilter{Event: "login", Username: "u1", Success: &failed})
+  if len(audits) != 1 || audits[0].Success || audits[0].RemoteIP != "10.0.0.1" {
+    t.Fatal("Failed login of u1 not matched:", audits)
+  }
+
+  audits, _ = db.GetAudits(&AuditFilter{ClientID: "c1"})
+  if len(audits) != 1 || audits[0].Event != "clipboard.push" {
+    t.Fatal("Client audit not matched:", audits)
+  }
+
+  audits, _ = db.GetAudits(&AuditFilter{Limit: 2, Since: "2000-01-01 00:00:00"})
+  if len(audits) != 2 {
+    t.Fatal("Limit not applied:", audits)
+  }
+
+  audits, _ = db.GetAudits(&AuditFilter{Until: "2000-01-01 00:00:00"})
+  if len(audits) != 0 {
+    t.Fatal("Until not applied:", audits)
+  }
+}
+
+func TestStorageUsage(t *testing.T) {
+  db := InitDB("test-usage.sqlite3")
+  if db == nil {
+    t.Fatal("Failed to init sqlite.")
+  }
+  defer os.Remove("test-usage.sqlite3")
+  defer db.Close()
+
+  if err := db.CreateTables(); err != nil {
+    t.Fatal("Failed to create tables:", err)
+  }
+
+  contents := []ClipContentInfo{
+    {ClientID: "11", Username: "u1", Content: "1234"},
+    {ClientID: "12", Username: "u1", Content: "12345678"},
+    {ClientID: "11", Username: "u1", Content: "12", Channel: "team"},
+    {ClientID: "21", Username: "u2", Content: "1234"},
+  }
+
+  for i := range contents {
+    if err := db.InsertClipContent(&contents[i]); err != nil {
+      t.Fatal("Failed to insert content:", err)
+    }
+  }
+
+  if usage, err := db.GetStorageUsage("u1", "", "13"); err != nil || usage != 14 {
+    t.Fatal("Usage should count the clipboard and channel clips of the user:", usage, err)
+  }
+
+  // the replaced clip is not counted
+  if usage, _ := db.GetStorageUsage("u1", "", "12"); usage != 6 {
+    t.Fatal("Usage should exclude the replaced clip:", usage)
+  }
+  if usage, _ := db.GetStorageUsage("u1", "team", "11"); usage != 12 {
+    t.Fatal("Usage should exclude the replaced channel clip:", usage)
+  }
+}
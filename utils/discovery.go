@@ -0,0 +1,151 @@
+package utils
+
+import (
+  "net"
+  "sort"
+  "strings"
+)
+
+// Version of the server and the client, set by -ldflags "-X clipboard-remote/utils.Version=x.y.z"
+var Version = "dev"
+
+// mDNS service of the server
+const (
+  DiscoveryService = "_cliphttp._tcp"
+  DiscoveryDomain  = "local."
+
+  // version of the TXT records
+  discoveryTXTVersion = "1"
+)
+
+// DiscoveryInfo identity of the server announced by the mDNS TXT records
+type DiscoveryInfo struct {
+  Version string
+  Name    string
+
+  // websocket path and scheme of the server
+  Path   string
+  Scheme string
+
+  // sha256 fingerprints of the server and its CA certificate
+  Fingerprint   string
+  CAFingerprint string
+}
+
+// TXT return the TXT records of the announcement
+func (d *DiscoveryInfo) TXT() []string {
+  txt := []string{
+    "txtv=" + discoveryTXTVersion,
+    "version=" + d.Version,
+    "name=" + d.Name,
+    "path=" + d.Path,
+    "scheme=" + d.Scheme,
+  }
+
+  if d.Fingerprint != "" {
+    txt = append(txt, "fp="+d.Fingerprint)
+  }
+
+  if d.CAFingerprint != "" {
+    txt = append(txt, "cafp="+d.CAFingerprint)
+  }
+
+  return txt
+}
+
+// ParseDiscoveryTXT parse the TXT records of an announcement, unknown keys are ignored
+func ParseDiscoveryTXT(txt []string) *DiscoveryInfo {
+  d := &DiscoveryInfo{}
+  for _, record := range txt {
+    key, value, _ := strings.Cut(record, "=")
+    switch key {
+    case "version":
+      d.Version = value
+    case "name":
+      d.Name = value
+    case "path":
+      d.Path = value
+    case "scheme":
+      d.Scheme = value
+    case "fp":
+      d.Fingerprint = NormalizeFingerprint(value)
+    case "cafp":
+      d.CAFingerprint = NormalizeFingerprint(value)
+    }
+  }
+
+  return d
+}
+
+// DiscoveredServer a server answering the discovery
+type DiscoveredServer struct {
+  Instance string
+  Host     string
+  Port     int
+  Info     *DiscoveryInfo
+}
+
+// NewDiscoveredServer return the server of an answer, the host is the first IPv4 address,
+// then a routable IPv6 one. Nil if the answer has no usable address.
+func NewDiscoveredServer(instance string, port int, ipv4 []net.IP, ipv6 []net.IP, txt []string) *DiscoveredServer {
+  host := ""
+  for _, ip := range ipv4 {
+    if !ip.IsUnspecified() {
+      host = ip.String()
+      break
+    }
+  }
+
+  // link-local addresses need the zone of the interface, which is not announced
+  if host == "" {
+    for _, ip := range ipv6 {
+      if !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() {
+        host = ip.String()
+        break
+      }
+    }
+  }
+
+  if host == "" || port == 0 {
+    return nil
+  }
+
+  return &DiscoveredServer{
+    Instance: instance,
+    Host:     host,
+    Port:     port,
+    Info:     ParseDiscoveryTXT(txt),
+  }
+}
+
+// matchName return whether the server is the named one
+func (s *DiscoveredServer) matchName(name string) bool {
+  return name == "" || s.Instance == name || s.Info.Name == name
+}
+
+// matchFingerprint return whether the server or its CA has the fingerprint
+func (s *DiscoveredServer) matchFingerprint(fingerprint string) bool {
+  fp := NormalizeFingerprint(fingerprint)
+  return fp == "" || s.Info.Fingerprint == fp || s.Info.CAFingerprint == fp
+}
+
+// SelectServer pick the server matching the name and the fingerprint, the empty filters
+// match any server. The instance names are sorted so the choice is stable.
+func SelectServer(servers []*DiscoveredServer, name string, fingerprint string) *DiscoveredServer {
+  var matched []*DiscoveredServer
+  for _, s := range servers {
+    if s.matchName(name) && s.matchFingerprint(fingerprint) {
+      matched = append(matched, s)
+    }
+  }
+
+  if len(matched) == 0 {
+    return nil
+  }
+
+  sort.SliceStable(matched, func(i, j int) bool {
+    return matched[i].Instance < matched[j].Instance
+  })
+
+  return matched[0]
+}
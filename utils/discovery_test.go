@@ -0,0 +1,64 @@
+package utils
+
+import (
+  "net"
+  "testing"
+)
+
+func TestDiscoveryTXT(t *testing.T) {
+  info := &DiscoveryInfo{
+    Version:     "1.2.0",
+    Name:        "office",
+    Path:        "/websocket",
+    Scheme:      "https",
+    Fingerprint: "ab12",
+  }
+
+  parsed := ParseDiscoveryTXT(append(info.TXT(), "unknown=1", "broken"))
+  if *parsed != *info {
+    t.Fatal("TXT records should round trip:", parsed)
+  }
+
+  // older servers announce placeholders only
+  if old := ParseDiscoveryTXT([]string{"txtv=0", "lo=1", "la=2"}); old.Path != "" || old.Fingerprint != "" {
+    t.Fatal("Old records should be ignored:", old)
+  }
+}
+
+func TestSelectServer(t *testing.T) {
+  linkLocal := net.ParseIP("fe80::1")
+  if s := NewDiscoveredServer("none", 443, nil, []net.IP{linkLocal}, nil); s != nil {
+    t.Fatal("Link-local only server should be skipped:", s)
+  }
+
+  v6 := NewDiscoveredServer("home", 443, nil, []net.IP{linkLocal, net.ParseIP("fd00::2")}, []string{"name=home", "fp=AA:BB"})
+  if v6 == nil || v6.Host != "fd00::2" {
+    t.Fatal("Routable IPv6 address should be used:", v6)
+  }
+
+  v4 := NewDiscoveredServer("office", 8443, []net.IP{net.ParseIP("192.168.1.2")}, []net.IP{net.ParseIP("fd00::3")}, []string{"name=office", "cafp=cc"})
+  if v4.Host != "192.168.1.2" {
+    t.Fatal("IPv4 address should be preferred:", v4.Host)
+  }
+
+  servers := []*DiscoveredServer{v4, v6}
+  if s := SelectServer(servers, "", ""); s != v6 {
+    t.Fatal("First instance name should be picked without filters:", s)
+  }
+
+  if s := SelectServer(servers, "office", ""); s != v4 {
+    t.Fatal("Server should be picked by name:", s)
+  }
+
+  if s := SelectServer(servers, "", "aabb"); s != v6 {
+    t.Fatal("Server should be picked by fingerprint:", s)
+  }
+
+  if s := SelectServer(servers, "", "CC"); s != v4 {
+    t.Fatal("Server should be picked by CA fingerprint:", s)
+  }
+
+  if s := SelectServer(servers, "office", "aabb"); s != nil {
+    t.Fatal("No server should match both filters:", s)
+  }
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
   "bytes"
+  "encoding/json"
   "fmt"
   "path/filepath"
   "runtime"
@@ -12,8 +13,26 @@ import (
   "github.com/sirupsen/logrus"
 )
 
+// fields written on every json line, empty if the entry does not carry them
+const (
+  LogFieldComponent  = "component"
+  LogFieldClientID   = "client_id"
+  LogFieldUsername   = "username"
+  LogFieldAction     = "action"
+  LogFieldRemoteAddr = "remote_addr"
+  LogFieldRequestID  = "request_id"
+)
+
+var logFields = []string{LogFieldClientID, LogFieldUsername, LogFieldAction, LogFieldRemoteAddr, LogFieldRequestID}
+
 // Formatter - logrus formatter, implements logrus.Formatter
 type Formatter struct {
+  // JSON - one json object per line for log collectors instead of the bracketed format
+  JSON bool
+
+  // Component - value of the component field of the json lines
+  Component string
+
   // FieldsOrder - default: fields sorted alphabetically
   FieldsOrder []string
 
@@ -50,6 +69,10 @@ type Formatter struct {
 
 // Format an log entry
 func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+  if f.JSON {
+    return f.formatJSON(entry)
+  }
+
   levelColor := getColorByLevel(entry.Level)
 
   timestampFormat := f.TimestampFormat
@@ -126,6 +149,43 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
   return b.Bytes(), nil
 }
 
+// formatJSON format the entry as a json line with the consistent fields
+func (f *Formatter) formatJSON(entry *logrus.Entry) ([]byte, error) {
+  data := make(map[string]interface{}, len(entry.Data)+len(logFields)+5)
+  for _, field := range logFields {
+    data[field] = ""
+  }
+
+  for k, v := range entry.Data {
+    // errors are marshaled as empty objects
+    if err, ok := v.(error); ok {
+      v = err.Error()
+    }
+    data[k] = v
+  }
+
+  data[LogFieldComponent] = f.Component
+  data["time"] = entry.Time.Format(time.RFC3339Nano)
+  data["level"] = entry.Level.String()
+  if f.TrimMessages {
+    data["msg"] = strings.TrimSpace(entry.Message)
+  } else {
+    data["msg"] = strings.TrimRight(entry.Message, "\n")
+  }
+
+  if entry.HasCaller() {
+    data["caller"] = fmt.Sprintf("%s:%d", filepath.Base(entry.Caller.File), entry.Caller.Line)
+    data["func"] = entry.Caller.Function
+  }
+
+  b, err := json.Marshal(data)
+  if err != nil {
+    return nil, fmt.Errorf("failed to marshal log entry: %w", err)
+  }
+
+  return append(b, '\n'), nil
+}
+
 func (f *Formatter) writeCaller(b *bytes.Buffer, entry *logrus.Entry) {
   if entry.HasCaller() {
     if f.CustomCallerFormatter != nil {
@@ -0,0 +1,40 @@
+package utils
+
+import (
+  "encoding/json"
+  "errors"
+  "testing"
+
+  "github.com/sirupsen/logrus"
+)
+
+func TestFormatterJSON(t *testing.T) {
+  f := &Formatter{JSON: true, Component: "server"}
+
+  entry := logrus.WithFields(logrus.Fields{
+    LogFieldRequestID: "req-1",
+    "error":           errors.New("boom"),
+  })
+  entry.Message = "hello\n"
+
+  b, err := f.Format(entry)
+  if err != nil {
+    t.Fatal("Failed to format:", err)
+  }
+
+  var data map[string]interface{}
+  if err := json.Unmarshal(b, &data); err != nil {
+    t.Fatal("Line should be json:", string(b))
+  }
+
+  if data["msg"] != "hello" || data[LogFieldComponent] != "server" || data[LogFieldRequestID] != "req-1" || data["error"] != "boom" {
+    t.Fatal("Unexpected fields:", string(b))
+  }
+
+  // the consistent fields are present even if not set
+  for _, field := range logFields {
+    if _, ok := data[field]; !ok {
+      t.Fatal("Missing field:", field)
+    }
+  }
+}
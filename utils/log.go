@@ -0,0 +1,51 @@
+package utils
+
+import (
+  "io"
+  "os"
+
+  "github.com/sirupsen/logrus"
+  "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// SetupLog set the level, format and output of the standard logger. The log file is
+// rotated by size and age, stdout is used if no path is configured.
+func SetupLog(config *LogConfig, component string) {
+  // Set the report callers to true
+  logrus.SetReportCaller(true)
+  // Set the formatter to include the function name and line number
+  logrus.SetFormatter(&Formatter{
+    JSON:        config.Format == "json",
+    Component:   component,
+    HideKeys:    true,
+    CallerFirst: true,
+    NoColors:    true,
+  })
+
+  // Set the log level
+  switch config.LogLevel {
+  case "debug":
+    logrus.SetLevel(logrus.DebugLevel)
+  case "warn":
+    logrus.SetLevel(logrus.WarnLevel)
+  case "error":
+    logrus.SetLevel(logrus.ErrorLevel)
+  case "fatal":
+    logrus.SetLevel(logrus.FatalLevel)
+  default:
+    logrus.SetLevel(logrus.InfoLevel)
+  }
+
+  // Set the log file, it is opened on the first write
+  var output io.Writer = os.Stdout
+  if config.LogPath != "" {
+    output = &lumberjack.Logger{
+      Filename:   config.LogPath,
+      MaxSize:    config.MaxSize,
+      MaxAge:     config.MaxAge,
+      MaxBackups: config.MaxBackups,
+      LocalTime:  true,
+    }
+  }
+  logrus.SetOutput(output)
+}
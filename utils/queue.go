@@ -0,0 +1,225 @@
+package utils
+
+import (
+  "bufio"
+  "bytes"
+  "os"
+  "path/filepath"
+  "sync"
+
+  log "github.com/sirupsen/logrus"
+)
+
+// MessageQueue bounded queue of the messages to the server, kept while the client is
+// disconnected and saved to the queue file if configured. The file is only written while
+// the client is offline, the clips are stored in plaintext.
+type MessageQueue struct {
+  sync.Mutex
+
+  config *QueueConfig
+
+  // latest wins, a new clipboard change replaces the queued ones
+  coalesce bool
+
+  msgs []*WebsocketMessage
+  size int
+
+  // messages dropped since the last report
+  dropped int
+
+  // connected to the server, the queue is not saved
+  online bool
+
+  // the queue file has messages
+  saved bool
+
+  // signaled when a message is queued
+  ready chan struct{}
+}
+
+// NewMessageQueue return the queue with the messages left in the queue file
+func NewMessageQueue(config *QueueConfig, coalesce bool) (*MessageQueue, error) {
+  q := &MessageQueue{
+    config:   config,
+    coalesce: coalesce,
+    ready:    make(chan struct{}, 1),
+  }
+
+  if config.File == "" {
+    return q, nil
+  }
+
+  data, err := os.ReadFile(config.File)
+  if os.IsNotExist(err) {
+    return q, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  scanner := bufio.NewScanner(bytes.NewReader(data))
+  scanner.Buffer(nil, len(data)+1)
+  for scanner.Scan() {
+    msg := &WebsocketMessage{}
+    if err := msg.Decode(scanner.Bytes()); err != nil {
+      log.Warnln("Skip the broken message of the queue file:", err)
+      continue
+    }
+    q.push(msg)
+  }
+  q.saved = len(q.msgs) > 0
+
+  if q.Len() > 0 {
+    q.Wake()
+  }
+
+  return q, nil
+}
+
+// Push queue the message without blocking, the oldest messages are dropped when the
+// queue is full
+func (q *MessageQueue) Push(msg *WebsocketMessage) {
+  q.Lock()
+  q.push(msg)
+  q.save()
+  q.Unlock()
+
+  q.Wake()
+}
+
+func (q *MessageQueue) push(msg *WebsocketMessage) {
+  if q.coalesce && msg.Action == ActionClipboardChanged {
+    kept := q.msgs[:0]
+    for _, m := range q.msgs {
+      if m.Action == ActionClipboardChanged {
+        q.size -= len(m.Data)
+        continue
+      }
+      kept = append(kept, m)
+    }
+    q.msgs = kept
+  }
+
+  q.msgs = append(q.msgs, msg)
+  q.size += len(msg.Data)
+
+  // the newest message is kept even if it exceeds the size alone
+  for len(q.msgs) > 1 && (len(q.msgs) > q.config.MaxMessages || q.size > q.config.MaxBytes) {
+    q.size -= len(q.msgs[0].Data)
+    q.msgs[0] = nil
+    q.msgs = q.msgs[1:]
+    q.dropped++
+  }
+}
+
+// Peek return the oldest message, nil if the queue is empty
+func (q *MessageQueue) Peek() *WebsocketMessage {
+  q.Lock()
+  defer q.Unlock()
+
+  if len(q.msgs) == 0 {
+    return nil
+  }
+
+  return q.msgs[0]
+}
+
+// Remove remove the sent message, unless it was replaced or dropped meanwhile
+func (q *MessageQueue) Remove(msg *WebsocketMessage) {
+  q.Lock()
+  defer q.Unlock()
+
+  for i, m := range q.msgs {
+    if m == msg {
+      q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+      q.size -= len(msg.Data)
+      q.save()
+
+      // the queue saved while offline is flushed
+      if q.online && q.saved && len(q.msgs) == 0 {
+        q.clear()
+      }
+      return
+    }
+  }
+}
+
+// Len return the count of the queued messages
+func (q *MessageQueue) Len() int {
+  q.Lock()
+  defer q.Unlock()
+
+  return len(q.msgs)
+}
+
+// Dropped return the count of the messages dropped since the last call
+func (q *MessageQueue) Dropped() int {
+  q.Lock()
+  defer q.Unlock()
+
+  dropped := q.dropped
+  q.dropped = 0
+  return dropped
+}
+
+// Ready return the channel signaled when the queue should be flushed
+func (q *MessageQueue) Ready() <-chan struct{} {
+  return q.ready
+}
+
+// Wake signal the queue is ready to be flushed, e.g. after reconnecting
+func (q *MessageQueue) Wake() {
+  select {
+  case q.ready <- struct{}{}:
+  default:
+  }
+}
+
+// SetOnline set whether the client is connected, the queue is saved when it goes offline
+// and only then, the clips sent while connected are not written to the file
+func (q *MessageQueue) SetOnline(online bool) {
+  q.Lock()
+  defer q.Unlock()
+
+  if q.online == online {
+    return
+  }
+  q.online = online
+
+  if !online && len(q.msgs) > 0 {
+    q.save()
+  }
+}
+
+// save write the queued messages to the queue file while offline, replacing it at once
+func (q *MessageQueue) save() {
+  if q.config.File == "" || q.online {
+    return
+  }
+
+  var buf bytes.Buffer
+  for _, msg := range q.msgs {
+    buf.Write(msg.Encode())
+    buf.WriteByte('\n')
+  }
+
+  tmp := filepath.Join(filepath.Dir(q.config.File), "."+filepath.Base(q.config.File)+".tmp")
+  if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+    log.Errorln("Failed to save queue file:", err)
+    return
+  }
+
+  if err := os.Rename(tmp, q.config.File); err != nil {
+    log.Errorln("Failed to save queue file:", err)
+    return
+  }
+  q.saved = len(q.msgs) > 0
+}
+
+// clear remove the queue file
+func (q *MessageQueue) clear() {
+  if err := os.Remove(q.config.File); err != nil && !os.IsNotExist(err) {
+    log.Errorln("Failed to remove queue file:", err)
+    return
+  }
+  q.saved = false
+}
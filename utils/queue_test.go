@@ -0,0 +1,91 @@
+package utils
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestMessageQueue(t *testing.T) {
+  config := &QueueConfig{MaxMessages: 2, MaxBytes: 10, File: filepath.Join(t.TempDir(), "queue")}
+
+  q, err := NewMessageQueue(config, false)
+  if err != nil {
+    t.Fatal("Failed to create queue:", err)
+  }
+
+  for _, data := range []string{"a", "b", "c"} {
+    q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte(data)})
+  }
+  if q.Len() != 2 || string(q.Peek().Data) != "b" || q.Dropped() != 1 {
+    t.Fatal("Oldest message should be dropped:", q.Len(), string(q.Peek().Data))
+  }
+
+  // the size limit drops the older ones, the newest one is kept
+  q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte("0123456789abc")})
+  if q.Len() != 1 || q.Dropped() != 2 {
+    t.Fatal("Size limit should keep only the newest message:", q.Len())
+  }
+
+  // the queue file survives restarts
+  reloaded, err := NewMessageQueue(config, false)
+  if err != nil || reloaded.Len() != 1 || string(reloaded.Peek().Data) != "0123456789abc" {
+    t.Fatal("Queue should be loaded from the file:", err)
+  }
+
+  select {
+  case <-reloaded.Ready():
+  default:
+    t.Fatal("Loaded queue should be ready to flush.")
+  }
+
+  reloaded.Remove(reloaded.Peek())
+  if reloaded, _ = NewMessageQueue(config, false); reloaded.Len() != 0 {
+    t.Fatal("Sent message should be removed from the file.")
+  }
+}
+
+func TestMessageQueueOnline(t *testing.T) {
+  config := &QueueConfig{MaxMessages: 10, MaxBytes: 100, File: filepath.Join(t.TempDir(), "queue")}
+  q, _ := NewMessageQueue(config, false)
+
+  // the clips sent while connected are not written
+  q.SetOnline(true)
+  q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte("a")})
+  if _, err := os.Stat(config.File); !os.IsNotExist(err) {
+    t.Fatal("Queue should not be saved while online:", err)
+  }
+
+  // the queue is saved when the client goes offline
+  q.SetOnline(false)
+  q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte("b")})
+  if reloaded, _ := NewMessageQueue(config, false); reloaded.Len() != 2 {
+    t.Fatal("Queue should be saved while offline:", reloaded.Len())
+  }
+
+  // the file is removed once the saved queue is flushed
+  q.SetOnline(true)
+  q.Remove(q.Peek())
+  q.Remove(q.Peek())
+  if _, err := os.Stat(config.File); !os.IsNotExist(err) {
+    t.Fatal("Flushed queue file should be removed:", err)
+  }
+}
+
+func TestMessageQueueCoalesce(t *testing.T) {
+  q, _ := NewMessageQueue(&QueueConfig{MaxMessages: 10, MaxBytes: 100}, true)
+
+  q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte("a")})
+  sending := q.Peek()
+  q.Push(&WebsocketMessage{Action: ActionClipboardChanged, Data: []byte("b")})
+
+  if q.Len() != 1 || string(q.Peek().Data) != "b" || q.Dropped() != 0 {
+    t.Fatal("Latest clip should replace the queued one:", q.Len())
+  }
+
+  // the replaced message was being sent, removing it keeps the latest
+  q.Remove(sending)
+  if q.Len() != 1 {
+    t.Fatal("Latest clip should stay queued.")
+  }
+}
@@ -0,0 +1,277 @@
+package utils
+
+import (
+  "bufio"
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+
+  log "github.com/sirupsen/logrus"
+)
+
+// ErrCertMismatch the server certificate does not match the pinned or the known fingerprint
+var ErrCertMismatch = errors.New("server certificate fingerprint mismatch")
+
+// CertTrust verify the server certificates of the client connections by the CA file, the
+// pinned fingerprint or the fingerprints trusted on first use
+type CertTrust struct {
+  sync.Mutex
+
+  // CA certificates, the system ones if nil
+  roots *x509.CertPool
+
+  // pinned sha256 fingerprint of the server or its CA certificate
+  pin string
+
+  // trust on first use store, disabled if empty
+  knownFile string
+
+  // skip the verification if nothing else is configured
+  insecure bool
+
+  // client certificate for mutual TLS, nil if not configured
+  clientCert *tls.Certificate
+
+  // fingerprints announced by the discovered server, checked in addition to the configured trust
+  discovered []string
+
+  // fingerprints of the known servers by host:port
+  known map[string]string
+
+  // fingerprints of the first connections, recorded by Remember
+  seen map[string]string
+}
+
+// NewCertTrust load the CA file and the known servers of the client config
+func NewCertTrust(config *ClientConfig) (*CertTrust, error) {
+  t := &CertTrust{
+    pin:      NormalizeFingerprint(config.PinnedCertSHA256),
+    insecure: config.InsecureSkipVerify,
+    known:    map[string]string{},
+    seen:     map[string]string{},
+  }
+
+  if config.CAFile != "" {
+    b, err := os.ReadFile(config.CAFile)
+    if err != nil {
+      return nil, err
+    }
+
+    t.roots = x509.NewCertPool()
+    if !t.roots.AppendCertsFromPEM(b) {
+      return nil, fmt.Errorf("no certificate in %s", config.CAFile)
+    }
+  }
+
+  if config.ClientCert != "" || config.ClientKey != "" {
+    cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+    if err != nil {
+      return nil, err
+    }
+    t.clientCert = &cert
+  }
+
+  if config.TrustOnFirstUse && t.pin == "" {
+    t.knownFile = config.KnownServersFile
+
+    f, err := os.Open(t.knownFile)
+    if err == nil {
+      defer f.Close()
+
+      scanner := bufio.NewScanner(f)
+      for scanner.Scan() {
+        if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+          t.known[fields[0]] = NormalizeFingerprint(fields[1])
+        }
+      }
+    } else if !os.IsNotExist(err) {
+      return nil, err
+    }
+  }
+
+  if t.insecure && t.pin == "" && t.roots == nil && t.knownFile == "" {
+    log.Warnln("Server certificate verification is disabled, set pinned-cert-sha256, ca-file or trust-on-first-use instead.")
+  }
+
+  return t, nil
+}
+
+// TLSConfig return the TLS config verifying the server of the address host:port
+func (t *CertTrust) TLSConfig(host string, addr string) *tls.Config {
+  config := &tls.Config{
+    ServerName: host,
+
+    // verified by VerifyConnection
+    InsecureSkipVerify: true,
+    VerifyConnection: func(cs tls.ConnectionState) error {
+      return t.verify(addr, cs)
+    },
+  }
+
+  if t.clientCert != nil {
+    config.Certificates = []tls.Certificate{*t.clientCert}
+  }
+
+  return config
+}
+
+// SetDiscovered require the fingerprints announced by the discovered server, replacing the
+// ones of the previous discovery. The announcement is not authenticated, it only narrows the
+// configured trust and is ignored if a pin or a CA file is configured.
+func (t *CertTrust) SetDiscovered(fingerprints ...string) {
+  if t.pin != "" || t.roots != nil {
+    return
+  }
+
+  t.Lock()
+  defer t.Unlock()
+
+  t.discovered = nil
+  for _, fingerprint := range fingerprints {
+    if fingerprint != "" {
+      t.discovered = append(t.discovered, NormalizeFingerprint(fingerprint))
+    }
+  }
+}
+
+// matchFingerprint check the leaf has one of the fingerprints, or chains to a certificate
+// of the chain having it. The handshake only proves the leaf key, a CA sent along must sign
+// the leaf.
+func matchFingerprint(certs []*x509.Certificate, fingerprints ...string) bool {
+  leaf := certs[0]
+  for i, cert := range certs {
+    fingerprint := CertFingerprint(cert.Raw)
+    for _, expected := range fingerprints {
+      if fingerprint != expected {
+        continue
+      }
+
+      if i == 0 || chainsTo(leaf, certs[1:i], cert) {
+        return true
+      }
+    }
+  }
+
+  return false
+}
+
+// chainsTo check the leaf is signed by the root through the intermediates
+func chainsTo(leaf *x509.Certificate, intermediates []*x509.Certificate, root *x509.Certificate) bool {
+  opts := x509.VerifyOptions{
+    Roots:         x509.NewCertPool(),
+    Intermediates: x509.NewCertPool(),
+  }
+  opts.Roots.AddCert(root)
+  for _, cert := range intermediates {
+    opts.Intermediates.AddCert(cert)
+  }
+
+  _, err := leaf.Verify(opts)
+  return err == nil
+}
+
+// HasClientCert return whether the client authenticates by certificate
+func (t *CertTrust) HasClientCert() bool {
+  return t.clientCert != nil
+}
+
+// verify check the peer certificates of the connection to addr
+func (t *CertTrust) verify(addr string, cs tls.ConnectionState) error {
+  if len(cs.PeerCertificates) == 0 {
+    return errors.New("no server certificate")
+  }
+
+  // the discovered fingerprints change when the client discovers again
+  t.Lock()
+  discovered := t.discovered
+  t.Unlock()
+
+  // verify the chain by the CA file, or by the system CAs if nothing else is configured
+  if t.roots != nil || (t.pin == "" && t.knownFile == "" && !t.insecure) {
+    opts := x509.VerifyOptions{
+      Roots:         t.roots,
+      DNSName:       cs.ServerName,
+      Intermediates: x509.NewCertPool(),
+    }
+    for _, cert := range cs.PeerCertificates[1:] {
+      opts.Intermediates.AddCert(cert)
+    }
+
+    if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+      return err
+    }
+  }
+
+  if t.pin != "" {
+    if matchFingerprint(cs.PeerCertificates, t.pin) {
+      return nil
+    }
+
+    return ErrCertMismatch
+  }
+
+  if len(discovered) > 0 && !matchFingerprint(cs.PeerCertificates, discovered...) {
+    return fmt.Errorf("%w: %s does not match the discovered server", ErrCertMismatch, addr)
+  }
+
+  if t.knownFile == "" {
+    return nil
+  }
+
+  t.Lock()
+  defer t.Unlock()
+
+  if known, ok := t.known[addr]; ok {
+    if !matchFingerprint(cs.PeerCertificates, known) {
+      return fmt.Errorf("%w: %s is %s, trusted %s", ErrCertMismatch, addr, CertFingerprint(cs.PeerCertificates[0].Raw), known)
+    }
+    return nil
+  }
+
+  // the top of the chain if it signs the leaf, the CA if the server sends it, so the
+  // renewed certificates are still trusted
+  top := cs.PeerCertificates[len(cs.PeerCertificates)-1]
+  fingerprint := CertFingerprint(cs.PeerCertificates[0].Raw)
+  if len(cs.PeerCertificates) > 1 && chainsTo(cs.PeerCertificates[0], cs.PeerCertificates[1:len(cs.PeerCertificates)-1], top) {
+    fingerprint = CertFingerprint(top.Raw)
+  }
+
+  t.seen[addr] = fingerprint
+  return nil
+}
+
+// Remember record the fingerprint of the first successful connection to addr, the later
+// connections must present the same certificate
+func (t *CertTrust) Remember(addr string) error {
+  t.Lock()
+  defer t.Unlock()
+
+  fingerprint, ok := t.seen[addr]
+  if !ok {
+    return nil
+  }
+  delete(t.seen, addr)
+
+  if _, ok := t.known[addr]; ok {
+    return nil
+  }
+
+  f, err := os.OpenFile(t.knownFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  if _, err = fmt.Fprintf(f, "%s %s\n", addr, fingerprint); err != nil {
+    return err
+  }
+
+  t.known[addr] = fingerprint
+  log.Infof("Trusted the certificate of %s on first use, fingerprint: %s.", addr, fingerprint)
+
+  return nil
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+  "crypto/tls"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// newTLSServer start a https server with a certificate signed by the CA files, sent with
+// the chain certificate files
+func newTLSServer(t *testing.T, dir string, name string, chain ...string) (*httptest.Server, string) {
+  caCert, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+  certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+
+  if err := CreateCert(caCert, caKey, certFile, keyFile, &CertRequest{CommonName: "localhost", Hosts: []string{"127.0.0.1"}}); err != nil {
+    t.Fatal("Failed to create certificate:", err)
+  }
+
+  cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+  if err != nil {
+    t.Fatal("Failed to load certificate:", err)
+  }
+
+  // the certificates sent along with the leaf
+  for _, file := range chain {
+    ca, err := LoadCertFile(file)
+    if err != nil {
+      t.Fatal("Failed to load certificate:", err)
+    }
+    cert.Certificate = append(cert.Certificate, ca.Raw)
+  }
+
+  server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+  server.StartTLS()
+  t.Cleanup(server.Close)
+
+  return server, CertFingerprint(cert.Certificate[0])
+}
+
+func TestCertTrust(t *testing.T) {
+  dir := t.TempDir()
+  if err := CreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "test CA"); err != nil {
+    t.Fatal("Failed to create CA:", err)
+  }
+
+  server1, fp1 := newTLSServer(t, dir, "server1")
+  server2, _ := newTLSServer(t, dir, "server2")
+  addr1 := strings.TrimPrefix(server1.URL, "https://")
+  addr2 := strings.TrimPrefix(server2.URL, "https://")
+
+  get := func(trust *CertTrust, addr string) error {
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: trust.TLSConfig("127.0.0.1", addr)}}
+    resp, err := client.Get("https://" + addr)
+    if err == nil {
+      resp.Body.Close()
+    }
+    return err
+  }
+
+  // the system CAs do not know the test CA
+  trust, _ := NewCertTrust(&ClientConfig{})
+  if get(trust, addr1) == nil {
+    t.Fatal("Unknown CA should be refused.")
+  }
+
+  trust, err := NewCertTrust(&ClientConfig{CAFile: filepath.Join(dir, "ca.crt")})
+  if err != nil || get(trust, addr1) != nil {
+    t.Fatal("CA file should be trusted:", err)
+  }
+
+  trust, _ = NewCertTrust(&ClientConfig{PinnedCertSHA256: strings.ToUpper(fp1)})
+  if err := get(trust, addr1); err != nil {
+    t.Fatal("Pinned certificate should be trusted:", err)
+  }
+  if err := get(trust, addr2); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Other certificate should be refused:", err)
+  }
+
+  // the discovered fingerprint does not replace the CAs
+  trust, _ = NewCertTrust(&ClientConfig{})
+  trust.SetDiscovered(fp1)
+  if get(trust, addr1) == nil {
+    t.Fatal("Discovered certificate of an unknown CA should be refused.")
+  }
+
+  // the discovered fingerprint is checked on first use
+  trust, _ = NewCertTrust(&ClientConfig{TrustOnFirstUse: true, KnownServersFile: filepath.Join(dir, "discovered_servers")})
+  trust.SetDiscovered(fp1)
+  if err := get(trust, addr1); err != nil {
+    t.Fatal("Discovered certificate should be trusted:", err)
+  }
+  if err := get(trust, addr2); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Other certificate than the discovered one should be refused:", err)
+  }
+
+  // trust on first use, the second server pretends to be the first one
+  config := &ClientConfig{TrustOnFirstUse: true, KnownServersFile: filepath.Join(dir, "known_servers")}
+  trust, _ = NewCertTrust(config)
+  if err := get(trust, addr1); err != nil {
+    t.Fatal("First use should be trusted:", err)
+  }
+  if err := trust.Remember(addr1); err != nil {
+    t.Fatal("Failed to remember:", err)
+  }
+
+  trust, _ = NewCertTrust(config)
+  if err := get(trust, addr1); err != nil {
+    t.Fatal("Known certificate should be trusted:", err)
+  }
+
+  client := &http.Client{Transport: &http.Transport{TLSClientConfig: trust.TLSConfig("127.0.0.1", addr1)}}
+  if _, err := client.Get("https://" + addr2); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Changed certificate should be refused:", err)
+  }
+}
+
+func TestCertTrustChain(t *testing.T) {
+  dir, evil := t.TempDir(), t.TempDir()
+  caFile := filepath.Join(dir, "ca.crt")
+  if err := CreateCA(caFile, filepath.Join(dir, "ca.key"), "test CA"); err != nil {
+    t.Fatal("Failed to create CA:", err)
+  }
+  if err := CreateCA(filepath.Join(evil, "ca.crt"), filepath.Join(evil, "ca.key"), "test CA"); err != nil {
+    t.Fatal("Failed to create CA:", err)
+  }
+
+  ca, err := LoadCertFile(caFile)
+  if err != nil {
+    t.Fatal("Failed to load CA:", err)
+  }
+  caFingerprint := CertFingerprint(ca.Raw)
+
+  server, _ := newTLSServer(t, dir, "server", caFile)
+  // the leaf of another CA sent with the real CA
+  spoofed, _ := newTLSServer(t, evil, "server", caFile)
+  addr := strings.TrimPrefix(server.URL, "https://")
+  spoofedAddr := strings.TrimPrefix(spoofed.URL, "https://")
+
+  // get connect to url as if it was addr
+  get := func(trust *CertTrust, addr string, url string) error {
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: trust.TLSConfig("127.0.0.1", addr)}}
+    resp, err := client.Get(url)
+    if err == nil {
+      resp.Body.Close()
+    }
+    return err
+  }
+
+  trust, _ := NewCertTrust(&ClientConfig{PinnedCertSHA256: caFingerprint})
+  if err := get(trust, addr, server.URL); err != nil {
+    t.Fatal("Certificate signed by the pinned CA should be trusted:", err)
+  }
+  if err := get(trust, spoofedAddr, spoofed.URL); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Certificate sent with the pinned CA but not signed by it should be refused:", err)
+  }
+
+  trust, _ = NewCertTrust(&ClientConfig{TrustOnFirstUse: true, KnownServersFile: filepath.Join(dir, "discovered_servers")})
+  trust.SetDiscovered(caFingerprint)
+  if err := get(trust, addr, server.URL); err != nil {
+    t.Fatal("Certificate signed by the discovered CA should be trusted:", err)
+  }
+  if err := get(trust, spoofedAddr, spoofed.URL); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Certificate sent with the discovered CA but not signed by it should be refused:", err)
+  }
+
+  // the CA is trusted on first use, the spoofed server pretends to be the real one
+  config := &ClientConfig{TrustOnFirstUse: true, KnownServersFile: filepath.Join(dir, "known_servers")}
+  trust, _ = NewCertTrust(config)
+  if err := get(trust, addr, server.URL); err != nil {
+    t.Fatal("First use should be trusted:", err)
+  }
+  if err := trust.Remember(addr); err != nil {
+    t.Fatal("Failed to remember:", err)
+  }
+  if known, _ := os.ReadFile(config.KnownServersFile); !strings.Contains(string(known), caFingerprint) {
+    t.Fatal("CA signing the certificate should be remembered:", string(known))
+  }
+
+  trust, _ = NewCertTrust(config)
+  if err := get(trust, addr, server.URL); err != nil {
+    t.Fatal("Known CA should be trusted:", err)
+  }
+  if err := get(trust, addr, spoofed.URL); !errors.Is(err, ErrCertMismatch) {
+    t.Fatal("Certificate sent with the known CA but not signed by it should be refused:", err)
+  }
+}
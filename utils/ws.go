@@ -1,8 +1,17 @@
 package utils
 
 import (
+  "crypto/sha256"
+  "encoding/hex"
   "encoding/json"
   "errors"
+  "fmt"
+  "math/rand"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
 )
 
 // Errors
@@ -10,6 +19,12 @@ var (
   ErrBadAction             = errors.New("bad action data")
   ErrAuthFailed            = errors.New("auth failed")
   ErrUnAuthenticatedClient = errors.New("client is not authenticated")
+  ErrPermissionDenied      = errors.New("permission denied")
+  ErrRateLimited           = errors.New("too many authentication failures")
+  ErrClipTooLarge          = errors.New("clip is too large")
+  ErrQuotaExceeded         = errors.New("storage quota exceeded")
+  ErrTooManyClips          = errors.New("too many clips")
+  ErrServerShutdown        = errors.New("server is shutting down")
 )
 
 // All actions from daemons
@@ -21,8 +36,124 @@ const (
   ActionClipboardGet                      = "cbget"
   ActionClipboardPut                      = "cbput"
   ActionTerminate                         = "terminate"
+  ActionSubscribe                         = "subscribe"
+  ActionClipboardPush                     = "cbpush"
+  ActionPushResult                        = "pushresult"
+  ActionPresence                          = "presence"
+  ActionError                             = "error"
 )
 
+// codes of the error action
+const (
+  ErrorAuthFailed       = "auth_failed"
+  ErrorUnauthenticated  = "unauthenticated"
+  ErrorPermissionDenied = "permission_denied"
+  ErrorTooLarge         = "too_large"
+  ErrorQuota            = "quota"
+  ErrorRateLimited      = "rate_limited"
+  ErrorBadAction        = "bad_action"
+  ErrorShutdown         = "shutdown"
+)
+
+var errorCodes = map[error]string{
+  ErrAuthFailed:            ErrorAuthFailed,
+  ErrUnAuthenticatedClient: ErrorUnauthenticated,
+  ErrPermissionDenied:      ErrorPermissionDenied,
+  ErrClipTooLarge:          ErrorTooLarge,
+  ErrQuotaExceeded:         ErrorQuota,
+  ErrRateLimited:           ErrorRateLimited,
+  ErrTooManyClips:          ErrorRateLimited,
+  ErrBadAction:             ErrorBadAction,
+  ErrServerShutdown:        ErrorShutdown,
+}
+
+// ErrorInfo data of the error action, the code is for the programs and the message for the users
+type ErrorInfo struct {
+  Code    string `json:"code"`
+  Message string `json:"message"`
+
+  // seconds to wait before trying again, for the rate limits and the shutdown
+  RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Error the received error action as an error of the client
+func (e *ErrorInfo) Error() string {
+  return e.Code + ": " + e.Message
+}
+
+// Is match the errors of the same code, e.g. errors.Is(info, ErrAuthFailed)
+func (e *ErrorInfo) Is(target error) bool {
+  return e.Code != "" && ErrorCode(target) == e.Code
+}
+
+// ErrorCode return the code of the error action for the error, empty if it has none
+func ErrorCode(err error) string {
+  return errorCodes[err]
+}
+
+// close frame reasons telling the clients when to connect again
+const (
+  reasonGoingAway = "server going away, reconnect in %d seconds"
+  reasonRetry     = "retry after %d seconds"
+)
+
+var reasonDelay = regexp.MustCompile(`(?:reconnect in|retry after) (\d+) seconds`)
+
+// GoingAwayReason close reason sent to the clients when the server shuts down
+func GoingAwayReason(seconds int) string {
+  return fmt.Sprintf(reasonGoingAway, seconds)
+}
+
+// RetryReason close reason sent to the rejected clients
+func RetryReason(seconds int) string {
+  return fmt.Sprintf(reasonRetry, seconds)
+}
+
+// ReconnectDelay parse the delay of the close reason, false if the reason has none
+func ReconnectDelay(reason string) (time.Duration, bool) {
+  m := reasonDelay.FindStringSubmatch(reason)
+  if m == nil {
+    return 0, false
+  }
+
+  seconds, err := strconv.Atoi(m[1])
+  if err != nil {
+    return 0, false
+  }
+
+  return time.Duration(seconds) * time.Second, true
+}
+
+// Backoff exponential delays between the reconnections
+type Backoff struct {
+  Min time.Duration
+  Max time.Duration
+
+  // failed attempts since the last reset
+  attempt int
+}
+
+// Next return the delay before the next attempt, doubled each time up to max with a
+// jitter of a fifth either way, so the clients of a restarted server spread out
+func (b *Backoff) Next() time.Duration {
+  d := b.Max
+  if b.attempt < 32 && b.Min<<b.attempt < b.Max {
+    d = b.Min << b.attempt
+    b.attempt++
+  }
+
+  if spread := int64(d) / 5; spread > 0 {
+    d += time.Duration(rand.Int63n(2*spread+1) - spread)
+  }
+
+  return d
+}
+
+// Reset start again from the minimum delay after a successful connection
+func (b *Backoff) Reset() {
+  b.attempt = 0
+}
+
 // WebsocketAction is an action between midgard daemon and midgard server
 type WebsocketAction string
 
@@ -31,6 +162,144 @@ type WebsocketMessage struct {
   Action WebsocketAction `json:"action"`
   UserID string          `json:"user_id"`
   Data   []byte          `json:"data"`
+
+  // content hash of the clipboard data, see ContentHash
+  Hash string `json:"hash,omitempty"`
+
+  // channel of the clip, the clipboard of the user if empty
+  Channel string `json:"channel,omitempty"`
+
+  // client ID of a direct push
+  Target string `json:"target,omitempty"`
+}
+
+// ProtocolVersion version of the structured handshake, the colon separated handshake
+// user:secret:mode is version 1
+const ProtocolVersion = 2
+
+// capabilities of the handshake
+const (
+  // permessage-deflate of the websocket connection
+  CapCompression = "compression"
+  // clips split into several messages
+  CapChunking = "chunking"
+  // clips encrypted by the clients
+  CapE2E = "e2e"
+)
+
+// HandshakeInfo data of the register action
+type HandshakeInfo struct {
+  Protocol int    `json:"protocol"`
+  User     string `json:"user"`
+  Secret   string `json:"secret,omitempty"`
+  Mode     string `json:"mode"`
+
+  Version      string   `json:"version,omitempty"`
+  Platform     string   `json:"platform,omitempty"`
+  ClipTypes    []string `json:"clip_types,omitempty"`
+  Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// ServerLimits limits of the server sent in the ready action, zero means unlimited
+type ServerLimits struct {
+  MaxMsgSize int   `json:"max_msg_size"`
+  MaxText    int   `json:"max_text,omitempty"`
+  MaxImage   int   `json:"max_image,omitempty"`
+  MaxFile    int   `json:"max_file,omitempty"`
+  Quota      int64 `json:"quota,omitempty"`
+  Rate       int   `json:"rate,omitempty"`
+  Burst      int   `json:"burst,omitempty"`
+}
+
+// MaxSize return the maximum size of the clip type, clips of unknown types are files
+func (l *ServerLimits) MaxSize(clipType string) int {
+  switch clipType {
+  case ClipTypeText:
+    return l.MaxText
+  case ClipTypeImage:
+    return l.MaxImage
+  default:
+    return l.MaxFile
+  }
+}
+
+// ReadyInfo data of the ready action replied to the structured handshakes, with the
+// negotiated clip types and capabilities
+type ReadyInfo struct {
+  Protocol     int          `json:"protocol"`
+  Version      string       `json:"version"`
+  ClipTypes    []string     `json:"clip_types"`
+  Capabilities []string     `json:"capabilities"`
+  Limits       ServerLimits `json:"limits"`
+}
+
+// ParseHandshake parse the structured handshake, or the colon separated one of the
+// older clients, where the user and the secret may be empty for the clients
+// authenticated by the upgrade request
+func ParseHandshake(data []byte) (*HandshakeInfo, error) {
+  if len(data) > 0 && data[0] == '{' {
+    info := &HandshakeInfo{}
+    if err := json.Unmarshal(data, info); err != nil || info.Protocol < ProtocolVersion {
+      return nil, ErrBadAction
+    }
+
+    return info, nil
+  }
+
+  s := BytesToString(data)
+  first, last := strings.Index(s, ":"), strings.LastIndex(s, ":")
+
+  info := &HandshakeInfo{Protocol: 1, Mode: s[last+1:]}
+  if first >= 0 {
+    info.User = s[:first]
+  }
+  if first < last {
+    info.Secret = s[first+1 : last]
+  }
+
+  return info, nil
+}
+
+// presence events
+const (
+  PresenceJoin  = "join"
+  PresenceLeave = "leave"
+)
+
+// DeviceInfo online device of the user
+type DeviceInfo struct {
+  ClientID   string `json:"client_id"`
+  Mode       string `json:"mode"`
+  Connected  string `json:"connected"`
+  RemoteAddr string `json:"remote_addr"`
+  Version    string `json:"version,omitempty"`
+  Platform   string `json:"platform,omitempty"`
+}
+
+// PresenceEvent sent to the other devices of the user when a device joins or leaves
+type PresenceEvent struct {
+  Event  string     `json:"event"`
+  Device DeviceInfo `json:"device"`
+}
+
+// UserAgentPrefix user agent of the clients, followed by the version
+const UserAgentPrefix = "clipboard-remote/"
+
+// ClientVersion return the version of the client user agent, empty for other agents
+func ClientVersion(userAgent string) string {
+  version, ok := strings.CutPrefix(userAgent, UserAgentPrefix)
+  if !ok {
+    return ""
+  }
+
+  version, _, _ = strings.Cut(version, " ")
+  return version
+}
+
+// PushResult delivery result of a direct push, replied to the sender
+type PushResult struct {
+  Target    string `json:"target"`
+  Delivered bool   `json:"delivered"`
 }
 
 // Encode encodes a websocket message
@@ -43,3 +312,50 @@ func (m *WebsocketMessage) Encode() []byte {
 func (m *WebsocketMessage) Decode(data []byte) error {
   return json.Unmarshal(data, m)
 }
+
+// ContentHash return the sha256 hex of the clipboard data
+func ContentHash(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+// RecentHashes content hashes seen recently, e.g. the clips written to the local
+// clipboard, so they are not sent back to the server when the clipboard changes
+type RecentHashes struct {
+  sync.Mutex
+
+  ttl    time.Duration
+  hashes map[string]time.Time
+}
+
+// NewRecentHashes return the set keeping the hashes for ttl
+func NewRecentHashes(ttl time.Duration) *RecentHashes {
+  return &RecentHashes{
+    ttl:    ttl,
+    hashes: make(map[string]time.Time),
+  }
+}
+
+// Add remember the hash
+func (r *RecentHashes) Add(hash string) {
+  r.Lock()
+  defer r.Unlock()
+
+  now := time.Now()
+  for h, seen := range r.hashes {
+    if now.Sub(seen) > r.ttl {
+      delete(r.hashes, h)
+    }
+  }
+
+  r.hashes[hash] = now
+}
+
+// Contains return whether the hash was added within ttl
+func (r *RecentHashes) Contains(hash string) bool {
+  r.Lock()
+  defer r.Unlock()
+
+  seen, ok := r.hashes[hash]
+  return ok && time.Since(seen) <= r.ttl
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+  "errors"
+  "fmt"
+  "testing"
+  "time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+  if d, ok := ReconnectDelay(GoingAwayReason(5)); !ok || d != 5*time.Second {
+    t.Fatal("Going away reason should carry the delay:", d, ok)
+  }
+
+  if d, ok := ReconnectDelay(RetryReason(60)); !ok || d != time.Minute {
+    t.Fatal("Retry reason should carry the delay:", d, ok)
+  }
+
+  if _, ok := ReconnectDelay("authentication failed"); ok {
+    t.Fatal("Other reasons should have no delay.")
+  }
+}
+
+func TestBackoff(t *testing.T) {
+  b := &Backoff{Min: time.Second, Max: 10 * time.Second}
+
+  for i, base := range []time.Duration{1, 2, 4, 8, 10, 10} {
+    base *= time.Second
+    if d := b.Next(); d < base-base/5 || d > base+base/5 {
+      t.Fatalf("Attempt %d should wait about %v: %v", i, base, d)
+    }
+  }
+
+  b.Reset()
+  if d := b.Next(); d > time.Second+time.Second/5 {
+    t.Fatal("Reset should start from the minimum delay:", d)
+  }
+}
+
+func TestRecentHashes(t *testing.T) {
+  recent := NewRecentHashes(50 * time.Millisecond)
+
+  hash := ContentHash([]byte("hello"))
+  if hash != ContentHash([]byte("hello")) || hash == ContentHash([]byte("hello!")) {
+    t.Fatal("Content hash should only depend on the content.")
+  }
+
+  recent.Add(hash)
+  if !recent.Contains(hash) || recent.Contains(ContentHash([]byte("other"))) {
+    t.Fatal("Only the added hash should be recent.")
+  }
+
+  time.Sleep(60 * time.Millisecond)
+  if recent.Contains(hash) {
+    t.Fatal("Hash should expire after ttl.")
+  }
+}
+
+func TestClientVersion(t *testing.T) {
+  if v := ClientVersion(UserAgentPrefix + "1.2.0 (windows)"); v != "1.2.0" {
+    t.Fatal("Version should be parsed from the user agent:", v)
+  }
+
+  if v := ClientVersion("Go-http-client/1.1"); v != "" {
+    t.Fatal("Other agents should have no version:", v)
+  }
+}
+
+func TestErrorInfo(t *testing.T) {
+  var err error = &ErrorInfo{Code: ErrorRateLimited, Message: "too many clips", RetryAfter: 3}
+  wrapped := fmt.Errorf("failed to handshake with server: %w", err)
+
+  if !errors.Is(wrapped, ErrTooManyClips) || !errors.Is(wrapped, ErrRateLimited) || errors.Is(wrapped, ErrAuthFailed) {
+    t.Fatal("Error action should match the errors of its code.")
+  }
+
+  var info *ErrorInfo
+  if !errors.As(wrapped, &info) || info.RetryAfter != 3 {
+    t.Fatal("Error action should be found in the wrapped error.")
+  }
+
+  if ErrorCode(ErrServerShutdown) != ErrorShutdown || ErrorCode(errors.New("other")) != "" {
+    t.Fatal("Only the known errors should have a code.")
+  }
+}
+
+func TestParseHandshake(t *testing.T) {
+  info, err := ParseHandshake([]byte("u1:pass:with:colon:auto"))
+  if err != nil || info.Protocol != 1 || info.User != "u1" || info.Secret != "pass:with:colon" || info.Mode != "auto" {
+    t.Fatal("Colon separated handshake should be parsed:", info, err)
+  }
+
+  // the clients authenticated by the upgrade request may only send the mode
+  if info, _ = ParseHandshake([]byte("manual")); info.User != "" || info.Secret != "" || info.Mode != "manual" {
+    t.Fatal("Mode only handshake should be parsed:", info)
+  }
+
+  info, err = ParseHandshake([]byte(`{"protocol":2,"user":"u1","secret":"pass","mode":"auto","clip_types":["text"],"capabilities":["e2e"]}`))
+  if err != nil || info.Protocol != 2 || info.User != "u1" || len(info.ClipTypes) != 1 || info.Capabilities[0] != CapE2E {
+    t.Fatal("Structured handshake should be parsed:", info, err)
+  }
+
+  if _, err = ParseHandshake([]byte(`{"protocol":1,"user":"u1"}`)); err != ErrBadAction {
+    t.Fatal("Structured handshake without its protocol version should be rejected:", err)
+  }
+}
@@ -11,7 +11,6 @@ import (
   "clipboard-remote/clipboard"
   "clipboard-remote/utils"
 
-  "github.com/grandcat/zeroconf"
   log "github.com/sirupsen/logrus"
 )
 
@@ -21,19 +20,8 @@ var (
 )
 
 func init() {
-  // Set the log output to stdout
-  log.SetReportCaller(true)
-  log.SetFormatter(&utils.Formatter{
-    HideKeys:    true,
-    CallerFirst: true,
-    NoColors:    true,
-  })
-
-  // Set the log output to the specified file
-  log.SetOutput(os.Stdout)
-
-  // Set the log level
-  log.SetLevel(log.InfoLevel)
+  // text log of info level to stdout until the config is loaded
+  utils.SetupLog(&utils.LogConfig{}, "client")
 }
 
 func main() {
@@ -63,30 +51,8 @@ func main() {
     return
   }
 
-  // Set the log level from config file
-  switch clientConfig.Log.LogLevel {
-  case "debug":
-    log.SetLevel(log.DebugLevel)
-  case "info":
-    log.SetLevel(log.InfoLevel)
-  case "warn":
-    log.SetLevel(log.WarnLevel)
-  case "error":
-    log.SetLevel(log.ErrorLevel)
-  case "fatal":
-    log.SetLevel(log.FatalLevel)
-  }
-
-  // Set the log file
-  if clientConfig.Log.LogPath != "" {
-    logfile, err := os.OpenFile(clientConfig.Log.LogPath, os.O_RDONLY|os.O_CREATE, 0666)
-    if err != nil {
-      log.Errorf("Failed to open log file(%s), err: %v.", clientConfig.Log.LogPath, err)
-      // print the log info to stdout
-    } else {
-      log.SetOutput(logfile)
-    }
-  }
+  // Set the log level, format and file from config file
+  utils.SetupLog(&clientConfig.Log, "client")
 
   // add interrupt sigal
   interrupt := make(chan os.Signal, 1)
@@ -95,37 +61,29 @@ func main() {
   // watch context, used for watch break
   ctx, cancel := context.WithCancel(context.Background())
 
-  // auto find the server
-  resolver, err := zeroconf.NewResolver(nil)
+  // verify the server certificate by the pinned fingerprint, the CA file or on first use
+  trust, err := utils.NewCertTrust(clientConfig)
   if err != nil {
-    log.Errorln("Failed to initialize resolver:", err)
+    log.Errorln("Failed to load certificate trust:", err)
+    cancel()
     return
   }
 
-  entries := make(chan *zeroconf.ServiceEntry)
-  err = resolver.Browse(ctx, "_cliphttp._tcp", "local.", entries)
-  if err != nil {
-    log.Errorln("Failed to browse:", err)
-    return
-  }
+  client := NewClient(clientConfig, trust)
 
-  if clientConfig.Host == "" {
-    select {
-    case <-interrupt:
-      cancel()
-      log.Infoln("No server found, waiting client to exist...")
-      time.Sleep(1 * time.Second)
-      return
-    case serverResult := <-entries:
-      log.Println(serverResult)
-      clientConfig.Host = serverResult.AddrIPv4[0].String()
-      clientConfig.Port = serverResult.Port
-    }
+  // find the server, interrupted if nothing answers
+  go func() {
+    <-interrupt
+    cancel()
+  }()
+
+  if !client.locate(ctx) {
+    log.Infoln("No server found, waiting client to exist...")
+    time.Sleep(1 * time.Second)
+    return
   }
 
   // handle io local to server
-  client := NewClient(clientConfig)
-
   if clientConfig.Mode == "auto" {
     go client.handleIO(ctx, clipboard.Watch(ctx))
   } else {
@@ -139,8 +97,7 @@ func main() {
     go hk.listenHotkey(ctx)
   }
 
-  <-interrupt
-  cancel()
+  <-ctx.Done()
   log.Infoln("Waiting client to exist...")
 
   client.close()
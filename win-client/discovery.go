@@ -0,0 +1,141 @@
+package main
+
+import (
+  "context"
+  "time"
+
+  "clipboard-remote/utils"
+
+  "github.com/grandcat/zeroconf"
+  log "github.com/sirupsen/logrus"
+)
+
+// discover collect the servers answering within the timeout
+func discover(ctx context.Context, timeout time.Duration) ([]*utils.DiscoveredServer, error) {
+  resolver, err := zeroconf.NewResolver(nil)
+  if err != nil {
+    return nil, err
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+
+  entries := make(chan *zeroconf.ServiceEntry)
+  err = resolver.Browse(ctx, utils.DiscoveryService, utils.DiscoveryDomain, entries)
+  if err != nil {
+    return nil, err
+  }
+
+  // the channel is closed when the timeout expires
+  var servers []*utils.DiscoveredServer
+  for entry := range entries {
+    server := utils.NewDiscoveredServer(entry.Instance, entry.Port, entry.AddrIPv4, entry.AddrIPv6, entry.Text)
+    if server == nil {
+      log.Warnf("Discovered server %s has no usable address.", entry.Instance)
+      continue
+    }
+
+    log.Debugf("Discovered server %s at %s:%d.", server.Instance, server.Host, server.Port)
+    servers = append(servers, server)
+  }
+
+  return servers, nil
+}
+
+// discoverServer return the discovered server matching the config, nil if none answers
+func (c *Client) discoverServer(ctx context.Context) *utils.DiscoveredServer {
+  config := &c.config.Discovery
+
+  servers, err := discover(ctx, time.Duration(config.Timeout)*time.Second)
+  if err != nil {
+    log.Errorln("Failed to discover server:", err)
+    return nil
+  }
+
+  server := utils.SelectServer(servers, config.Name, config.Fingerprint)
+  if server == nil {
+    log.Warnf("No server matched in %d discovered.", len(servers))
+    return nil
+  }
+
+  log.Infof("Discovered server %s version %s at %s:%d.", server.Instance, server.Info.Version, server.Host, server.Port)
+  return server
+}
+
+// locate find the server, the configured one if set. Without a configured server it
+// discovers until one answers or the context is done.
+func (c *Client) locate(ctx context.Context) bool {
+  if c.fallback.Host != "" {
+    log.Infof("Use the configured server %s.", c.fallback.Host)
+    c.useServer(c.fallback)
+    return true
+  }
+
+  if !c.config.DiscoveryEnabled() {
+    log.Errorln("No server configured and the discovery is disabled.")
+    return false
+  }
+
+  // the delay grows while nothing answers or the resolver fails
+  backoff := &utils.Backoff{Min: time.Second, Max: time.Duration(c.config.Reconnect.MaxDelay) * time.Second}
+  for {
+    if server := c.discoverServer(ctx); server != nil {
+      c.useServer(server)
+      return true
+    }
+
+    delay := backoff.Next()
+    log.Infof("No server found, discover again in %v...", delay)
+
+    select {
+    case <-ctx.Done():
+      return false
+    case <-time.After(delay):
+    }
+  }
+}
+
+// relocate switch the server after the reconnections kept failing, back to the configured
+// server from a discovered one, else to the server discovered again
+func (c *Client) relocate(ctx context.Context) {
+  c.Lock()
+  discovered := c.discovered
+  c.Unlock()
+
+  if discovered && c.fallback.Host != "" {
+    log.Infof("Use the configured server %s again.", c.fallback.Host)
+    c.useServer(c.fallback)
+    return
+  }
+
+  if !c.config.DiscoveryEnabled() {
+    return
+  }
+
+  if server := c.discoverServer(ctx); server != nil {
+    c.useServer(server)
+  }
+}
+
+// useServer connect to the server from now on, the fingerprints it announced are required
+func (c *Client) useServer(server *utils.DiscoveredServer) {
+  c.Lock()
+  defer c.Unlock()
+
+  c.config.Host = server.Host
+  c.config.Port = server.Port
+  c.discovered = server != c.fallback
+
+  // the protocol is negotiated again with another server
+  c.protocol = 0
+
+  // the advertised path and scheme instead of the config defaults
+  if server.Info.Path != "" {
+    c.config.WebsocketPath = server.Info.Path
+  }
+  if server.Info.Scheme != "" {
+    c.config.Scheme = server.Info.Scheme
+  }
+
+  c.trust.SetDiscovered(server.Info.Fingerprint, server.Info.CAFingerprint)
+}
@@ -4,7 +4,6 @@ import (
   "clipboard-remote/clipboard"
   "clipboard-remote/utils"
   "context"
-  "crypto/tls"
   "encoding/json"
   "fmt"
   "io"
@@ -155,28 +154,31 @@ func (h *Hotkey) uploadHotkeyHandler() {
     return
   }
 
-  // send clipboard content to server
-  h.client.writeCh <- &utils.WebsocketMessage{
-    Action: utils.ActionClipboardChanged,
-    UserID: h.client.ID,
-    Data:   clipBuff,
-  }
+  // queue clipboard content to server, sent once the connection is ready
+  h.client.send(&utils.WebsocketMessage{
+    Action:  utils.ActionClipboardChanged,
+    UserID:  h.client.ID,
+    Data:    clipBuff,
+    Hash:    utils.ContentHash(clipBuff),
+    Channel: h.client.config.Channel,
+  })
 }
 
 func (h *Hotkey) downloadHotkeyHandler() {
-  transport := &http.Transport{
-    TLSClientConfig: &tls.Config{InsecureSkipVerify: h.client.config.InsecureSkipVerify},
-  }
-  client := &http.Client{Transport: transport}
+  client := h.client.httpClient()
 
-  url := fmt.Sprintf("https://%s:%d/clipboard/get", h.client.config.Host, h.client.config.Port)
+  url := fmt.Sprintf("%s://%s/clipboard/get", h.client.config.Scheme, h.client.addr())
   req, err := http.NewRequest("GET", url, nil)
   if err != nil {
     log.Errorln("Failed to handle new request:", err)
     return
   }
 
-  req.SetBasicAuth(h.client.config.Auth.User, h.client.config.Auth.Password)
+  if strings.HasPrefix(h.client.config.Auth.Password, utils.APITokenPrefix) {
+    req.Header.Set("Authorization", "Bearer "+h.client.config.Auth.Password)
+  } else if h.client.config.Auth.Password != "" || !h.client.trust.HasClientCert() {
+    req.SetBasicAuth(h.client.config.Auth.User, h.client.config.Auth.Password)
+  }
   resp, err := client.Do(req)
   if err != nil {
     log.Errorln("Failed to request remote clipboard info:", err)
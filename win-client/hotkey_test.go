@@ -13,7 +13,12 @@ func TestHotkey(t *testing.T) {
     return
   }
 
-  client := NewClient(clientConfig)
+  trust, err := utils.NewCertTrust(clientConfig)
+  if err != nil {
+    t.Fatal("Failed to load certificate trust:", err)
+  }
+
+  client := NewClient(clientConfig, trust)
 
   hotkey := &Hotkey{client: client}
 
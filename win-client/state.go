@@ -0,0 +1,70 @@
+package main
+
+import (
+  "time"
+)
+
+// ConnState connection state of the client
+type ConnState int32
+
+const (
+  // not connected and not retrying, e.g. stopped
+  StateOffline ConnState = iota
+  StateConnecting
+  StateReady
+  // waiting before the next attempt
+  StateBackoff
+)
+
+var stateNames = [...]string{"offline", "connecting", "ready", "backoff"}
+
+func (s ConnState) String() string {
+  if s < 0 || int(s) >= len(stateNames) {
+    return "unknown"
+  }
+
+  return stateNames[s]
+}
+
+// StateEvent change of the connection state, for a UI or a tray icon
+type StateEvent struct {
+  State ConnState
+
+  // error of the failed attempt and delay before the next one, for the backoff state
+  Err   error
+  Retry time.Duration
+
+  // queued messages dropped while disconnected, for the ready state
+  Dropped int
+}
+
+// State return the current connection state
+func (c *Client) State() ConnState {
+  return ConnState(c.state.Load())
+}
+
+// Events return the state changes, the oldest ones are dropped if they are not read
+func (c *Client) Events() <-chan StateEvent {
+  return c.events
+}
+
+// setState record the state and publish its event without blocking
+func (c *Client) setState(event StateEvent) {
+  c.state.Store(int32(event.State))
+  c.queue.SetOnline(event.State == StateReady)
+  c.logger().Debugf("Connection state changed to %s.", event.State)
+
+  for {
+    select {
+    case c.events <- event:
+      return
+    default:
+    }
+
+    // make room for the latest state
+    select {
+    case <-c.events:
+    default:
+    }
+  }
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+  "clipboard-remote/utils"
+  "testing"
+)
+
+func TestStateEvents(t *testing.T) {
+  client := NewClient(&utils.ClientConfig{}, nil)
+
+  // nobody reads the events, the oldest ones are dropped
+  for i := 0; i < cap(client.events)+5; i++ {
+    client.setState(StateEvent{State: StateConnecting})
+  }
+  client.setState(StateEvent{State: StateReady})
+
+  if client.State() != StateReady {
+    t.Fatal("State should be ready:", client.State())
+  }
+
+  var last StateEvent
+  for len(client.events) > 0 {
+    last = <-client.Events()
+  }
+  if last.State != StateReady {
+    t.Fatal("Latest event should be kept:", last.State)
+  }
+}
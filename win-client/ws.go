@@ -2,11 +2,19 @@ package main
 
 import (
   "context"
-  "crypto/tls"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
   "fmt"
+  "net"
+  "net/http"
   "net/url"
   "os"
+  "runtime"
+  "strconv"
+  "strings"
   "sync"
+  "sync/atomic"
   "time"
 
   "github.com/google/uuid"
@@ -25,13 +33,40 @@ type Client struct {
   ID     string
   conn   *websocket.Conn
 
-  // {message: chan *types.WebsocketMessage}
-  // readChs sync.Map
-  writeCh chan *utils.WebsocketMessage
+  // verify the server certificate for the websocket and the http requests
+  trust *utils.CertTrust
+
+  // the configured server, the discovery finds another one only if it is unset or unreachable
+  fallback *utils.DiscoveredServer
+
+  // whether the current server was discovered
+  discovered bool
+
+  // messages to the server, kept while disconnected
+  queue *utils.MessageQueue
+
+  // connection state and its changes
+  state  atomic.Int32
+  events chan StateEvent
+
+  // delays between the failed reconnections
+  backoff *utils.Backoff
+
+  // hashes of the clips applied recently, not sent back by the clipboard watch
+  recent *utils.RecentHashes
+
+  // features and limits negotiated with the server, nil for the colon separated handshake
+  server *utils.ReadyInfo
+
+  // handshake protocol accepted by the current server, 0 until a handshake succeeded
+  protocol int
 }
 
+// clientClipTypes clip types of the windows clipboard
+var clientClipTypes = []string{utils.ClipTypeText, utils.ClipTypeFile}
+
 // NewClient creates a new ws client
-func NewClient(c *utils.ClientConfig) *Client {
+func NewClient(c *utils.ClientConfig, trust *utils.CertTrust) *Client {
   id, err := os.Hostname()
   if err != nil {
     id = uuid.NewString()
@@ -39,49 +74,171 @@ func NewClient(c *utils.ClientConfig) *Client {
       panic(fmt.Errorf("failed to initialize daemon: %v", err))
     }
   }
+
+  // latest wins in auto mode, only the current clipboard matters
+  queue, err := utils.NewMessageQueue(&c.Queue, c.Mode == "auto")
+  if err != nil {
+    log.Errorln("Failed to load queue file, the queue is kept in memory:", err)
+    queue, _ = utils.NewMessageQueue(&utils.QueueConfig{MaxMessages: c.Queue.MaxMessages, MaxBytes: c.Queue.MaxBytes}, c.Mode == "auto")
+  }
+
   return &Client{
-    ID:      id,
-    writeCh: make(chan *utils.WebsocketMessage, 10),
-    config:  c,
+    ID:     id,
+    queue:  queue,
+    config: c,
+    trust:  trust,
+    events: make(chan StateEvent, 16),
+    recent: utils.NewRecentHashes(echoWindow),
+    backoff: &utils.Backoff{
+      Min: time.Duration(c.Reconnect.MinDelay) * time.Second,
+      Max: time.Duration(c.Reconnect.MaxDelay) * time.Second,
+    },
+    fallback: &utils.DiscoveredServer{
+      Host: c.Host,
+      Port: c.Port,
+      Info: &utils.DiscoveryInfo{Path: c.WebsocketPath, Scheme: c.Scheme},
+    },
+  }
+}
+
+// addr return the host:port of the server
+func (c *Client) addr() string {
+  port := c.config.Port
+  if port == 0 && c.config.Scheme == "http" {
+    port = 80
+  } else if port == 0 {
+    port = 443
+  }
+
+  return net.JoinHostPort(c.config.Host, strconv.Itoa(port))
+}
+
+// wsScheme return the websocket scheme matching the http scheme, ws only behind a TLS terminating proxy
+func (c *Client) wsScheme() string {
+  if c.config.Scheme == "http" {
+    return "ws"
   }
+
+  return "wss"
+}
+
+// httpClient return the http client verifying the server certificate
+func (c *Client) httpClient() *http.Client {
+  return &http.Client{
+    Transport: &http.Transport{TLSClientConfig: c.trust.TLSConfig(c.config.Host, c.addr())},
+    Timeout:   30 * time.Second,
+  }
+}
+
+// logger return the logger carrying the client fields
+func (c *Client) logger() *log.Entry {
+  return log.WithFields(log.Fields{
+    utils.LogFieldClientID: c.ID,
+    utils.LogFieldUsername: c.config.Auth.User,
+  })
 }
 
 func (c *Client) connect() error {
   c.Lock()
   defer c.Unlock()
 
-  dial := websocket.Dialer{TLSClientConfig: &tls.Config{
-    InsecureSkipVerify: c.config.InsecureSkipVerify,
-  }}
+  conn, err := c.dial()
+  if err != nil {
+    return err
+  }
+
+  protocol := c.protocol
+  if protocol == 0 {
+    protocol = c.config.Protocol
+  }
 
-  u := url.URL{Scheme: "wss", Host: c.config.Host, Path: c.config.WebsocketPath}
-  conn, _, err := dial.Dial(u.String(), nil)
+  // the servers before the structured handshake close the connection, try the colon
+  // separated one until a handshake with the server succeeded. The error actions are
+  // replied by the newer servers, so a wrong password is not tried twice.
+  err = c.handshake(conn, protocol)
+  var info *utils.ErrorInfo
+  if err != nil && !errors.As(err, &info) && c.protocol == 0 && protocol >= utils.ProtocolVersion {
+    conn.Close()
+    c.logger().Warnln("Failed to handshake, try the colon separated handshake:", err)
+
+    if conn, err = c.dial(); err != nil {
+      return err
+    }
+    protocol = 1
+    err = c.handshake(conn, protocol)
+  }
+
+  // the connection is only used by the read and write routines once it is ready
   if err != nil {
-    return fmt.Errorf("failed to dial(%s): %w", u.String(), err)
+    conn.Close()
+    return err
   }
+  c.protocol = protocol
   c.conn = conn
 
-  // hash password
-  hashBytes, err := bcrypt.GenerateFromPassword([]byte(c.config.Auth.Password), bcrypt.DefaultCost)
+  return nil
+}
+
+// dial open the websocket connection to the server
+func (c *Client) dial() (*websocket.Conn, error) {
+  dial := websocket.Dialer{
+    TLSClientConfig:   c.trust.TLSConfig(c.config.Host, c.addr()),
+    EnableCompression: true,
+  }
+
+  u := url.URL{Scheme: c.wsScheme(), Host: c.addr(), Path: c.config.WebsocketPath}
+  // the version is shown by the presence of the server
+  header := http.Header{"User-Agent": {utils.UserAgentPrefix + utils.Version + " (" + runtime.GOOS + ")"}}
+  conn, _, err := dial.Dial(u.String(), header)
   if err != nil {
-    return fmt.Errorf("failed to hash password: %w", err)
+    return nil, fmt.Errorf("failed to dial(%s): %w", u.String(), err)
   }
 
-  // handshake with server
-  c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-  creds := c.config.Auth.User + ":" + utils.BytesToString(hashBytes) + ":" + c.config.Mode
-  err = c.conn.WriteMessage(websocket.BinaryMessage, (&utils.WebsocketMessage{
+  return conn, nil
+}
+
+// handshake register the client to the server by the protocol version and wait for
+// the ready message
+func (c *Client) handshake(conn *websocket.Conn, protocol int) error {
+  // hash password, the plain password is required by servers using ldap,
+  // personal API tokens are sent as is, no password if the client certificate authenticates
+  secret := c.config.Auth.Password
+  if secret != "" && !c.config.SendPassword && !strings.HasPrefix(secret, utils.APITokenPrefix) {
+    hashBytes, err := bcrypt.GenerateFromPassword([]byte(c.config.Auth.Password), bcrypt.DefaultCost)
+    if err != nil {
+      return fmt.Errorf("failed to hash password: %w", err)
+    }
+    secret = utils.BytesToString(hashBytes)
+  }
+
+  // handshake with server, the older servers only know the colon separated one
+  data := utils.StringToBytes(c.config.Auth.User + ":" + secret + ":" + c.config.Mode)
+  if protocol >= utils.ProtocolVersion {
+    data, _ = json.Marshal(&utils.HandshakeInfo{
+      Protocol:     utils.ProtocolVersion,
+      User:         c.config.Auth.User,
+      Secret:       secret,
+      Mode:         c.config.Mode,
+      Version:      utils.Version,
+      Platform:     runtime.GOOS,
+      ClipTypes:    clientClipTypes,
+      Capabilities: []string{utils.CapCompression},
+    })
+  }
+
+  conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+  err := conn.WriteMessage(websocket.BinaryMessage, (&utils.WebsocketMessage{
     Action: utils.ActionHandshakeRegister,
     UserID: c.ID,
-    Data:   utils.StringToBytes(creds),
+    Data:   data,
   }).Encode())
 
   if err != nil {
     return fmt.Errorf("failed to send handshake message: %w", err)
   }
 
-  c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-  _, msg, err := c.conn.ReadMessage()
+  conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+  _, msg, err := conn.ReadMessage()
   if err != nil {
     return fmt.Errorf("failed to read message for handshake: %w", err)
   }
@@ -94,43 +251,144 @@ func (c *Client) connect() error {
 
   switch wsm.Action {
   case utils.ActionHandshakeReady:
-    log.Infoln("Hand shake succeed:", c.ID)
+    c.logger().Infoln("Hand shake succeed:", c.ID)
+
+    c.server = nil
+    if len(wsm.Data) > 0 {
+      info := &utils.ReadyInfo{}
+      if err := json.Unmarshal(wsm.Data, info); err != nil {
+        c.logger().Warnln("Failed to parse the ready info:", err)
+      } else {
+        c.server = info
+        c.logger().Infof("Server %s negotiated clip types %v, capabilities %v.", info.Version, info.ClipTypes, info.Capabilities)
+      }
+    }
+
+    // trust the certificate of the first successful connection
+    if err := c.trust.Remember(c.addr()); err != nil {
+      c.logger().Errorln("Failed to record server certificate:", err)
+    }
+  case utils.ActionError:
+    info := &utils.ErrorInfo{}
+    if err := json.Unmarshal(wsm.Data, info); err != nil {
+      return fmt.Errorf("failed to handshake with server: %w", err)
+    }
+    return fmt.Errorf("failed to handshake with server: %w", info)
   default:
-    // close the connection if handshake is not ready
-    c.conn.Close()
-    return fmt.Errorf("failed to handshake with server: %w", err)
+    return fmt.Errorf("failed to handshake with server: unexpected action %s", wsm.Action)
+  }
+
+  // subscribe the channels, the server replies the subscribed ones
+  if len(c.config.Channels) > 0 {
+    data, _ := json.Marshal(c.config.Channels)
+    err = conn.WriteMessage(websocket.BinaryMessage, (&utils.WebsocketMessage{
+      Action: utils.ActionSubscribe,
+      UserID: c.ID,
+      Data:   data,
+    }).Encode())
+    if err != nil {
+      return fmt.Errorf("failed to subscribe channels: %w", err)
+    }
   }
 
   return nil
 }
 
-// wsReconnect tries to reconnect to the server and returns
-// until it connects to the server.
-func (c *Client) reconnect(ctx context.Context) {
-  tk := time.NewTicker(10 * time.Second)
-  defer tk.Stop()
+// clips applied to the local clipboard within this window are not sent back
+const echoWindow = 30 * time.Second
+
+// serverDelay return the delay asked by the close frame of the server
+func serverDelay(err error) (time.Duration, bool) {
+  var closeErr *websocket.CloseError
+  if errors.As(err, &closeErr) {
+    return utils.ReconnectDelay(closeErr.Text)
+  }
+
+  return 0, false
+}
+
+// retryDelay return the delay asked by the server, or the next backoff
+func (c *Client) retryDelay(err error) time.Duration {
+  if delay, ok := serverDelay(err); ok {
+    return delay
+  }
+
+  var info *utils.ErrorInfo
+  if errors.As(err, &info) && info.RetryAfter > 0 {
+    return time.Duration(info.RetryAfter) * time.Second
+  }
+
+  return c.backoff.Next()
+}
+
+// reconnect tries to reconnect to the server after the delay and returns
+// until it connects to the server. The delay grows after each failure, and the
+// client switches between the configured and the discovered server when the
+// reconnections keep failing, it may have moved to another address. After an authentication failure the client stays
+// offline until the context is done.
+func (c *Client) reconnect(ctx context.Context, delay time.Duration, cause error) {
+  tm := time.NewTimer(delay)
+  defer tm.Stop()
+
+  failures := 0
   for {
+    if delay > 0 {
+      c.setState(StateEvent{State: StateBackoff, Err: cause, Retry: delay})
+    }
+
     select {
     case <-ctx.Done():
+      c.setState(StateEvent{State: StateOffline})
       return
-    case <-tk.C:
+    case <-tm.C:
+      if failures >= c.config.Discovery.Retries {
+        c.logger().Infof("Failed to reconnect %d times, look for the server again.", failures)
+        c.relocate(ctx)
+        failures = 0
+      }
+
+      c.setState(StateEvent{State: StateConnecting})
       err := c.connect()
       if err == nil {
-        log.Infoln("Connected to server succeed.")
+        c.logger().Infoln("Connected to server succeed.")
+        c.backoff.Reset()
+
+        dropped := c.queue.Dropped()
+        if dropped > 0 {
+          c.logger().Warnf("Dropped %d queued messages while disconnected.", dropped)
+        }
+        c.setState(StateEvent{State: StateReady, Dropped: dropped})
+
+        // send the messages queued while disconnected
+        c.queue.Wake()
         return
       }
-      log.Errorf("%v\n", err)
-      log.Infoln("Retry in 10 seconds..")
+      c.logger().Errorf("%v\n", err)
+
+      // retrying does not help until the credentials are fixed
+      if errors.Is(err, utils.ErrAuthFailed) {
+        c.logger().Errorln("Authentication failed, stop reconnecting until the client is restarted.")
+        c.setState(StateEvent{State: StateOffline, Err: err})
+        <-ctx.Done()
+        return
+      }
+
+      failures++
+      cause = err
+
+      delay = c.retryDelay(err)
+      c.logger().Infof("Retry in %v..", delay.Round(time.Millisecond))
+      tm.Reset(delay)
     }
   }
 }
 
 func (c *Client) handleIO(ctx context.Context, clipData <-chan []byte) {
   if c.conn == nil {
-    c.reconnect(ctx)
+    c.reconnect(ctx, 0, nil)
   }
 
-  log.Debugln("Client id:", c.ID)
+  c.logger().Debugln("Client id:", c.ID)
 
   // when auto mode, watch the clipboard content
   if clipData != nil {
@@ -145,36 +403,75 @@ func (c *Client) readFromServer(ctx context.Context) {
   for {
     select {
     case <-ctx.Done():
-      log.Infoln("Exit read routine.")
+      c.logger().Infoln("Exit read routine.")
       return
     default:
       c.conn.SetReadDeadline(time.Time{})
       _, msg, err := c.conn.ReadMessage()
       if err != nil {
-        log.Errorf("Failed to read message from server: %v", err)
+        c.logger().Errorf("Failed to read message from server: %v", err)
 
         c.Lock()
         c.conn.Close()
         c.conn = nil
         c.Unlock()
 
-        // block until connection is ready again
-        c.reconnect(ctx)
+        // block until connection is ready again, the server may ask for a delay when going away
+        c.reconnect(ctx, c.retryDelay(err), err)
         continue
       }
 
       wsm := &utils.WebsocketMessage{}
       err = wsm.Decode(msg)
       if err != nil {
-        log.Errorf("Failed to read message: %v", err)
+        c.logger().Errorf("Failed to read message: %v", err)
         continue
       }
 
       switch wsm.Action {
       case utils.ActionClipboardChanged:
-        log.Debugf("Clipboard data has changed from %s, sync with local...", wsm.UserID)
+        c.logger().Debugf("Clipboard data has changed from %s, sync with local...", wsm.UserID)
+
+        // the clipboard watch sees the write as a change, remember it is not ours
+        hash := wsm.Hash
+        if hash == "" {
+          hash = utils.ContentHash(wsm.Data)
+        }
+        c.recent.Add(hash)
+
+        if wsm.Channel != "" {
+          c.logger().Debugf("Clipboard data is from channel %s.", wsm.Channel)
+        }
         clipboard.Write(wsm.Data)
-        log.Debugf("Clipboard data has changed from %s, sync succeed.", wsm.UserID)
+        c.logger().Debugf("Clipboard data has changed from %s, sync succeed.", wsm.UserID)
+      case utils.ActionPresence:
+        event := &utils.PresenceEvent{}
+        if err := json.Unmarshal(wsm.Data, event); err == nil {
+          c.logger().Infof("Device %s %s from %s.", event.Device.ClientID, event.Event, event.Device.RemoteAddr)
+        }
+      case utils.ActionError:
+        info := &utils.ErrorInfo{}
+        if err := json.Unmarshal(wsm.Data, info); err != nil {
+          continue
+        }
+
+        // the connection is closed after the errors ending it, the read fails then
+        switch info.Code {
+        case utils.ErrorShutdown:
+          c.logger().Infof("Server is shutting down, reconnect in %d seconds.", info.RetryAfter)
+        case utils.ErrorTooLarge, utils.ErrorQuota, utils.ErrorRateLimited:
+          c.logger().Warnf("Server rejected the clip, code: %s, error: %s.", info.Code, info.Message)
+        default:
+          c.logger().Errorf("Server error, code: %s, error: %s.", info.Code, info.Message)
+        }
+      case utils.ActionSubscribe:
+        var channels []string
+        json.Unmarshal(wsm.Data, &channels)
+        if len(channels) < len(c.config.Channels) {
+          c.logger().Warnf("Subscribed channels %v of %v, not a member of the others.", channels, c.config.Channels)
+        } else {
+          c.logger().Infoln("Subscribed channels:", channels)
+        }
       }
     }
   }
@@ -184,21 +481,75 @@ func (c *Client) writeToServer(ctx context.Context) {
   for {
     select {
     case <-ctx.Done():
-      log.Infoln("Exit write routine.")
+      c.logger().Infoln("Exit write routine.")
       return
-    case msg := <-c.writeCh:
-      if c.conn == nil {
-        log.Errorln("connection is not ready yet for user:", c.ID)
-        continue
-      }
+    case <-c.queue.Ready():
+      c.flush()
+    }
+  }
+}
 
-      c.conn.SetWriteDeadline(time.Time{})
-      err := c.conn.WriteMessage(websocket.BinaryMessage, msg.Encode())
-      if err != nil {
-        log.Errorf("failed to write message to server: %v", err)
-        return
-      }
+// flush send the queued messages while the connection is ready, a failed one stays queued
+func (c *Client) flush() {
+  for c.State() == StateReady {
+    msg := c.queue.Peek()
+    if msg == nil {
+      return
     }
+
+    c.Lock()
+    conn := c.conn
+    c.Unlock()
+
+    if conn == nil {
+      return
+    }
+
+    conn.SetWriteDeadline(time.Time{})
+    err := conn.WriteMessage(websocket.BinaryMessage, msg.Encode())
+    if err != nil {
+      // the read routine fails on the closed connection and reconnects
+      c.logger().Errorf("failed to write message to server: %v", err)
+      conn.Close()
+      return
+    }
+
+    c.queue.Remove(msg)
+  }
+}
+
+// exceedsLimit return whether the clip is over the limits the server sent in the ready info
+func (c *Client) exceedsLimit(data []byte) bool {
+  c.Lock()
+  server := c.server
+  c.Unlock()
+
+  if server == nil {
+    return false
+  }
+
+  // the data is base64 encoded in the message
+  if server.Limits.MaxMsgSize > 0 && base64.StdEncoding.EncodedLen(len(data)) > server.Limits.MaxMsgSize {
+    return true
+  }
+
+  clipType, size := utils.ClipTypeOf(data)
+  limit := server.Limits.MaxSize(clipType)
+  return limit > 0 && size > limit
+}
+
+// send queue the message to the server without blocking, the clips over the limits of
+// the server are dropped
+func (c *Client) send(msg *utils.WebsocketMessage) {
+  if (msg.Action == utils.ActionClipboardChanged || msg.Action == utils.ActionClipboardPush) && c.exceedsLimit(msg.Data) {
+    c.logger().Warnf("Clip of %d bytes is over the limits of the server, not sent.", len(msg.Data))
+    return
+  }
+
+  c.queue.Push(msg)
+
+  if c.State() != StateReady {
+    c.logger().Infof("Connection is not ready, %d messages queued.", c.queue.Len())
   }
 }
 
@@ -206,29 +557,35 @@ func (c *Client) watchClipboard(ctx context.Context, clipData <-chan []byte) {
   for {
     select {
     case <-ctx.Done():
-      log.Infoln("Exit watch routine.")
+      c.logger().Infoln("Exit watch routine.")
       return
     case data, ok := <-clipData:
-      if c.conn == nil || !ok {
-        log.Errorln("connection is not ready yet for user:", c.ID)
-        continue
+      if !ok {
+        c.logger().Errorln("Clipboard data channel has been closed.")
+        return
       }
 
-      if !ok {
-        log.Errorln("Clipboard data channel has been closed.")
+      hash := utils.ContentHash(data)
+      // only the clips written by the server, the sent ones may be copied again after
+      // another clip was received
+      if c.recent.Contains(hash) {
+        c.logger().Debugln("Skip the clip applied recently.")
         continue
       }
 
-      c.writeCh <- &utils.WebsocketMessage{
-        Action: utils.ActionClipboardChanged,
-        UserID: c.ID,
-        Data:   data,
-      }
+      c.send(&utils.WebsocketMessage{
+        Action:  utils.ActionClipboardChanged,
+        UserID:  c.ID,
+        Data:    data,
+        Hash:    hash,
+        Channel: c.config.Channel,
+      })
     }
   }
 }
 
 func (c *Client) close() {
+  c.setState(StateEvent{State: StateOffline})
   if c.conn == nil {
     return
   }